@@ -2,6 +2,7 @@ package dbclient
 
 import (
 	"context"
+	"errors"
 	"time"
 	"turtle/core/lgr"
 	"turtle/core/serverKit"
@@ -21,6 +22,14 @@ type Client struct {
 
 var MongoClient *Client
 
+// ErrNotConnected is returned by repositories when MongoDB was not reachable at start
+var ErrNotConnected = errors.New("MongoDB is not connected")
+
+// IsConnected reports whether InitMongoDb connected
+func IsConnected() bool {
+	return MongoClient != nil
+}
+
 // NewClient creates a new MongoDB wrapper client
 func InitMongoDb() {
 
@@ -29,7 +38,7 @@ func InitMongoDb() {
 	client, err := mongo.Connect(context.Background(), clientOptions)
 
 	if err != nil {
-		lgr.ErrorStack("failed to connect to MongoDB: %w", err)
+		lgr.ErrorStack("failed to connect to MongoDB: %v", err)
 		return
 	}
 
@@ -38,7 +47,7 @@ func InitMongoDb() {
 	defer cancel()
 
 	if err := client.Ping(ctx, nil); err != nil {
-		lgr.ErrorStack("failed to ping MongoDB: %w", err)
+		lgr.ErrorStack("failed to ping MongoDB: %v", err)
 		return
 	}
 
@@ -53,11 +62,14 @@ func InitMongoDb() {
 }
 
 func Insert(ctx context.Context, collection string, document interface{}) (*mongo.InsertOneResult, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 
 	tmp, err := MongoClient.database.Collection(collection).InsertOne(ctx, document)
 
 	if err != nil {
-		lgr.ErrorStack("failed to insert documents: %w", err)
+		lgr.ErrorStack("failed to insert documents: %v", err)
 	}
 
 	return tmp, err
@@ -65,6 +77,9 @@ func Insert(ctx context.Context, collection string, document interface{}) (*mong
 }
 
 func FindOne[T any](ctx context.Context, collection string, filter interface{}) (*T, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 	var result T
 	err := MongoClient.database.Collection(collection).FindOne(ctx, filter).Decode(&result)
 
@@ -73,7 +88,7 @@ func FindOne[T any](ctx context.Context, collection string, filter interface{})
 			//lgr.Error("no document found in collection %s", collection)
 			return nil, err
 		}
-		//lgr.Error("failed to find document: %w", err)
+		//lgr.Error("failed to find document: %v", err)
 		return nil, err
 	}
 
@@ -81,18 +96,21 @@ func FindOne[T any](ctx context.Context, collection string, filter interface{})
 }
 
 func FindMany[T any](ctx context.Context, collection string, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 	results := []T{}
 
 	cursor, err := MongoClient.database.Collection(collection).Find(ctx, filter, opts...)
 	if err != nil {
-		lgr.Error("failed to find documents: %w", err)
+		lgr.Error("failed to find documents: %v", err)
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
 	err = cursor.All(ctx, &results)
 	if err != nil {
-		lgr.Error("failed to find documents: %w", err)
+		lgr.Error("failed to find documents: %v", err)
 		return results, err
 	}
 
@@ -100,11 +118,14 @@ func FindMany[T any](ctx context.Context, collection string, filter interface{},
 }
 
 func SetById(ctx context.Context, collection string, id primitive.ObjectID, dataToSet interface{}) (*mongo.UpdateResult, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 
 	tmp, err := MongoClient.database.Collection(collection).UpdateByID(ctx, id, bson.M{"$set": dataToSet})
 
 	if err != nil {
-		lgr.Error("failed to update documents: %w", err)
+		lgr.Error("failed to update documents: %v", err)
 		return tmp, err
 	} else {
 		return tmp, nil
@@ -114,11 +135,14 @@ func SetById(ctx context.Context, collection string, id primitive.ObjectID, data
 
 // IncrementBy increments fields in a MongoDB document by specified values
 func IncrementBy(ctx context.Context, collection string, id primitive.ObjectID, dataToIncrement interface{}) (*mongo.UpdateResult, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 
 	result, err := MongoClient.database.Collection(collection).UpdateByID(ctx, id, bson.M{"$inc": dataToIncrement})
 
 	if err != nil {
-		lgr.Error("failed to increment document fields: %w", err)
+		lgr.Error("failed to increment document fields: %v", err)
 		return result, err
 	}
 
@@ -127,11 +151,14 @@ func IncrementBy(ctx context.Context, collection string, id primitive.ObjectID,
 
 // DeleteById deletes a document from MongoDB by its ID
 func DeleteById(ctx context.Context, collection string, id primitive.ObjectID) (*mongo.DeleteResult, error) {
+	if !IsConnected() {
+		return nil, ErrNotConnected
+	}
 
 	result, err := MongoClient.database.Collection(collection).DeleteOne(ctx, bson.M{"_id": id})
 
 	if err != nil {
-		lgr.Error("failed to delete document: %w", err)
+		lgr.Error("failed to delete document: %v", err)
 		return result, err
 	}
 
@@ -19,8 +19,13 @@ type Repository[T any] struct {
 	timeout    time.Duration
 }
 
-// NewRepository creates a new repository for a specific entity type
+// NewRepository creates a new repository for a specific entity type, without
+// connected client its operations return ErrNotConnected
 func NewRepository[T any](client *Client, collectionName string) *Repository[T] {
+	if client == nil {
+		return &Repository[T]{}
+	}
+
 	return &Repository[T]{
 		collection: client.database.Collection(collectionName),
 		timeout:    client.timeout,
@@ -29,6 +34,10 @@ func NewRepository[T any](client *Client, collectionName string) *Repository[T]
 
 // InsertOne inserts a single document
 func (r *Repository[T]) InsertOne(ctx context.Context, entity *T) (primitive.ObjectID, error) {
+	if r.collection == nil {
+		return primitive.NilObjectID, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -46,6 +55,10 @@ func (r *Repository[T]) InsertOne(ctx context.Context, entity *T) (primitive.Obj
 
 // InsertMany inserts multiple documents
 func (r *Repository[T]) InsertMany(ctx context.Context, entities []T) ([]primitive.ObjectID, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -71,6 +84,10 @@ func (r *Repository[T]) InsertMany(ctx context.Context, entities []T) ([]primiti
 
 // FindOne finds a single document matching the filter
 func (r *Repository[T]) FindOne(ctx context.Context, filter interface{}) (*T, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -93,6 +110,10 @@ func (r *Repository[T]) FindByID(ctx context.Context, id primitive.ObjectID) (*T
 
 // FindMany finds all documents matching the filter
 func (r *Repository[T]) FindMany(ctx context.Context, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -117,6 +138,10 @@ func (r *Repository[T]) FindAll(ctx context.Context, opts ...*options.FindOption
 
 // UpdateOne updates a single document matching the filter
 func (r *Repository[T]) UpdateOne(ctx context.Context, filter interface{}, update interface{}) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -135,6 +160,10 @@ func (r *Repository[T]) UpdateByID(ctx context.Context, id primitive.ObjectID, u
 
 // UpdateMany updates all documents matching the filter
 func (r *Repository[T]) UpdateMany(ctx context.Context, filter interface{}, update interface{}) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -148,6 +177,10 @@ func (r *Repository[T]) UpdateMany(ctx context.Context, filter interface{}, upda
 
 // ReplaceOne replaces a single document matching the filter
 func (r *Repository[T]) ReplaceOne(ctx context.Context, filter interface{}, replacement *T) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -161,6 +194,10 @@ func (r *Repository[T]) ReplaceOne(ctx context.Context, filter interface{}, repl
 
 // DeleteOne deletes a single document matching the filter
 func (r *Repository[T]) DeleteOne(ctx context.Context, filter interface{}) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -179,6 +216,10 @@ func (r *Repository[T]) DeleteByID(ctx context.Context, id primitive.ObjectID) (
 
 // DeleteMany deletes all documents matching the filter
 func (r *Repository[T]) DeleteMany(ctx context.Context, filter interface{}) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -192,6 +233,10 @@ func (r *Repository[T]) DeleteMany(ctx context.Context, filter interface{}) (int
 
 // Count counts documents matching the filter
 func (r *Repository[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	if r.collection == nil {
+		return 0, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -214,6 +259,10 @@ func (r *Repository[T]) Exists(ctx context.Context, filter interface{}) (bool, e
 
 // Aggregate performs an aggregation pipeline
 func (r *Repository[T]) Aggregate(ctx context.Context, pipeline interface{}) ([]T, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -233,6 +282,10 @@ func (r *Repository[T]) Aggregate(ctx context.Context, pipeline interface{}) ([]
 
 // Distinct gets distinct values for a field
 func (r *Repository[T]) Distinct(ctx context.Context, fieldName string, filter interface{}) ([]interface{}, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+
 	ctx, cancel := context.WithTimeout(ctx, r.timeout)
 	defer cancel()
 
@@ -249,11 +302,20 @@ func (c *Client) Close(ctx context.Context) error {
 	return c.client.Disconnect(ctx)
 }
 
-// GetCollection returns the underlying mongo.Collection for advanced operations
+// GetCollection returns the underlying mongo.Collection for advanced operations,
+// it is nil without connected client
 func (r *Repository[T]) GetCollection() *mongo.Collection {
 	return r.collection
 }
 
+// Collection returns the underlying mongo.Collection or ErrNotConnected
+func (r *Repository[T]) Collection() (*mongo.Collection, error) {
+	if r.collection == nil {
+		return nil, ErrNotConnected
+	}
+	return r.collection, nil
+}
+
 // QueryBuilder provides a fluent interface for building queries
 type QueryBuilder[T any] struct {
 	repo   *Repository[T]
@@ -336,10 +398,14 @@ func (qb *QueryBuilder[T]) Count(ctx context.Context) (int64, error) {
 }
 
 func Count(ctx context.Context, collection string, filter interface{}) int64 {
+	if !IsConnected() {
+		return 0
+	}
+
 	tmp, err := MongoClient.database.Collection(collection).CountDocuments(ctx, filter)
 
 	if err != nil {
-		lgr.Error("failed to count documents: %w", err)
+		lgr.Error("failed to count documents: %v", err)
 		return 0
 	} else {
 		return tmp
@@ -1,12 +1,24 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 	"turtle/core/dbclient"
 	"turtle/core/lgr"
 	"turtle/core/serverKit"
+	"turtle/netes/controller"
 	"turtle/netes/deployListener"
+	"turtle/netes/events"
+	"turtle/netes/ingress"
+	"turtle/netes/jobs"
+	"turtle/netes/nodeInfo"
+	"turtle/netes/nodes"
+	"turtle/netes/secrets"
+	"turtle/netes/supervisor"
 
 	"github.com/gin-gonic/contrib/static"
 	"github.com/gin-gonic/gin"
@@ -15,12 +27,24 @@ import (
 //TIP <p>To run your code, right-click the code and select <b>Run</b>.</p> <p>Alternatively, click
 // the <icon src="AllIcons.Actions.Execute"/> icon in the gutter and select the <b>Run</b> menu item from here.</p>
 
+// How long shutdown waits for requests in progress
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
 func main() {
 	lgr.SetColors(true)
 	lgr.SetOutputFolder("../logs", "TurtleNetes", true)
 
 	serverKit.LoadGinConfig()
 	dbclient.InitMongoDb()
+	events.Start()
+
+	if _, err := jobs.RecoverInterruptedRuns(context.Background()); err != nil {
+		lgr.Error("Failed to recover interrupted job runs: %s", err.Error())
+	}
+
+	deployListener.StartReconciler()
+	deployListener.StartGarbageCollector()
+	ingress.Start()
 
 	lgr.Info("Starting server with config: %+v", serverKit.SERVER_CONFIG)
 	lgr.Info("Server URL: %s", serverKit.SERVER_CONFIG.GetURL())
@@ -31,6 +55,20 @@ func main() {
 	r.Use(static.Serve("/", static.LocalFile("./static", true)))
 
 	deployListener.InitDeployListenerApi(r)
+	supervisor.InitSupervisorApi(r)
+	secrets.InitSecretsApi(r)
+	jobs.InitJobsApi(r)
+	ingress.InitIngressApi(r)
+	events.InitEventsApi(r)
+
+	switch serverKit.SERVER_CONFIG.GetMode() {
+	case serverKit.MODE_AGENT:
+		nodeInfo.StartHeartbeat()
+	case serverKit.MODE_CONTROLLER:
+		nodes.InitNodesApi(r)
+		nodes.StartNodeMonitor()
+		controller.InitControllerApi(r)
+	}
 
 	// Create HTTP server with timeouts
 	srv := &http.Server{
@@ -44,7 +82,39 @@ func main() {
 	// Start server
 	lgr.Ok("Server is running at %s", serverKit.SERVER_CONFIG.GetURL())
 
-	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		lgr.ErrorStack("Failed to start server: %v", err)
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-serverErr:
+		if err != nil && err != http.ErrServerClosed {
+			lgr.ErrorStack("Failed to start server: %v", err)
+		}
+	case sig := <-signals:
+		lgr.Info("Received %s, shutting down", sig)
 	}
+
+	shutdown(srv)
+}
+
+// shutdown stops accepting requests, then cancels job runs and stops replicas with
+// their grace period so they are not left to be killed by the parent death signal
+func shutdown(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		lgr.Error("Failed to shut down server: %s", err.Error())
+	}
+
+	deployListener.StopReconciler()
+	jobs.JOBS.CancelAll()
+	supervisor.SUPERVISOR.StopAll()
+
+	lgr.Ok("Server stopped")
 }
@@ -0,0 +1,267 @@
+package appLogs
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"turtle/core/serverKit"
+)
+
+const (
+	STREAM_STDOUT = "stdout"
+	STREAM_STDERR = "stderr"
+	// Messages written by supervisor itself, e.g. process started/exited
+	STREAM_SYSTEM = "system"
+)
+
+var (
+	// Log file is rotated when it grows over LOG_MAX_SIZE, LOG_MAX_FILES rotated files are kept
+	LOG_MAX_SIZE  int64 = 10 << 20
+	LOG_MAX_FILES       = 5
+)
+
+const LOG_FILE_NAME = "app.log"
+
+// LogLine is one line of application output, stored as "<RFC3339Nano> <stream>/<replica> <text>"
+type LogLine struct {
+	Time       time.Time `json:"time"`
+	App        string    `json:"app"`
+	RevisionId string    `json:"revisionId"`
+	Replica    int       `json:"replica"`
+	Stream     string    `json:"stream"`
+	Text       string    `json:"text"`
+}
+
+func (self *LogLine) format() string {
+	return self.Time.UTC().Format(time.RFC3339Nano) + " " + self.Stream + "/" + strconv.Itoa(self.Replica) + " " + self.Text + "\n"
+}
+
+func parseLine(app, revisionId, raw string) (LogLine, bool) {
+	parts := strings.SplitN(raw, " ", 3)
+	if len(parts) < 3 {
+		return LogLine{}, false
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return LogLine{}, false
+	}
+
+	stream, replica, _ := strings.Cut(parts[1], "/")
+	replicaIndex, _ := strconv.Atoi(replica)
+
+	return LogLine{
+		Time:       parsed,
+		App:        app,
+		RevisionId: revisionId,
+		Replica:    replicaIndex,
+		Stream:     stream,
+		Text:       parts[2],
+	}, true
+}
+
+func GetLogsDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".logs")
+}
+
+func GetRevisionLogDir(app, revisionId string) string {
+	return filepath.Join(GetLogsDir(), app, revisionId)
+}
+
+// AppLog is rotating log of one app revision
+type AppLog struct {
+	app        string
+	revisionId string
+	dir        string
+	refs       int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var (
+	openMu   sync.Mutex
+	openLogs = map[string]*AppLog{}
+)
+
+// Open returns log of app revision, the log is shared by all its processes (e.g.
+// concurrent job runs) and every Open must be paired with Close
+func Open(app, revisionId string) (*AppLog, error) {
+	openMu.Lock()
+	defer openMu.Unlock()
+
+	key := app + "/" + revisionId
+
+	if existing, ok := openLogs[key]; ok {
+		existing.refs++
+		return existing, nil
+	}
+
+	result := &AppLog{
+		app:        app,
+		revisionId: revisionId,
+		dir:        GetRevisionLogDir(app, revisionId),
+	}
+
+	if err := os.MkdirAll(result.dir, 0755); err != nil {
+		return nil, err
+	}
+
+	if err := result.openFile(); err != nil {
+		return nil, err
+	}
+
+	result.refs = 1
+	openLogs[key] = result
+
+	return result, nil
+}
+
+func (self *AppLog) openFile() error {
+	file, err := os.OpenFile(filepath.Join(self.dir, LOG_FILE_NAME), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	self.file = file
+	self.size = info.Size()
+
+	return nil
+}
+
+// rotate shifts app.log -> app.log.1 -> app.log.2 ... and drops the oldest
+func (self *AppLog) rotate() error {
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+
+	base := filepath.Join(self.dir, LOG_FILE_NAME)
+
+	os.Remove(fmt.Sprintf("%s.%d", base, LOG_MAX_FILES))
+
+	for i := LOG_MAX_FILES - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", base, i), fmt.Sprintf("%s.%d", base, i+1))
+	}
+
+	if err := os.Rename(base, base+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return self.openFile()
+}
+
+func (self *AppLog) WriteLine(stream string, replica int, text string) {
+	line := LogLine{
+		Time:       time.Now(),
+		App:        self.app,
+		RevisionId: self.revisionId,
+		Replica:    replica,
+		Stream:     stream,
+		Text:       text,
+	}
+
+	formatted := line.format()
+
+	self.mu.Lock()
+	if self.size+int64(len(formatted)) > LOG_MAX_SIZE {
+		self.rotate()
+	}
+	if self.file != nil {
+		n, _ := self.file.WriteString(formatted)
+		self.size += int64(n)
+	}
+	self.mu.Unlock()
+
+	publish(line)
+}
+
+func (self *AppLog) Systemf(replica int, format string, args ...any) {
+	self.WriteLine(STREAM_SYSTEM, replica, fmt.Sprintf(format, args...))
+}
+
+// Writer returns io.Writer splitting process output of replica into lines of given stream
+func (self *AppLog) Writer(stream string, replica int) *StreamWriter {
+	return &StreamWriter{log: self, stream: stream, replica: replica}
+}
+
+func (self *AppLog) Close() error {
+	openMu.Lock()
+	self.refs--
+	if self.refs > 0 {
+		openMu.Unlock()
+		return nil
+	}
+	delete(openLogs, self.app+"/"+self.revisionId)
+	openMu.Unlock()
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.file == nil {
+		return nil
+	}
+
+	err := self.file.Close()
+	self.file = nil
+	return err
+}
+
+// Longer lines are split so a process without newlines can't exhaust memory
+const MAX_LINE_LENGTH = 64 << 10
+
+type StreamWriter struct {
+	log     *AppLog
+	stream  string
+	replica int
+	mu      sync.Mutex
+	pending []byte
+}
+
+func (self *StreamWriter) Write(data []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.pending = append(self.pending, data...)
+
+	for {
+		index := bytes.IndexByte(self.pending, '\n')
+
+		if index < 0 {
+			if len(self.pending) >= MAX_LINE_LENGTH {
+				self.log.WriteLine(self.stream, self.replica, string(self.pending[:MAX_LINE_LENGTH]))
+				self.pending = self.pending[MAX_LINE_LENGTH:]
+				continue
+			}
+			break
+		}
+
+		self.log.WriteLine(self.stream, self.replica, strings.TrimSuffix(string(self.pending[:index]), "\r"))
+		self.pending = self.pending[index+1:]
+	}
+
+	return len(data), nil
+}
+
+// Flush writes unterminated last line, called after process exits
+func (self *StreamWriter) Flush() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if len(self.pending) > 0 {
+		self.log.WriteLine(self.stream, self.replica, string(self.pending))
+		self.pending = nil
+	}
+}
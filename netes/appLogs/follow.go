@@ -0,0 +1,50 @@
+package appLogs
+
+import "sync"
+
+// Lines buffered for one follower, slower followers lose lines instead of blocking apps
+const FOLLOW_BUFFER = 256
+
+var (
+	followersMu sync.Mutex
+	followers   = map[string]map[chan LogLine]bool{}
+)
+
+// Follow subscribes to new lines of app, cancel must be called when done
+func Follow(app string) (<-chan LogLine, func()) {
+	ch := make(chan LogLine, FOLLOW_BUFFER)
+
+	followersMu.Lock()
+	if followers[app] == nil {
+		followers[app] = map[chan LogLine]bool{}
+	}
+	followers[app][ch] = true
+	followersMu.Unlock()
+
+	cancel := func() {
+		followersMu.Lock()
+		defer followersMu.Unlock()
+
+		if _, ok := followers[app][ch]; ok {
+			delete(followers[app], ch)
+			close(ch)
+		}
+		if len(followers[app]) == 0 {
+			delete(followers, app)
+		}
+	}
+
+	return ch, cancel
+}
+
+func publish(line LogLine) {
+	followersMu.Lock()
+	defer followersMu.Unlock()
+
+	for ch := range followers[line.App] {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package appLogs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type LogQuery struct {
+	App        string
+	RevisionId string
+	// Tail keeps only last N matching lines, 0 means all
+	Tail  int
+	Since time.Time
+	Until time.Time
+	// Replica filters lines of one replica, nil means all replicas
+	Replica *int
+}
+
+// Query reads rotated files of revision from oldest to newest
+func Query(query LogQuery) ([]LogLine, error) {
+	dir := GetRevisionLogDir(query.App, query.RevisionId)
+
+	if _, err := os.Stat(dir); err != nil {
+		return []LogLine{}, nil
+	}
+
+	base := filepath.Join(dir, LOG_FILE_NAME)
+
+	files := []string{}
+	for i := LOG_MAX_FILES; i >= 1; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", base, i))
+	}
+	files = append(files, base)
+
+	result := []LogLine{}
+
+	for _, path := range files {
+		err := scanFile(path, func(raw string) {
+			line, ok := parseLine(query.App, query.RevisionId, raw)
+			if !ok {
+				return
+			}
+			if !query.Since.IsZero() && line.Time.Before(query.Since) {
+				return
+			}
+			if !query.Until.IsZero() && line.Time.After(query.Until) {
+				return
+			}
+			if query.Replica != nil && line.Replica != *query.Replica {
+				return
+			}
+
+			result = append(result, line)
+
+			// Trim in batches so memory stays bounded on huge files
+			if query.Tail > 0 && len(result) > query.Tail*2 {
+				result = append([]LogLine{}, result[len(result)-query.Tail:]...)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if query.Tail > 0 && len(result) > query.Tail {
+		result = result[len(result)-query.Tail:]
+	}
+
+	return result, nil
+}
+
+func scanFile(path string, fn func(string)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), MAX_LINE_LENGTH+1024)
+
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+
+	return scanner.Err()
+}
+
+// RemoveRevisionLogs deletes logs of revision, used when revision is removed
+func RemoveRevisionLogs(app, revisionId string) error {
+	return os.RemoveAll(GetRevisionLogDir(app, revisionId))
+}
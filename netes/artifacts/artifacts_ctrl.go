@@ -0,0 +1,288 @@
+package artifacts
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ARTIFACTS_COLLECTION = "artifacts"
+
+// Unreferenced objects younger than this are kept, upload may be just creating its revision
+var GC_GRACE_PERIOD = 1 * time.Hour
+
+// Artifact tracks one stored object and how many revisions use it. Every node has
+// its own store, so the same content on two nodes is tracked twice.
+type Artifact struct {
+	Uid       primitive.ObjectID `json:"uid" bson:"_id"`
+	Node      string             `json:"node" bson:"node"`
+	Sha256    string             `json:"sha256" bson:"sha256"`
+	Size      int64              `json:"size" bson:"size"`
+	RefCount  int64              `json:"refCount" bson:"refCount"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+type StoreReport struct {
+	Objects             int64 `json:"objects"`
+	StoreBytes          int64 `json:"storeBytes"`
+	ReferencedBytes     int64 `json:"referencedBytes"`
+	ReclaimableBytes    int64 `json:"reclaimableBytes"`
+	UnreferencedObjects int64 `json:"unreferencedObjects"`
+	DiskBytes           int64 `json:"diskBytes"`
+	DiskObjects         int64 `json:"diskObjects"`
+	// Bytes of revision files that are hardlinks of stored objects, they use no disk.
+	// Filled from revision records by deploy listener.
+	SharedBytes int64 `json:"sharedBytes"`
+	// Bytes of revision files that are own copies of stored objects
+	CopiedBytes int64 `json:"copiedBytes"`
+}
+
+type GcResult struct {
+	RemovedObjects int64 `json:"removedObjects"`
+	RemovedBytes   int64 `json:"removedBytes"`
+}
+
+func artifactsRepo() *dbclient.Repository[Artifact] {
+	return dbclient.NewRepository[Artifact](dbclient.MongoClient, ARTIFACTS_COLLECTION)
+}
+
+func artifactUid(node, sha256Hex string) primitive.ObjectID {
+	return tools.StringToObjectID(node + "/sha256/" + sha256Hex)
+}
+
+// EnsureIndexes creates indexes of GC and store report queries
+func EnsureIndexes(ctx context.Context) error {
+	collection, err := artifactsRepo().Collection()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys: bson.D{{Key: "node", Value: 1}, {Key: "refCount", Value: 1}, {Key: "updatedAt", Value: 1}},
+		},
+	})
+	return err
+}
+
+// Track records objects in Mongo, existing objects are only touched
+func Track(ctx context.Context, sizes map[string]int64) error {
+	if len(sizes) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	node := serverKit.SERVER_CONFIG.GetNodeName()
+	models := make([]mongo.WriteModel, 0, len(sizes))
+
+	for sum, size := range sizes {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": artifactUid(node, sum)}).
+			SetUpdate(bson.M{
+				"$set": bson.M{"updatedAt": now},
+				"$setOnInsert": bson.M{
+					"node":      node,
+					"sha256":    sum,
+					"size":      size,
+					"refCount":  0,
+					"createdAt": now,
+				},
+			}).
+			SetUpsert(true))
+	}
+
+	collection, err := artifactsRepo().Collection()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return fmt.Errorf("failed to track artifacts: %w", err)
+	}
+
+	return nil
+}
+
+// TrackFiles records package and files of revision in Mongo
+func TrackFiles(ctx context.Context, packageSha256 string, packageSize int64, files []FileEntry) error {
+	sizes := map[string]int64{packageSha256: packageSize}
+
+	for _, file := range files {
+		if file.Sha256 != "" {
+			sizes[file.Sha256] = file.Size
+		}
+	}
+
+	return Track(ctx, sizes)
+}
+
+// ReferencedHashes returns unique hashes revision with package and files points to
+func ReferencedHashes(packageSha256 string, files []FileEntry) []string {
+	seen := map[string]bool{}
+	result := []string{}
+
+	add := func(sum string) {
+		if sum != "" && !seen[sum] {
+			seen[sum] = true
+			result = append(result, sum)
+		}
+	}
+
+	add(packageSha256)
+	for _, file := range files {
+		add(file.Sha256)
+	}
+
+	return result
+}
+
+func AddReferences(ctx context.Context, hashes []string) error {
+	return changeReferences(ctx, hashes, 1)
+}
+
+func RemoveReferences(ctx context.Context, hashes []string) error {
+	return changeReferences(ctx, hashes, -1)
+}
+
+func changeReferences(ctx context.Context, hashes []string, delta int64) error {
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	node := serverKit.SERVER_CONFIG.GetNodeName()
+
+	uids := make([]primitive.ObjectID, len(hashes))
+	for i, sum := range hashes {
+		uids[i] = artifactUid(node, sum)
+	}
+
+	_, err := artifactsRepo().UpdateMany(ctx,
+		bson.M{"_id": bson.M{"$in": uids}, "node": node},
+		bson.M{
+			"$inc": bson.M{"refCount": delta},
+			"$set": bson.M{"updatedAt": time.Now()},
+		},
+	)
+
+	return err
+}
+
+// CollectGarbage removes unreferenced objects of this node older than GC_GRACE_PERIOD
+func CollectGarbage(ctx context.Context) (GcResult, error) {
+	result := GcResult{}
+
+	unreferenced, err := artifactsRepo().FindMany(ctx, bson.M{
+		"node":      serverKit.SERVER_CONFIG.GetNodeName(),
+		"refCount":  bson.M{"$lte": 0},
+		"updatedAt": bson.M{"$lt": time.Now().Add(-GC_GRACE_PERIOD)},
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for _, artifact := range unreferenced {
+		removed, err := collectObject(ctx, artifact)
+		if err != nil {
+			return result, err
+		}
+		if removed {
+			result.RemovedObjects++
+			result.RemovedBytes += artifact.Size
+		}
+	}
+
+	if result.RemovedObjects > 0 {
+		lgr.Info("Artifact GC removed %d objects, %d bytes", result.RemovedObjects, result.RemovedBytes)
+	}
+
+	return result, nil
+}
+
+// collectObject removes unreferenced object unless an upload reused it meanwhile,
+// uploads can't reuse it while it is being removed
+func collectObject(ctx context.Context, artifact Artifact) (bool, error) {
+	storeMu.Lock()
+	defer storeMu.Unlock()
+
+	if objectInUse(artifact.Sha256) {
+		return false, nil
+	}
+
+	// Re-check with delete filter, reference could be added meanwhile
+	deleted, err := artifactsRepo().DeleteOne(ctx, bson.M{
+		"_id":      artifact.Uid,
+		"refCount": bson.M{"$lte": 0},
+	})
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+
+	if err := removeObject(artifact.Sha256); err != nil {
+		lgr.Error("Failed to remove object %s: %s", artifact.Sha256, err.Error())
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// GetStoreReport sums tracked objects of this node in Mongo and objects on disk
+func GetStoreReport(ctx context.Context) (*StoreReport, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"node": serverKit.SERVER_CONFIG.GetNodeName()}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":     bson.M{"$gt": bson.A{"$refCount", 0}},
+			"objects": bson.M{"$sum": 1},
+			"bytes":   bson.M{"$sum": "$size"},
+		}}},
+	}
+
+	collection, err := artifactsRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate artifacts: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Referenced bool  `bson:"_id"`
+		Objects    int64 `bson:"objects"`
+		Bytes      int64 `bson:"bytes"`
+	}
+
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	report := &StoreReport{}
+
+	for _, group := range groups {
+		report.Objects += group.Objects
+		report.StoreBytes += group.Bytes
+
+		if group.Referenced {
+			report.ReferencedBytes += group.Bytes
+		} else {
+			report.ReclaimableBytes += group.Bytes
+			report.UnreferencedObjects += group.Objects
+		}
+	}
+
+	report.DiskBytes, report.DiskObjects = diskUsage()
+
+	return report, nil
+}
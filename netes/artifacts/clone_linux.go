@@ -0,0 +1,42 @@
+//go:build linux
+
+package artifacts
+
+import (
+	"io/fs"
+	"os"
+	"syscall"
+)
+
+// FICLONE ioctl shares blocks of src with dst, btrfs and xfs support it
+const FICLONE = 0x40049409
+
+// cloneFile creates dst as reflink of src, it fails where filesystem can't do it
+func cloneFile(src, dst string, perm fs.FileMode) error {
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), FICLONE, source.Fd())
+	closeErr := target.Close()
+
+	err = closeErr
+	if errno != 0 {
+		err = errno
+	}
+	if err == nil {
+		// Umask could drop bits of perm
+		err = os.Chmod(dst, perm)
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package artifacts
+
+import (
+	"errors"
+	"io/fs"
+)
+
+// cloneFile is not supported, files are copied
+func cloneFile(src, dst string, perm fs.FileMode) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,360 @@
+package artifacts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"turtle/core/serverKit"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Stored objects are read-only because immutable revisions hardlink them, apps write
+// into their data dir. Executable bits of files are kept.
+const OBJECT_MODE = 0444
+
+// errNotLinked tells revision file could not be hardlinked to stored object and is
+// its own copy of the content
+var errNotLinked = errors.New("file is not hardlinked to stored object")
+
+// storeMu lets uploads reuse objects without GC removing them in between,
+// uploads hold read lock, GC holds write lock while removing an object
+var storeMu sync.RWMutex
+
+// FileEntry is one file of unpacked revision, symlinks have Link and no hash
+type FileEntry struct {
+	Path   string      `json:"path" bson:"path"`
+	Sha256 string      `json:"sha256,omitempty" bson:"sha256,omitempty"`
+	Size   int64       `json:"size" bson:"size"`
+	Mode   fs.FileMode `json:"mode" bson:"mode"`
+	Link   string      `json:"link,omitempty" bson:"link,omitempty"`
+	// File is own copy of stored object instead of its hardlink, e.g. store is on
+	// other filesystem or the object has other executable bits
+	Copied bool `json:"copied,omitempty" bson:"copied,omitempty"`
+}
+
+func GetStoreDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".store")
+}
+
+// GetObjectPath returns where content with given hash lives, e.g. .store/sha256/ab/abcdef...
+func GetObjectPath(sha256Hex string) string {
+	return filepath.Join(GetStoreDir(), "sha256", sha256Hex[:2], sha256Hex)
+}
+
+func HasObject(sha256Hex string) bool {
+	_, err := os.Stat(GetObjectPath(sha256Hex))
+	return err == nil
+}
+
+// putObject moves file into store unless the same content is already there, then
+// the file is removed. Reused object is touched so GC keeps it through grace period.
+// Caller holds storeMu read lock.
+func putObject(path, sha256Hex string, perm fs.FileMode) (string, error) {
+	objectPath := GetObjectPath(sha256Hex)
+
+	if _, err := os.Stat(objectPath); err == nil {
+		now := time.Now()
+		os.Chtimes(objectPath, now, now)
+		return objectPath, os.Remove(path)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return "", err
+	}
+
+	if err := os.Chmod(path, perm); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(path, objectPath); err != nil {
+		// Another upload could store the same content meanwhile
+		if _, statErr := os.Stat(objectPath); statErr == nil {
+			return objectPath, os.Remove(path)
+		}
+		return "", err
+	}
+
+	return objectPath, nil
+}
+
+// PutPackage moves uploaded package file into store
+func PutPackage(path, sha256Hex string) error {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	_, err := putObject(path, sha256Hex, OBJECT_MODE)
+	return err
+}
+
+// IngestDir moves every regular file of dir into store and replaces it with hardlink
+// to stored object, so identical files of many revisions use disk once. Revision
+// files become read-only like the objects, where hardlink is not possible the file
+// stays its own read-only copy.
+func IngestDir(dir string) ([]FileEntry, error) {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	entries := []FileEntry{}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path == dir || d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, FileEntry{
+				Path: filepath.ToSlash(rel),
+				Mode: info.Mode(),
+				Link: link,
+			})
+			return nil
+		}
+
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("unsupported file type of %s", rel)
+		}
+
+		sum, err := HashFile(path)
+		if err != nil {
+			return err
+		}
+
+		err = linkIntoStore(path, sum, info.Mode())
+		if err != nil && !errors.Is(err, errNotLinked) {
+			return err
+		}
+
+		entries = append(entries, FileEntry{
+			Path:   filepath.ToSlash(rel),
+			Sha256: sum,
+			Size:   info.Size(),
+			Mode:   info.Mode(),
+			Copied: err != nil,
+		})
+
+		return nil
+	})
+
+	return entries, err
+}
+
+// objectMode is mode of stored object, read-only with executable bits of file
+func objectMode(mode fs.FileMode) fs.FileMode {
+	return OBJECT_MODE | mode.Perm()&0111
+}
+
+// linkIntoStore stores file unless its content was stored before and links file to
+// stored object, errNotLinked is returned when file is left as its own copy. Caller
+// holds storeMu read lock.
+func linkIntoStore(path, sum string, mode fs.FileMode) error {
+	objectPath := GetObjectPath(sum)
+
+	if _, err := os.Stat(objectPath); err != nil {
+		if err := addObject(path, sum, objectMode(mode)); err != nil {
+			return err
+		}
+	} else {
+		now := time.Now()
+		os.Chtimes(objectPath, now, now)
+	}
+
+	err := replaceWithObject(objectPath, path, mode)
+	if errors.Is(err, errNotLinked) {
+		// Copy is as read-only as linked files of the revision
+		if chmodErr := os.Chmod(path, objectMode(mode)); chmodErr != nil {
+			return chmodErr
+		}
+	}
+	return err
+}
+
+// addObject puts content of file into store, as the same inode where possible
+func addObject(path, sum string, perm fs.FileMode) error {
+	tmpDir := filepath.Join(GetStoreDir(), "tmp")
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return err
+	}
+
+	tmpPath := filepath.Join(tmpDir, sum+"."+primitive.NewObjectID().Hex())
+
+	if err := os.Link(path, tmpPath); err != nil {
+		if err := CopyFile(path, tmpPath, perm); err != nil {
+			return err
+		}
+	}
+
+	if _, err := putObject(tmpPath, sum, perm); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// replaceWithObject replaces file with hardlink of stored object. Shared inode has
+// one mode, so object with other executable bits than file is not linked and
+// errNotLinked is returned like when hardlink fails.
+func replaceWithObject(objectPath, path string, mode fs.FileMode) error {
+	objectInfo, err := os.Stat(objectPath)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Lstat(path); err == nil && os.SameFile(info, objectInfo) {
+		return nil
+	}
+
+	if objectInfo.Mode().Perm() != objectMode(mode) {
+		return errNotLinked
+	}
+
+	tmpPath := path + ".link"
+
+	if err := os.Link(objectPath, tmpPath); err != nil {
+		return errNotLinked
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
+
+// LinkObject hardlinks stored object to path, where it is not possible or the object
+// has other executable bits it is copied with mode, as reflink when filesystem
+// supports it
+func LinkObject(sha256Hex, path string, mode fs.FileMode) error {
+	storeMu.RLock()
+	defer storeMu.RUnlock()
+
+	objectPath := GetObjectPath(sha256Hex)
+
+	objectInfo, err := os.Stat(objectPath)
+	if err != nil {
+		return fmt.Errorf("object %s is missing in store: %w", sha256Hex, err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	os.Chtimes(objectPath, now, now)
+
+	if objectInfo.Mode().Perm() == objectMode(mode) {
+		if err := os.Link(objectPath, path); err == nil {
+			return nil
+		}
+	}
+
+	return CopyFile(objectPath, path, objectMode(mode))
+}
+
+// CopyFile creates dst with content of src, as reflink when filesystem supports it
+func CopyFile(src, dst string, perm fs.FileMode) error {
+	if err := cloneFile(src, dst, perm); err == nil {
+		return nil
+	}
+
+	source, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	target, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(target, source)
+	closeErr := target.Close()
+
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// Umask could drop bits of perm
+		err = os.Chmod(dst, perm)
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+func HashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// objectInUse tells object was reused by upload within grace period, caller holds storeMu
+func objectInUse(sha256Hex string) bool {
+	info, err := os.Stat(GetObjectPath(sha256Hex))
+	return err == nil && time.Since(info.ModTime()) < GC_GRACE_PERIOD
+}
+
+func removeObject(sha256Hex string) error {
+	err := os.Remove(GetObjectPath(sha256Hex))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// diskUsage walks store folder and sums sizes of objects
+func diskUsage() (int64, int64) {
+	var size, count int64
+
+	filepath.WalkDir(filepath.Join(GetStoreDir(), "sha256"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+			count++
+		}
+		return nil
+	})
+
+	return size, count
+}
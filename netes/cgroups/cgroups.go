@@ -0,0 +1,309 @@
+package cgroups
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+)
+
+// Controllers enabled for app sub-trees, parent of the root must delegate them
+var CONTROLLERS = []string{"cpu", "memory", "pids"}
+
+// CPU_PERIOD_USEC is period of cpu.max, quota is cores * period
+const CPU_PERIOD_USEC = 100000
+
+// Kernel rejects smaller quota
+const MIN_CPU_QUOTA_USEC = 1000
+
+// How long Remove waits for killed processes to leave the cgroup
+var REMOVE_TIMEOUT = 5 * time.Second
+
+var ErrNoCgroup = errors.New("cgroup is not available")
+
+// Limits of one cgroup, zero means unlimited
+type Limits struct {
+	Cpu            float64
+	MemoryMaxBytes int64
+	PidsMax        int64
+}
+
+func LimitsFromResources(resources manifest.Resources) Limits {
+	return Limits{
+		Cpu:            resources.Cpu,
+		MemoryMaxBytes: resources.MemoryMb * 1024 * 1024,
+		PidsMax:        resources.MaxPids,
+	}
+}
+
+func (self Limits) IsEmpty() bool {
+	return self.Cpu == 0 && self.MemoryMaxBytes == 0 && self.PidsMax == 0
+}
+
+// Usage counters read from cgroup files, limits are 0 when unlimited
+type Usage struct {
+	CpuUsageUsec       uint64  `json:"cpuUsageUsec" bson:"cpuUsageUsec"`
+	CpuThrottledUsec   uint64  `json:"cpuThrottledUsec" bson:"cpuThrottledUsec"`
+	CpuMax             float64 `json:"cpuMax" bson:"cpuMax"`
+	MemoryCurrentBytes uint64  `json:"memoryCurrentBytes" bson:"memoryCurrentBytes"`
+	MemoryPeakBytes    uint64  `json:"memoryPeakBytes" bson:"memoryPeakBytes"`
+	MemoryMaxBytes     uint64  `json:"memoryMaxBytes" bson:"memoryMaxBytes"`
+	OomKills           uint64  `json:"oomKills" bson:"oomKills"`
+	PidsCurrent        uint64  `json:"pidsCurrent" bson:"pidsCurrent"`
+	PidsMax            uint64  `json:"pidsMax" bson:"pidsMax"`
+}
+
+// Cgroup is a leaf cgroup of one app instance
+type Cgroup struct {
+	Path string
+}
+
+func GetRoot() string {
+	return serverKit.SERVER_CONFIG.GetCgroupRoot()
+}
+
+// Create makes <root>/<app>/<instance>, enables controllers on the way and writes
+// limits, existing cgroup is reused and its limits are overwritten
+func Create(app, instance string, limits Limits) (*Cgroup, error) {
+	root := GetRoot()
+
+	if _, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoCgroup, err)
+	}
+
+	appDir := filepath.Join(root, app)
+	leaf := filepath.Join(appDir, instance)
+
+	if err := os.MkdirAll(leaf, 0755); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoCgroup, err)
+	}
+
+	cgroup := &Cgroup{Path: leaf}
+
+	// Processes may only live in leaves, controllers of children are enabled in parents
+	for _, dir := range []string{root, appDir} {
+		if err := enableControllers(dir); err != nil {
+			cgroup.Remove()
+			return nil, err
+		}
+	}
+
+	if err := cgroup.SetLimits(limits); err != nil {
+		cgroup.Remove()
+		return nil, err
+	}
+
+	return cgroup, nil
+}
+
+// Open returns existing cgroup of app instance or nil
+func Open(app, instance string) *Cgroup {
+	path := filepath.Join(GetRoot(), app, instance)
+
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+
+	return &Cgroup{Path: path}
+}
+
+func enableControllers(dir string) error {
+	enabled := map[string]bool{}
+
+	data, err := os.ReadFile(filepath.Join(dir, "cgroup.subtree_control"))
+	if err == nil {
+		for _, controller := range strings.Fields(string(data)) {
+			enabled[controller] = true
+		}
+	}
+
+	missing := []string{}
+	for _, controller := range CONTROLLERS {
+		if !enabled[controller] {
+			missing = append(missing, "+"+controller)
+		}
+	}
+
+	if len(missing) == 0 {
+		return nil
+	}
+
+	if err := writeFile(dir, "cgroup.subtree_control", strings.Join(missing, " ")); err != nil {
+		return fmt.Errorf("failed to enable controllers %v in %s: %w", missing, dir, err)
+	}
+
+	return nil
+}
+
+func (self *Cgroup) SetLimits(limits Limits) error {
+	cpuMax := "max"
+	if limits.Cpu > 0 {
+		quota := int64(limits.Cpu * CPU_PERIOD_USEC)
+		if quota < MIN_CPU_QUOTA_USEC {
+			quota = MIN_CPU_QUOTA_USEC
+		}
+		cpuMax = strconv.FormatInt(quota, 10)
+	}
+
+	values := []struct {
+		file  string
+		value string
+	}{
+		{"cpu.max", cpuMax + " " + strconv.Itoa(CPU_PERIOD_USEC)},
+		{"memory.max", formatMax(limits.MemoryMaxBytes)},
+		{"pids.max", formatMax(limits.PidsMax)},
+	}
+
+	for _, entry := range values {
+		if err := writeFile(self.Path, entry.file, entry.value); err != nil {
+			return fmt.Errorf("failed to set %s of %s: %w", entry.file, self.Path, err)
+		}
+	}
+
+	return nil
+}
+
+// Remove deletes the cgroup, processes killed by Kill leave it asynchronously so
+// it waits until cgroup.events reports it is not populated
+func (self *Cgroup) Remove() error {
+	deadline := time.Now().Add(REMOVE_TIMEOUT)
+
+	for {
+		err := os.Remove(self.Path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		if !errors.Is(err, syscall.EBUSY) || time.Now().After(deadline) {
+			return err
+		}
+
+		self.waitEmpty(deadline)
+	}
+}
+
+// waitEmpty polls cgroup.events until no process is left or deadline passes
+func (self *Cgroup) waitEmpty(deadline time.Time) {
+	for time.Now().Before(deadline) {
+		events := readKeyValues(filepath.Join(self.Path, "cgroup.events"))
+		if populated, ok := events["populated"]; ok && populated == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Usage reads counters, files missing on older kernels stay zero
+func (self *Cgroup) Usage() Usage {
+	usage := Usage{}
+
+	cpuStat := readKeyValues(filepath.Join(self.Path, "cpu.stat"))
+	usage.CpuUsageUsec = cpuStat["usage_usec"]
+	usage.CpuThrottledUsec = cpuStat["throttled_usec"]
+
+	usage.CpuMax = readCpuMax(filepath.Join(self.Path, "cpu.max"))
+
+	usage.MemoryCurrentBytes = readUint(filepath.Join(self.Path, "memory.current"))
+	usage.MemoryPeakBytes = readUint(filepath.Join(self.Path, "memory.peak"))
+	usage.MemoryMaxBytes = readUint(filepath.Join(self.Path, "memory.max"))
+	usage.OomKills = readKeyValues(filepath.Join(self.Path, "memory.events"))["oom_kill"]
+
+	usage.PidsCurrent = readUint(filepath.Join(self.Path, "pids.current"))
+	usage.PidsMax = readUint(filepath.Join(self.Path, "pids.max"))
+
+	return usage
+}
+
+func formatMax(value int64) string {
+	if value <= 0 {
+		return "max"
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// writeFile writes cgroup control file like echo > file does, cgroupfs ignores
+// truncation and create, they matter only for fake cgroupfs directories
+func writeFile(dir, name, value string) error {
+	file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(value)
+	closeErr := file.Close()
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// readUint returns 0 for missing files and "max"
+func readUint(path string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+// readCpuMax converts "quota period" to cores, 0 when unlimited
+func readCpuMax(path string) float64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) != 2 || fields[0] == "max" {
+		return 0
+	}
+
+	quota, err1 := strconv.ParseFloat(fields[0], 64)
+	period, err2 := strconv.ParseFloat(fields[1], 64)
+	if err1 != nil || err2 != nil || period == 0 {
+		return 0
+	}
+
+	return quota / period
+}
+
+// readKeyValues parses flat keyed files like cpu.stat and memory.events
+func readKeyValues(path string) map[string]uint64 {
+	result := map[string]uint64{}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return result
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if value, err := strconv.ParseUint(fields[1], 10, 64); err == nil {
+			result[fields[0]] = value
+		}
+	}
+
+	return result
+}
+
+// Kill kills every process left in the cgroup, needs cgroup.kill from kernel 5.14
+func (self *Cgroup) Kill() error {
+	return writeFile(self.Path, "cgroup.kill", "1")
+}
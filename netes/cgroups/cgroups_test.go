@@ -0,0 +1,226 @@
+package cgroups
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"turtle/core/serverKit"
+)
+
+// useFakeRoot points cgroup root at empty temp dir standing for delegated cgroupfs
+func useFakeRoot(t *testing.T) string {
+	t.Helper()
+
+	root := t.TempDir()
+	previous := serverKit.SERVER_CONFIG
+	serverKit.SERVER_CONFIG = &serverKit.GinServerConfig{
+		CgroupRoot: root,
+	}
+	t.Cleanup(func() {
+		serverKit.SERVER_CONFIG = previous
+	})
+
+	return root
+}
+
+func readControlFile(t *testing.T, dir, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits Limits
+		// Limits set by SetLimits after Create when not nil
+		update *Limits
+
+		wantCpuMax    string
+		wantMemoryMax string
+		wantPidsMax   string
+	}{
+		{
+			name:          "unlimited",
+			wantCpuMax:    "max 100000",
+			wantMemoryMax: "max",
+			wantPidsMax:   "max",
+		},
+		{
+			name:          "all limits",
+			limits:        Limits{Cpu: 1.5, MemoryMaxBytes: 256 * 1024 * 1024, PidsMax: 64},
+			wantCpuMax:    "150000 100000",
+			wantMemoryMax: "268435456",
+			wantPidsMax:   "64",
+		},
+		{
+			name:          "cpu quota below kernel minimum",
+			limits:        Limits{Cpu: 0.001},
+			wantCpuMax:    "1000 100000",
+			wantMemoryMax: "max",
+			wantPidsMax:   "max",
+		},
+		{
+			name:          "limits overwritten",
+			limits:        Limits{Cpu: 2, MemoryMaxBytes: 1024, PidsMax: 10},
+			update:        &Limits{Cpu: 0.5},
+			wantCpuMax:    "50000 100000",
+			wantMemoryMax: "max",
+			wantPidsMax:   "max",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := useFakeRoot(t)
+
+			cgroup, err := Create("app", "replica-0", test.limits)
+			if err != nil {
+				t.Fatalf("Create() failed: %v", err)
+			}
+
+			if want := filepath.Join(root, "app", "replica-0"); cgroup.Path != want {
+				t.Fatalf("Create() path = %s, want %s", cgroup.Path, want)
+			}
+
+			if test.update != nil {
+				if err := cgroup.SetLimits(*test.update); err != nil {
+					t.Fatalf("SetLimits() failed: %v", err)
+				}
+			}
+
+			// Children get controllers from subtree_control of every parent
+			for _, dir := range []string{root, filepath.Join(root, "app")} {
+				if got := readControlFile(t, dir, "cgroup.subtree_control"); got != "+cpu +memory +pids" {
+					t.Errorf("subtree_control of %s = %q, want all controllers", dir, got)
+				}
+			}
+
+			if got := readControlFile(t, cgroup.Path, "cpu.max"); got != test.wantCpuMax {
+				t.Errorf("cpu.max = %q, want %q", got, test.wantCpuMax)
+			}
+			if got := readControlFile(t, cgroup.Path, "memory.max"); got != test.wantMemoryMax {
+				t.Errorf("memory.max = %q, want %q", got, test.wantMemoryMax)
+			}
+			if got := readControlFile(t, cgroup.Path, "pids.max"); got != test.wantPidsMax {
+				t.Errorf("pids.max = %q, want %q", got, test.wantPidsMax)
+			}
+
+			if opened := Open("app", "replica-0"); opened == nil || opened.Path != cgroup.Path {
+				t.Errorf("Open() = %v, want cgroup at %s", opened, cgroup.Path)
+			}
+		})
+	}
+}
+
+func TestCreateWithoutRoot(t *testing.T) {
+	root := useFakeRoot(t)
+	serverKit.SERVER_CONFIG.CgroupRoot = filepath.Join(root, "missing")
+
+	if _, err := Create("app", "replica-0", Limits{}); !errors.Is(err, ErrNoCgroup) {
+		t.Fatalf("Create() error = %v, want ErrNoCgroup", err)
+	}
+	if Open("app", "replica-0") != nil {
+		t.Fatal("Open() found cgroup under missing root")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  Usage
+	}{
+		{
+			name: "all counters",
+			files: map[string]string{
+				"cpu.stat":       "usage_usec 123456\nuser_usec 100000\nsystem_usec 23456\nnr_periods 10\nnr_throttled 2\nthrottled_usec 789\n",
+				"cpu.max":        "50000 100000\n",
+				"memory.current": "1048576\n",
+				"memory.peak":    "2097152\n",
+				"memory.max":     "268435456\n",
+				"memory.events":  "low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n",
+				"pids.current":   "3\n",
+				"pids.max":       "64\n",
+			},
+			want: Usage{
+				CpuUsageUsec:       123456,
+				CpuThrottledUsec:   789,
+				CpuMax:             0.5,
+				MemoryCurrentBytes: 1048576,
+				MemoryPeakBytes:    2097152,
+				MemoryMaxBytes:     268435456,
+				OomKills:           1,
+				PidsCurrent:        3,
+				PidsMax:            64,
+			},
+		},
+		{
+			name: "unlimited",
+			files: map[string]string{
+				"cpu.max":        "max 100000\n",
+				"memory.current": "4096\n",
+				"memory.max":     "max\n",
+				"pids.current":   "1\n",
+				"pids.max":       "max\n",
+			},
+			want: Usage{
+				MemoryCurrentBytes: 4096,
+				PidsCurrent:        1,
+			},
+		},
+		{
+			name: "files missing on older kernel",
+			files: map[string]string{
+				"cpu.stat":       "usage_usec 10\n",
+				"memory.current": "4096\n",
+			},
+			want: Usage{
+				CpuUsageUsec:       10,
+				MemoryCurrentBytes: 4096,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			for name, content := range test.files {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			cgroup := &Cgroup{Path: dir}
+
+			if got := cgroup.Usage(); got != test.want {
+				t.Fatalf("Usage() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEnableControllersKeepsEnabled(t *testing.T) {
+	root := useFakeRoot(t)
+
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte("cpu memory io\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Create("app", "replica-0", Limits{}); err != nil {
+		t.Fatalf("Create() failed: %v", err)
+	}
+
+	// Real cgroupfs applies the write on top of enabled controllers, fake file only
+	// shows what was written
+	if got := readControlFile(t, root, "cgroup.subtree_control"); strings.TrimSpace(got) != "+pids" {
+		t.Fatalf("subtree_control of root = %q, want only missing controller enabled", got)
+	}
+}
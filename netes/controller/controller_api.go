@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"turtle/core/auth"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/deployListener"
+	"turtle/netes/nodes"
+	"turtle/netes/scheduler"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+POST /api/rollouts?nodes=node-a,node-b&wait=true
+Package is sent the same way as to POST /deplistener/receive.
+Without nodes the configured scheduler places the manifest replicas on Ready nodes,
+with nodes the replicas are split across them.
+*/
+func _StartRollout(c *gin.Context) {
+	pkg, closePkg, err := deployListener.ParsePackageRequest(c)
+	defer closePkg()
+
+	if err != nil {
+		returnRolloutError(c, err)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	req := &RolloutRequest{
+		Package: pkg,
+		User:    user,
+		Wait:    c.Query("wait") == "true",
+	}
+
+	if req.Wait {
+		// Server WriteTimeout would cut waiting for the rollout before it finishes
+		req.OnWait = func(rollout *Rollout) {
+			deadline := time.Now().Add(rollout.MaxDuration() + time.Minute)
+			http.NewResponseController(c.Writer).SetWriteDeadline(deadline)
+		}
+	}
+
+	if nodesParam := c.Query("nodes"); nodesParam != "" {
+		req.Nodes = strings.Split(nodesParam, ",")
+	}
+
+	rollout, err := StartRollout(c.Request.Context(), req)
+	if err != nil {
+		returnRolloutError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, rollout)
+}
+
+/*
+GET /api/rollouts?app=&limit=
+*/
+func _ListRollouts(c *gin.Context) {
+	result, err := ListRollouts(c.Request.Context(), c.Query("app"), int64(tools.StringToInt(c.Query("limit"))))
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, result)
+}
+
+/*
+GET /api/rollouts/get?uid=
+*/
+func _GetRollout(c *gin.Context) {
+	rollout, err := GetRollout(c.Request.Context(), c.Query("uid"))
+
+	if err != nil {
+		returnRolloutError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, rollout)
+}
+
+/*
+POST /api/rollouts/schedule
+Dry run of scheduler, body is scheduler.PlacementRequest:
+
+	{
+	  "app": "my-app",
+	  "replicas": 3,
+	  "cpu": 0.5,
+	  "memoryMb": 256,
+	  "nodeSelector": {"zone": "eu"},
+	  "spread": "prefer"
+	}
+*/
+func _PreviewPlacement(c *gin.Context) {
+	var req scheduler.PlacementRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	placement, err := SchedulePlacement(c.Request.Context(), req)
+	if err != nil {
+		returnRolloutError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, placement)
+}
+
+func returnRolloutError(c *gin.Context, err error) {
+	var placementErr *scheduler.PlacementError
+
+	if errors.As(err, &placementErr) {
+		lgr.Error("Rollout rejected: %s", err.Error())
+		c.JSON(http.StatusNotAcceptable, gin.H{"error": err.Error(), "placement": placementErr})
+	} else if errors.Is(err, deployListener.ErrInvalidPackage) ||
+		errors.Is(err, ErrNoTargetNodes) ||
+		errors.Is(err, ErrRolloutNotFound) ||
+		errors.Is(err, nodes.ErrNodeNotFound) {
+		lgr.Error("Rollout rejected: %s", err.Error())
+		serverKit.ReturnUnacceptable(c, err)
+	} else {
+		lgr.ErrorStack("Rollout failed: %s", err.Error())
+		serverKit.ReturnError(c, err)
+	}
+}
+
+func InitControllerApi(r *gin.Engine) {
+	r.POST("/api/rollouts", auth.ApiKeysRequired, _StartRollout)
+	r.GET("/api/rollouts", auth.ApiKeysRequired, _ListRollouts)
+	r.GET("/api/rollouts/get", auth.ApiKeysRequired, _GetRollout)
+	r.POST("/api/rollouts/schedule", auth.ApiKeysRequired, _PreviewPlacement)
+}
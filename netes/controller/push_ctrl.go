@@ -0,0 +1,138 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"turtle/core/serverKit"
+	"turtle/netes/deployListener"
+	"turtle/netes/supervisor"
+)
+
+// How long upload of package to one node may take, including start of its replicas
+var PUSH_TIMEOUT = 30 * time.Minute
+
+var pushClient = &http.Client{Timeout: PUSH_TIMEOUT}
+
+// PushPackage uploads package of rollout to listener of target and returns created revision id,
+// listener starts as many replicas as are assigned to the target
+func PushPackage(ctx context.Context, target RolloutTarget, packagePath string, rollout *Rollout) (string, error) {
+	file, err := os.Open(packagePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	query := url.Values{}
+	query.Set("app", rollout.App)
+	query.Set("sha256", rollout.Sha256)
+	if target.Replicas > 0 {
+		query.Set("replicas", strconv.Itoa(target.Replicas))
+	}
+
+	receiveUrl := strings.TrimSuffix(target.Url, "/") + "/deplistener/receive?" + query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, receiveUrl, file)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Api-Key", serverKit.SERVER_CONFIG.NodesApiKey)
+
+	if rollout.Signature != "" {
+		req.Header.Set("X-Package-Signature", rollout.Signature)
+		req.Header.Set("X-Package-Key-Id", rollout.KeyId)
+	}
+
+	resp, err := pushClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("node responded %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var received deployListener.ReceivedPackage
+
+	if err := json.Unmarshal(body, &received); err != nil {
+		return "", fmt.Errorf("invalid node response: %w", err)
+	}
+
+	return received.RevisionId, nil
+}
+
+// WaitTargetReady asks listener of target until all replicas of revision are ready,
+// replica which gave up fails it right away
+func WaitTargetReady(ctx context.Context, app string, target RolloutTarget, revisionId string) error {
+	ctx, cancel := context.WithTimeout(ctx, ROLLOUT_READY_TIMEOUT)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("app", app)
+	query.Set("revisionId", revisionId)
+	query.Set("timeoutSeconds", "30")
+
+	readyUrl := strings.TrimSuffix(target.Url, "/") + "/deplistener/apps/ready?" + query.Encode()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, readyUrl, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Api-Key", serverKit.SERVER_CONFIG.NodesApiKey)
+
+		resp, err := pushClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("replicas not ready in %s", ROLLOUT_READY_TIMEOUT)
+			}
+			return err
+		}
+
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("node responded %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+		}
+
+		var report supervisor.ReadyReport
+
+		if err := json.Unmarshal(body, &report); err != nil {
+			return fmt.Errorf("invalid node response: %w", err)
+		}
+
+		if report.Ready {
+			return nil
+		}
+
+		ready := 0
+		for _, status := range report.Replicas {
+			if status.Ready {
+				ready++
+			}
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("%d of %d replicas ready in %s", ready, len(report.Replicas), ROLLOUT_READY_TIMEOUT)
+		}
+	}
+}
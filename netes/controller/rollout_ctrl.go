@@ -0,0 +1,396 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/deployListener"
+	"turtle/netes/manifest"
+	"turtle/netes/nodes"
+	"turtle/netes/scheduler"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ROLLOUTS_COLLECTION = "rollouts"
+
+const (
+	ROLLOUT_IN_PROGRESS = "in-progress"
+	ROLLOUT_SUCCEEDED   = "succeeded"
+	ROLLOUT_PARTIAL     = "partially-failed"
+	ROLLOUT_FAILED      = "failed"
+
+	TARGET_PENDING   = "pending"
+	TARGET_PUSHING   = "pushing"
+	TARGET_STARTING  = "starting"
+	TARGET_SUCCEEDED = "succeeded"
+	TARGET_FAILED    = "failed"
+)
+
+// How many nodes receive package at the same time
+var MAX_PARALLEL_PUSHES = 4
+
+// How long replicas on a node may take to pass readiness probes
+var ROLLOUT_READY_TIMEOUT = 5 * time.Minute
+
+var ErrRolloutNotFound = errors.New("rollout not found")
+var ErrNoTargetNodes = errors.New("no target nodes")
+
+// Rollout is one deployment pushed by controller to several listener nodes
+type Rollout struct {
+	Uid        primitive.ObjectID   `json:"uid" bson:"_id"`
+	App        string               `json:"app" bson:"app"`
+	Version    string               `json:"version" bson:"version"`
+	Sha256     string               `json:"sha256" bson:"sha256"`
+	Signature  string               `json:"signature" bson:"signature"`
+	KeyId      string               `json:"keyId" bson:"keyId"`
+	Size       int64                `json:"size" bson:"size"`
+	Manifest   manifest.Manifest    `json:"manifest" bson:"manifest"`
+	Status     string               `json:"status" bson:"status"`
+	Placement  *scheduler.Placement `json:"placement" bson:"placement"`
+	Targets    []RolloutTarget      `json:"targets" bson:"targets"`
+	CreatedBy  string               `json:"createdBy" bson:"createdBy"`
+	CreatedAt  time.Time            `json:"createdAt" bson:"createdAt"`
+	FinishedAt time.Time            `json:"finishedAt" bson:"finishedAt"`
+}
+
+type RolloutTarget struct {
+	Node       string    `json:"node" bson:"node"`
+	Url        string    `json:"url" bson:"url"`
+	Replicas   int       `json:"replicas" bson:"replicas"`
+	Status     string    `json:"status" bson:"status"`
+	RevisionId string    `json:"revisionId" bson:"revisionId"`
+	Error      string    `json:"error" bson:"error"`
+	StartedAt  time.Time `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt" bson:"finishedAt"`
+}
+
+// RolloutRequest is package received by controller and where it should go
+type RolloutRequest struct {
+	Package *deployListener.PackageRequest
+	// Node names, scheduler picks from Ready nodes when empty
+	Nodes []string
+	User  string
+	// Wait blocks until every node finished
+	Wait bool
+	// OnWait is called before StartRollout blocks in Wait, e.g. to extend response deadline
+	OnWait func(rollout *Rollout)
+}
+
+func rolloutsRepo() *dbclient.Repository[Rollout] {
+	return dbclient.NewRepository[Rollout](dbclient.MongoClient, ROLLOUTS_COLLECTION)
+}
+
+func getRolloutsDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".rollouts")
+}
+
+// StartRollout stores package on controller and pushes it to target nodes
+func StartRollout(ctx context.Context, req *RolloutRequest) (*Rollout, error) {
+	file, size, sum, err := deployListener.StorePackage(req.Package.Body, req.Package.Sha256, getRolloutsDir())
+	if err != nil {
+		return nil, err
+	}
+
+	fail := func(err error) (*Rollout, error) {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	// Fail fast here, every node verifies the signature again
+	if err := deployListener.VerifyPackageSignature(sum, req.Package.Signature, req.Package.KeyId); err != nil {
+		return fail(err)
+	}
+
+	appManifest, err := deployListener.ReadPackageManifest(file, size)
+	if err != nil {
+		return fail(err)
+	}
+
+	if req.Package.App != "" && req.Package.App != appManifest.App {
+		return fail(fmt.Errorf("%w: app %q does not match manifest app %q", deployListener.ErrInvalidPackage, req.Package.App, appManifest.App))
+	}
+
+	placement, err := resolvePlacement(ctx, appManifest, req.Nodes)
+	if err != nil {
+		return fail(err)
+	}
+
+	rollout := &Rollout{
+		Uid:       primitive.NewObjectID(),
+		App:       appManifest.App,
+		Version:   appManifest.Version,
+		Sha256:    sum,
+		Signature: req.Package.Signature,
+		KeyId:     req.Package.KeyId,
+		Size:      size,
+		Manifest:  *appManifest,
+		Status:    ROLLOUT_IN_PROGRESS,
+		Placement: placement,
+		CreatedBy: req.User,
+		CreatedAt: time.Now(),
+	}
+
+	for _, assignment := range placement.Assignments {
+		rollout.Targets = append(rollout.Targets, RolloutTarget{
+			Node:     assignment.Node,
+			Url:      assignment.Url,
+			Replicas: assignment.Replicas,
+			Status:   TARGET_PENDING,
+		})
+	}
+
+	if _, err := rolloutsRepo().InsertOne(ctx, rollout); err != nil {
+		return fail(err)
+	}
+
+	lgr.Info("Rollout %s of %s %s to %d nodes started", rollout.Uid.Hex(), rollout.App, rollout.Version, len(rollout.Targets))
+
+	run := func() {
+		defer func() {
+			file.Close()
+			os.Remove(file.Name())
+		}()
+		runRollout(rollout, file.Name())
+	}
+
+	if req.Wait {
+		if req.OnWait != nil {
+			req.OnWait(rollout)
+		}
+		tools.SafeGoRoutine(run)
+		return GetRollout(ctx, rollout.Uid.Hex())
+	}
+
+	go tools.SafeGoRoutine(run)
+
+	return rollout, nil
+}
+
+// MaxDuration is the longest rollout can run, nodes are pushed in waves of
+// MAX_PARALLEL_PUSHES and each may take PUSH_TIMEOUT and ROLLOUT_READY_TIMEOUT
+func (self *Rollout) MaxDuration() time.Duration {
+	waves := (len(self.Targets) + MAX_PARALLEL_PUSHES - 1) / MAX_PARALLEL_PUSHES
+	return time.Duration(waves) * (PUSH_TIMEOUT + ROLLOUT_READY_TIMEOUT)
+}
+
+// resolvePlacement uses scheduler on Ready nodes, or explicitly requested nodes.
+// Placement replicas are the total of the app in both cases, requested nodes share them.
+func resolvePlacement(ctx context.Context, appManifest *manifest.Manifest, names []string) (*scheduler.Placement, error) {
+	if len(names) == 0 {
+		return SchedulePlacement(ctx, scheduler.RequestFromManifest(appManifest))
+	}
+
+	placement := &scheduler.Placement{
+		Scheduler: "manual",
+	}
+	seen := map[string]bool{}
+
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+
+		node, err := nodes.GetNode(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		if node.Status != nodes.NODE_READY {
+			return nil, fmt.Errorf("%w: node %s is %s", ErrNoTargetNodes, name, node.Status)
+		}
+
+		placement.Assignments = append(placement.Assignments, scheduler.Assignment{
+			Node: node.Name,
+			Url:  node.Url,
+		})
+	}
+
+	if len(placement.Assignments) == 0 {
+		return nil, ErrNoTargetNodes
+	}
+
+	if err := splitReplicas(placement.Assignments, appManifest.Placement); err != nil {
+		return nil, err
+	}
+
+	return placement, nil
+}
+
+// splitReplicas spreads total replicas of placement evenly over assignments, every
+// requested node gets at least one
+func splitReplicas(assignments []scheduler.Assignment, placement manifest.Placement) error {
+	replicas := max(placement.Replicas, 1)
+	count := len(assignments)
+
+	if replicas < count {
+		return fmt.Errorf("%w: manifest requests %d replicas in total, fewer than %d requested nodes", ErrNoTargetNodes, replicas, count)
+	}
+	if replicas > count && placement.Spread == manifest.SPREAD_REQUIRE {
+		return fmt.Errorf("%w: spread require allows one replica per node, manifest requests %d replicas on %d nodes", ErrNoTargetNodes, replicas, count)
+	}
+
+	for i := range assignments {
+		assignments[i].Replicas = replicas / count
+		if i < replicas%count {
+			assignments[i].Replicas++
+		}
+	}
+
+	return nil
+}
+
+// SchedulePlacement runs configured scheduler over currently Ready nodes
+func SchedulePlacement(ctx context.Context, req scheduler.PlacementRequest) (*scheduler.Placement, error) {
+	strategy, err := scheduler.GetScheduler(serverKit.SERVER_CONFIG.Scheduler)
+	if err != nil {
+		return nil, err
+	}
+
+	readyNodes, err := nodes.ListReadyNodes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return strategy.Schedule(req, scheduler.CandidatesFromNodes(readyNodes))
+}
+
+// runRollout pushes package to all targets and stores aggregate status
+func runRollout(rollout *Rollout, packagePath string) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+
+	slots := make(chan struct{}, MAX_PARALLEL_PUSHES)
+
+	for _, target := range rollout.Targets {
+		wg.Add(1)
+		slots <- struct{}{}
+
+		go tools.SafeGoRoutine(func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			setTargetStatus(ctx, rollout.Uid, target.Node, bson.M{
+				"status":    TARGET_PUSHING,
+				"startedAt": time.Now(),
+			})
+
+			revisionId, err := PushPackage(ctx, target, packagePath, rollout)
+
+			// Jobs have no replicas to wait for
+			if err == nil && !rollout.Manifest.IsJob() {
+				setTargetStatus(ctx, rollout.Uid, target.Node, bson.M{
+					"status":     TARGET_STARTING,
+					"revisionId": revisionId,
+				})
+				err = WaitTargetReady(ctx, rollout.App, target, revisionId)
+			}
+
+			update := bson.M{
+				"finishedAt": time.Now(),
+				"revisionId": revisionId,
+			}
+
+			if err != nil {
+				lgr.Error("Rollout %s to node %s failed: %s", rollout.Uid.Hex(), target.Node, err.Error())
+				update["status"] = TARGET_FAILED
+				update["error"] = err.Error()
+			} else {
+				update["status"] = TARGET_SUCCEEDED
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+
+			setTargetStatus(ctx, rollout.Uid, target.Node, update)
+		})
+	}
+
+	wg.Wait()
+
+	status := AggregateStatus(succeeded, len(rollout.Targets))
+
+	_, err := rolloutsRepo().UpdateByID(ctx, rollout.Uid, bson.M{"$set": bson.M{
+		"status":     status,
+		"finishedAt": time.Now(),
+	}})
+	if err != nil {
+		lgr.Error("Failed to finish rollout %s: %s", rollout.Uid.Hex(), err.Error())
+	}
+
+	lgr.Info("Rollout %s of %s finished %s (%d/%d nodes)", rollout.Uid.Hex(), rollout.App, status, succeeded, len(rollout.Targets))
+}
+
+func AggregateStatus(succeeded, total int) string {
+	switch {
+	case succeeded == total:
+		return ROLLOUT_SUCCEEDED
+	case succeeded == 0:
+		return ROLLOUT_FAILED
+	default:
+		return ROLLOUT_PARTIAL
+	}
+}
+
+func setTargetStatus(ctx context.Context, rolloutUid primitive.ObjectID, node string, fields bson.M) {
+	set := bson.M{}
+	for key, value := range fields {
+		set["targets.$."+key] = value
+	}
+
+	_, err := rolloutsRepo().UpdateOne(ctx, bson.M{"_id": rolloutUid, "targets.node": node}, bson.M{"$set": set})
+	if err != nil {
+		lgr.Error("Failed to update rollout %s node %s: %s", rolloutUid.Hex(), node, err.Error())
+	}
+}
+
+func GetRollout(ctx context.Context, uid string) (*Rollout, error) {
+	objectId, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRolloutNotFound, uid)
+	}
+
+	rollout, err := rolloutsRepo().FindByID(ctx, objectId)
+	if err != nil {
+		return nil, err
+	}
+	if rollout == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRolloutNotFound, uid)
+	}
+
+	return rollout, nil
+}
+
+// ListRollouts returns newest rollouts first, optionally of one app only
+func ListRollouts(ctx context.Context, app string, limit int64) ([]Rollout, error) {
+	filter := bson.M{}
+	if app != "" {
+		filter["app"] = app
+	}
+
+	if limit <= 0 {
+		limit = 50
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}}).SetLimit(limit)
+
+	return rolloutsRepo().FindMany(ctx, filter, opts)
+}
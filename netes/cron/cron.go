@@ -0,0 +1,227 @@
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidSchedule = errors.New("invalid cron schedule")
+
+// Schedule is parsed standard 5 field cron expression:
+// minute hour day-of-month month day-of-week
+type Schedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// When both day fields are restricted a day matches either of them, like in cron
+	dayOfMonthAny bool
+	dayOfWeekAny  bool
+}
+
+type field struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	minuteField     = field{name: "minute", min: 0, max: 59}
+	hourField       = field{name: "hour", min: 0, max: 23}
+	dayOfMonthField = field{name: "day of month", min: 1, max: 31}
+	monthField      = field{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 7 is Sunday too
+	dayOfWeekField = field{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var MACROS = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parse parses expression like "*/15 2-4 * * mon-fri" or macro like "@daily"
+func Parse(expression string) (*Schedule, error) {
+	expression = strings.TrimSpace(expression)
+
+	if macro, ok := MACROS[strings.ToLower(expression)]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%w: expected 5 fields, got %d", ErrInvalidSchedule, len(fields))
+	}
+
+	schedule := &Schedule{
+		dayOfMonthAny: fields[2] == "*" || fields[2] == "?",
+		dayOfWeekAny:  fields[4] == "*" || fields[4] == "?",
+	}
+
+	var err error
+
+	if schedule.minute, err = parseField(fields[0], minuteField); err != nil {
+		return nil, err
+	}
+	if schedule.hour, err = parseField(fields[1], hourField); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfMonth, err = parseField(fields[2], dayOfMonthField); err != nil {
+		return nil, err
+	}
+	if schedule.month, err = parseField(fields[3], monthField); err != nil {
+		return nil, err
+	}
+	if schedule.dayOfWeek, err = parseField(fields[4], dayOfWeekField); err != nil {
+		return nil, err
+	}
+
+	// Sunday can be written as 7
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+
+	return schedule, nil
+}
+
+// parseField returns bitmask of allowed values, bit n means value n
+func parseField(value string, spec field) (uint64, error) {
+	var result uint64
+
+	for _, part := range strings.Split(value, ",") {
+		bits, err := parsePart(strings.ToLower(part), spec)
+		if err != nil {
+			return 0, err
+		}
+		result |= bits
+	}
+
+	return result, nil
+}
+
+func parsePart(part string, spec field) (uint64, error) {
+	rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+	step := 1
+	if hasStep {
+		parsed, err := strconv.Atoi(stepPart)
+		if err != nil || parsed < 1 {
+			return 0, fmt.Errorf("%w: %s: invalid step %q", ErrInvalidSchedule, spec.name, stepPart)
+		}
+		step = parsed
+	}
+
+	start, end := spec.min, spec.max
+
+	switch {
+	case rangePart == "*" || rangePart == "?":
+	case strings.Contains(rangePart, "-"):
+		from, to, _ := strings.Cut(rangePart, "-")
+
+		var err error
+		if start, err = parseValue(from, spec); err != nil {
+			return 0, err
+		}
+		if end, err = parseValue(to, spec); err != nil {
+			return 0, err
+		}
+		if start > end {
+			return 0, fmt.Errorf("%w: %s: range %q is reversed", ErrInvalidSchedule, spec.name, rangePart)
+		}
+	default:
+		value, err := parseValue(rangePart, spec)
+		if err != nil {
+			return 0, err
+		}
+		start = value
+		// "5/10" means from 5 to max by 10
+		if !hasStep {
+			end = value
+		}
+	}
+
+	var bits uint64
+	for value := start; value <= end; value += step {
+		bits |= 1 << uint(value)
+	}
+
+	return bits, nil
+}
+
+func parseValue(value string, spec field) (int, error) {
+	if number, ok := spec.names[value]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: invalid value %q", ErrInvalidSchedule, spec.name, value)
+	}
+
+	if number < spec.min || number > spec.max {
+		return 0, fmt.Errorf("%w: %s: %d is out of range %d-%d", ErrInvalidSchedule, spec.name, number, spec.min, spec.max)
+	}
+
+	return number, nil
+}
+
+// Give up when nothing matches, e.g. "0 0 30 2 *"
+const MAX_SEARCH_YEARS = 5
+
+// Next returns first matching time after t with minute precision, zero time
+// when schedule never matches
+func (self *Schedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(MAX_SEARCH_YEARS, 0, 0)
+
+	for t.Before(limit) {
+		if self.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if !self.matchesDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if self.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+
+		if self.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (self *Schedule) matchesDay(t time.Time) bool {
+	dayOfMonth := self.dayOfMonth&(1<<uint(t.Day())) != 0
+	dayOfWeek := self.dayOfWeek&(1<<uint(t.Weekday())) != 0
+
+	if self.dayOfMonthAny || self.dayOfWeekAny {
+		return dayOfMonth && dayOfWeek
+	}
+
+	return dayOfMonth || dayOfWeek
+}
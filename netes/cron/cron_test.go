@@ -0,0 +1,79 @@
+package cron
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseRejectsInvalidExpressions(t *testing.T) {
+	tests := []struct {
+		name       string
+		expression string
+	}{
+		{"empty", ""},
+		{"four fields", "* * * *"},
+		{"six fields", "* * * * * *"},
+		{"minute out of range", "60 * * * *"},
+		{"hour out of range", "* 24 * * *"},
+		{"day of month zero", "* * 0 * *"},
+		{"month out of range", "* * * 13 *"},
+		{"day of week out of range", "* * * * 8"},
+		{"zero step", "*/0 * * * *"},
+		{"negative step", "*/-5 * * * *"},
+		{"reversed range", "5-1 * * * *"},
+		{"not a number", "a * * * *"},
+		{"unknown month name", "* * * foo *"},
+		{"unknown macro", "@often"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse(test.expression)
+			if !errors.Is(err, ErrInvalidSchedule) {
+				t.Fatalf("Parse(%q) error = %v, want ErrInvalidSchedule", test.expression, err)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// Thursday
+	from := time.Date(2026, time.January, 1, 10, 7, 30, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		expression string
+		want       time.Time
+	}{
+		{"every minute", "* * * * *", time.Date(2026, 1, 1, 10, 8, 0, 0, time.UTC)},
+		{"step", "*/15 * * * *", time.Date(2026, 1, 1, 10, 15, 0, 0, time.UTC)},
+		{"step from value", "5/20 10 * * *", time.Date(2026, 1, 1, 10, 25, 0, 0, time.UTC)},
+		{"list", "0,40 * * * *", time.Date(2026, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"current minute is skipped", "7 10 * * *", time.Date(2026, 1, 2, 10, 7, 0, 0, time.UTC)},
+		{"hourly macro", "@hourly", time.Date(2026, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"daily macro", "@daily", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"yearly macro", "@yearly", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"uppercase macro", "@WEEKLY", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"weekday range", "30 2-4 * * mon-fri", time.Date(2026, 1, 2, 2, 30, 0, 0, time.UTC)},
+		{"weekend names", "0 9 * * sat,sun", time.Date(2026, 1, 3, 9, 0, 0, 0, time.UTC)},
+		{"sunday as 7", "0 0 * * 7", time.Date(2026, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"month name", "0 0 1 mar *", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"day of month or day of week", "0 0 13 * fri", time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"leap day", "0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"never matches", "0 0 30 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := Parse(test.expression)
+			if err != nil {
+				t.Fatalf("Parse(%q) failed: %v", test.expression, err)
+			}
+
+			if got := schedule.Next(from); !got.Equal(test.want) {
+				t.Fatalf("Next(%s) of %q = %s, want %s", from, test.expression, got, test.want)
+			}
+		})
+	}
+}
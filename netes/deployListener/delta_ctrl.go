@@ -0,0 +1,167 @@
+package deployListener
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"turtle/core/serverKit"
+	"turtle/netes/artifacts"
+)
+
+// File in root of delta package listing paths removed from base revision, one per line
+const DELTA_DELETE_FILE = ".turtle-delete"
+
+type RevisionFiles struct {
+	App        string                `json:"app"`
+	RevisionId string                `json:"revisionId"`
+	Files      []artifacts.FileEntry `json:"files"`
+}
+
+// GetRevisionFiles returns file manifest of revision, of active revision when revisionId is empty
+func GetRevisionFiles(ctx context.Context, app, revisionId string) (*RevisionFiles, error) {
+	revision, err := resolveBaseRevision(ctx, app, revisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RevisionFiles{
+		App:        revision.App,
+		RevisionId: revision.Uid.Hex(),
+		Files:      revision.Files,
+	}, nil
+}
+
+func resolveBaseRevision(ctx context.Context, app, revisionId string) (*Revision, error) {
+	if revisionId == "" {
+		deployment, err := GetAppDeployment(ctx, app)
+		if err != nil {
+			return nil, err
+		}
+		if deployment == nil {
+			return nil, fmt.Errorf("%w: app %s has no active revision", ErrRevisionNotFound, app)
+		}
+		revisionId = deployment.ActiveRevisionId.Hex()
+	}
+
+	revision, err := GetRevision(ctx, revisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if app != "" && revision.App != app {
+		return nil, fmt.Errorf("%w: %s does not belong to app %s", ErrRevisionNotFound, revisionId, app)
+	}
+
+	// Files of revisions of other nodes are not on this node
+	if revision.Node != serverKit.SERVER_CONFIG.GetNodeName() {
+		return nil, fmt.Errorf("%w: %s is not a revision of this node", ErrRevisionNotFound, revisionId)
+	}
+
+	return revision, nil
+}
+
+// DeployDelta builds new revision from base revision and delta package with
+// new or changed files and deploys it
+func DeployDelta(ctx context.Context, req *PackageRequest, baseRevisionId, uploader string) (*ReceivedPackage, error) {
+	base, err := resolveBaseRevision(ctx, req.App, baseRevisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	req.App = base.App
+	req.Base = base
+
+	return DeployPackage(ctx, req, uploader)
+}
+
+// applyDelta completes unpacked delta in dir with files of base revision
+// which were neither changed nor deleted
+func applyDelta(dir string, base *Revision) error {
+	deleted, err := readDeleteList(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range base.Files {
+		if isDeletedPath(file.Path, deleted) {
+			continue
+		}
+
+		target, err := safeArchivePath(dir, file.Path)
+		if err != nil {
+			return err
+		}
+
+		// Delta contains new version of the file
+		if _, err := os.Lstat(target); err == nil {
+			continue
+		}
+
+		if err := ensureNoSymlinkParents(dir, target); err != nil {
+			return err
+		}
+
+		if file.Link != "" {
+			if err := symlinkInRoot(dir, target, file.Link); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := artifacts.LinkObject(file.Sha256, target, file.Mode); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readDeleteList(dir string) (map[string]bool, error) {
+	path := filepath.Join(dir, DELTA_DELETE_FILE)
+	result := map[string]bool{}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(file, MAX_MANIFEST_SIZE))
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		result[strings.Trim(filepath.ToSlash(line), "/")] = true
+	}
+
+	err = scanner.Err()
+	file.Close()
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid %s: %s", ErrInvalidPackage, DELTA_DELETE_FILE, err.Error())
+	}
+
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// isDeletedPath matches file itself or any of its parent folders
+func isDeletedPath(path string, deleted map[string]bool) bool {
+	for current := path; current != "." && current != ""; current = filepath.ToSlash(filepath.Dir(current)) {
+		if deleted[current] {
+			return true
+		}
+	}
+	return false
+}
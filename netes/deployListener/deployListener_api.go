@@ -1,7 +1,14 @@
 package deployListener
 
 import (
+	"errors"
+	"net/http"
+	"turtle/core/auth"
+	"turtle/core/lgr"
 	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+	"turtle/netes/nodeInfo"
+	"turtle/netes/nodes"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
@@ -11,22 +18,122 @@ func _Ping(c *gin.Context) {
 	serverKit.ReturnOkJson(c, bson.M{"status": "ok"})
 }
 
+/*
+GET /deplistener/info
+Full report of node with its apps, replicas and resource usage.
+Requires API key, unauthenticated liveness check is GET /deplistener/ping.
+*/
 func _GetInfo(c *gin.Context) {
-	serverKit.ReturnOkJson(c, bson.M{"status": "ok"})
+	serverKit.ReturnOkJson(c, nodeInfo.Collect())
 }
 
+/*
+POST /deplistener/info
+Heartbeat of agent node, body is NodeInfo as returned by GET /deplistener/info.
+Only accepted in controller mode.
+*/
 func _PostInfo(c *gin.Context) {
-	serverKit.ReturnOkJson(c, bson.M{"status": "ok"})
+	if serverKit.SERVER_CONFIG.GetMode() != serverKit.MODE_CONTROLLER {
+		serverKit.ReturnUnacceptable(c, errors.New("node is not running in controller mode"))
+		return
+	}
+
+	var info nodeInfo.NodeInfo
+
+	if err := c.ShouldBindJSON(&info); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	node, err := nodes.RegisterHeartbeat(c.Request.Context(), &info, user)
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, node)
 }
 
+/*
+POST /deplistener/receive
+multipart/form-data: app, sha256, package (file)
+or raw tar.gz/zip body with ?app=&sha256= (or X-Package-App, X-Package-Sha256 headers)
+*/
 func _ReceiveDeploymentPackage(c *gin.Context) {
-	serverKit.ReturnOkJson(c, bson.M{"status": "ok"})
+	req, closeReq, err := ParsePackageRequest(c)
+	defer closeReq()
+
+	if err != nil {
+		returnPackageError(c, err)
+		return
+	}
+
+	uploader, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	received, err := DeployPackage(c.Request.Context(), req, uploader)
+
+	if err != nil {
+		returnPackageError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, received)
+}
+
+func returnPackageError(c *gin.Context, err error) {
+	var manifestErrors manifest.ValidationErrors
+
+	if errors.As(err, &manifestErrors) {
+		lgr.Error("Rejected deployment package: %s", err.Error())
+		c.JSON(http.StatusNotAcceptable, bson.M{"error": err.Error(), "fields": manifestErrors})
+	} else if errors.Is(err, ErrInvalidPackage) || errors.Is(err, ErrInvalidReplicas) {
+		lgr.Error("Rejected deployment package: %s", err.Error())
+		serverKit.ReturnUnacceptable(c, err)
+	} else {
+		lgr.ErrorStack("Failed to receive deployment package: %s", err.Error())
+		serverKit.ReturnError(c, err)
+	}
 }
 
 func InitDeployListenerApi(r *gin.Engine) {
 	r.GET("/deplistener/ping", _Ping)
-	r.GET("/deplistener/info", _GetInfo)
-	r.POST("/deplistener/info", _PostInfo)
+	r.GET("/deplistener/info", auth.ApiKeysRequired, _GetInfo)
+	r.POST("/deplistener/info", auth.ApiKeysRequired, _PostInfo)
+
+	r.POST("/deplistener/receive", auth.ApiKeysRequired, _ReceiveDeploymentPackage)
+
+	r.GET("/deplistener/revisions", auth.ApiKeysRequired, _ListRevisions)
+	r.GET("/deplistener/revisions/active", auth.ApiKeysRequired, _GetActiveRevision)
+	r.GET("/deplistener/revisions/files", auth.ApiKeysRequired, _GetRevisionFiles)
+	r.POST("/deplistener/revisions/delta", auth.ApiKeysRequired, _ReceiveDelta)
+	r.POST("/deplistener/revisions/rollback", auth.ApiKeysRequired, _RollbackRevision)
+	r.POST("/deplistener/apps/scale", auth.ApiKeysRequired, _ScaleApp)
+	r.POST("/deplistener/apps/switch", auth.ApiKeysRequired, _SwitchAppColor)
+	r.POST("/deplistener/apps/config", auth.ApiKeysRequired, _SetAppConfig)
+
+	r.GET("/deplistener/reconcile", auth.ApiKeysRequired, _GetReconcileStatus)
+	r.POST("/deplistener/reconcile", auth.ApiKeysRequired, _RunReconcile)
+
+	r.POST("/deplistener/uploads", auth.ApiKeysRequired, _StartUpload)
+	r.PUT("/deplistener/uploads/chunk", auth.ApiKeysRequired, _PutChunk)
+	r.GET("/deplistener/uploads/get", auth.ApiKeysRequired, _GetUpload)
+	r.POST("/deplistener/uploads/finalize", auth.ApiKeysRequired, _FinalizeUpload)
+	r.DELETE("/deplistener/uploads", auth.ApiKeysRequired, _AbortUpload)
+
+	r.POST("/deplistener/templates/render", auth.ApiKeysRequired, _RenderTemplates)
+
+	r.GET("/deplistener/logs", auth.ApiKeysRequired, _GetAppLogs)
 
-	r.POST("/deplistener/receive", _ReceiveDeploymentPackage)
+	r.GET("/deplistener/store", auth.ApiKeysRequired, _GetStoreReport)
+	r.POST("/deplistener/store/gc", auth.ApiKeysRequired, _RunStoreGc)
 }
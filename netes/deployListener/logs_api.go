@@ -0,0 +1,107 @@
+package deployListener
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+	"turtle/core/serverKit"
+	"turtle/netes/appLogs"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Comment sent to followers so dead connections are detected
+const LOG_FOLLOW_KEEPALIVE = 15 * time.Second
+
+/*
+GET /deplistener/logs?app=&revisionId=&replica=&tail=100&since=&until=&follow=false
+since/until are RFC3339 or duration back from now ("15m"), lines of all replicas
+are returned when replica is empty.
+With follow=true response is text/event-stream: last lines first and then new
+lines as "log" events. Without revisionId new revisions of app are followed too.
+*/
+func _GetAppLogs(c *gin.Context) {
+	query, err := ParseLogQuery(c.Query("app"), c.Query("revisionId"), c.Query("replica"), c.Query("tail"), c.Query("since"), c.Query("until"))
+	if err != nil {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	}
+
+	follow := c.Query("follow") == "true"
+
+	// Subscribe before reading history so no line is lost in between
+	var followCh <-chan appLogs.LogLine
+	if follow {
+		ch, cancel := appLogs.Follow(query.App)
+		defer cancel()
+		followCh = ch
+	}
+
+	lines, err := QueryAppLogs(c.Request.Context(), query)
+
+	if errors.Is(err, ErrRevisionNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	if !follow {
+		serverKit.ReturnOkJson(c, lines)
+		return
+	}
+
+	streamAppLogs(c, query, lines, followCh)
+}
+
+func streamAppLogs(c *gin.Context, query appLogs.LogQuery, lines []appLogs.LogLine, followCh <-chan appLogs.LogLine) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	var lastSent time.Time
+
+	for _, line := range lines {
+		c.SSEvent("log", line)
+		lastSent = line.Time
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(LOG_FOLLOW_KEEPALIVE)
+	defer keepalive.Stop()
+
+	// Server WriteTimeout would cut long follows, deadline is moved with every write
+	controller := http.NewResponseController(c.Writer)
+
+	c.Stream(func(w io.Writer) bool {
+		controller.SetWriteDeadline(time.Now().Add(2 * LOG_FOLLOW_KEEPALIVE))
+
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		case line, ok := <-followCh:
+			if !ok {
+				return false
+			}
+			// Lines written while history was read were already sent
+			if !line.Time.After(lastSent) {
+				return true
+			}
+			if query.RevisionId != "" && line.RevisionId != query.RevisionId {
+				return true
+			}
+			if query.Replica != nil && line.Replica != *query.Replica {
+				return true
+			}
+			if !query.Until.IsZero() && line.Time.After(query.Until) {
+				return false
+			}
+			c.SSEvent("log", line)
+			return true
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package deployListener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"turtle/netes/appLogs"
+	"turtle/netes/supervisor"
+)
+
+var ErrInvalidLogQuery = errors.New("invalid log query")
+
+// Maximum number of lines returned by one query
+const MAX_LOG_TAIL = 10000
+
+const DEFAULT_LOG_TAIL = 100
+
+// ParseLogQuery reads replica, tail, since and until, since/until accept RFC3339 or
+// duration relative to now like "15m"
+func ParseLogQuery(app, revisionId, replica, tail, since, until string) (appLogs.LogQuery, error) {
+	query := appLogs.LogQuery{
+		App:        app,
+		RevisionId: revisionId,
+		Tail:       DEFAULT_LOG_TAIL,
+	}
+
+	if tail != "" {
+		parsed, err := strconv.Atoi(tail)
+		if err != nil || parsed < 0 {
+			return query, fmt.Errorf("%w: tail must be positive number", ErrInvalidLogQuery)
+		}
+		query.Tail = parsed
+	}
+
+	if query.Tail == 0 || query.Tail > MAX_LOG_TAIL {
+		query.Tail = MAX_LOG_TAIL
+	}
+
+	if replica != "" {
+		parsed, err := strconv.Atoi(replica)
+		if err != nil || parsed < 0 {
+			return query, fmt.Errorf("%w: replica must be positive number", ErrInvalidLogQuery)
+		}
+		query.Replica = &parsed
+	}
+
+	var err error
+
+	if query.Since, err = parseLogTime(since); err != nil {
+		return query, fmt.Errorf("%w: since: %s", ErrInvalidLogQuery, err.Error())
+	}
+	if query.Until, err = parseLogTime(until); err != nil {
+		return query, fmt.Errorf("%w: until: %s", ErrInvalidLogQuery, err.Error())
+	}
+
+	return query, nil
+}
+
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+// resolveLogRevision returns revisionId, or revision of running process, or active revision
+func resolveLogRevision(ctx context.Context, app, revisionId string) (string, error) {
+	if revisionId != "" {
+		revision, err := GetRevision(ctx, revisionId)
+		if err != nil {
+			return "", err
+		}
+		if revision.App != app {
+			return "", fmt.Errorf("%w: %s does not belong to app %s", ErrRevisionNotFound, revisionId, app)
+		}
+		return revisionId, nil
+	}
+
+	if statuses, ok := supervisor.SUPERVISOR.Status(app); ok && len(statuses) > 0 {
+		return statuses[0].RevisionId, nil
+	}
+
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil {
+		return "", err
+	}
+	if deployment == nil {
+		return "", fmt.Errorf("%w: app %s has no active revision", ErrRevisionNotFound, app)
+	}
+
+	return deployment.ActiveRevisionId.Hex(), nil
+}
+
+// QueryAppLogs returns lines of one revision of app, of current revision when revisionId is empty
+func QueryAppLogs(ctx context.Context, query appLogs.LogQuery) ([]appLogs.LogLine, error) {
+	revisionId, err := resolveLogRevision(ctx, query.App, query.RevisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	query.RevisionId = revisionId
+
+	return appLogs.Query(query)
+}
@@ -0,0 +1,318 @@
+package deployListener
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/netes/artifacts"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+	"turtle/netes/supervisor"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidPackage = errors.New("invalid package")
+
+type ReceivedPackage struct {
+	App        string             `json:"app"`
+	RevisionId string             `json:"revisionId"`
+	Sha256     string             `json:"sha256"`
+	Size       int64              `json:"size"`
+	Folder     string             `json:"folder"`
+	Manifest   *manifest.Manifest `json:"manifest"`
+
+	BaseRevisionId string                `json:"baseRevisionId,omitempty"`
+	Files          []artifacts.FileEntry `json:"-"`
+
+	Processes []supervisor.ProcessStatus `json:"processes"`
+}
+
+// PackageRequest is everything the client sent along with the package bytes
+type PackageRequest struct {
+	App       string
+	Sha256    string
+	Signature string
+	KeyId     string
+	Body      io.Reader
+	// Replicas started on this node, 0 keeps current number of replicas
+	Replicas int
+	// Base makes package a delta of base revision
+	Base *Revision
+	// Uid of the created revision, new one when empty
+	RevisionId string
+}
+
+func ValidateAppName(app string) error {
+	if err := manifest.ValidateAppName(app); err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+	return nil
+}
+
+func GetAppDir(app string) string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), app)
+}
+
+func GetRevisionDir(app, revisionId string) string {
+	return filepath.Join(GetAppDir(app), revisionId)
+}
+
+func getTmpDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".tmp")
+}
+
+/*
+Package can be sent as:
+  - multipart/form-data with fields "app", "sha256", "signature", "keyId", "replicas" and file "package"
+  - raw body (application/gzip, application/zip, application/octet-stream)
+    with query ?app=&replicas= and headers X-Package-Sha256, X-Package-Signature, X-Package-Key-Id
+
+App is optional, when missing it is taken from the package manifest.
+*/
+func ParsePackageRequest(c *gin.Context) (*PackageRequest, func(), error) {
+	noop := func() {}
+
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		fileHeader, err := c.FormFile("package")
+		if err != nil {
+			return nil, noop, fmt.Errorf("%w: missing multipart file \"package\"", ErrInvalidPackage)
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			return nil, noop, err
+		}
+
+		req := &PackageRequest{
+			App:       firstNonEmpty(c.PostForm("app"), c.Query("app")),
+			Sha256:    firstNonEmpty(c.PostForm("sha256"), c.GetHeader("X-Package-Sha256")),
+			Signature: firstNonEmpty(c.PostForm("signature"), c.GetHeader("X-Package-Signature")),
+			KeyId:     firstNonEmpty(c.PostForm("keyId"), c.GetHeader("X-Package-Key-Id")),
+			Body:      file,
+		}
+
+		req.Replicas, err = parseReplicas(firstNonEmpty(c.PostForm("replicas"), c.Query("replicas"), c.GetHeader("X-Package-Replicas")))
+		if err != nil {
+			file.Close()
+			return nil, noop, err
+		}
+
+		return req, func() { file.Close() }, nil
+	}
+
+	req := &PackageRequest{
+		App:       firstNonEmpty(c.Query("app"), c.GetHeader("X-Package-App")),
+		Sha256:    firstNonEmpty(c.Query("sha256"), c.GetHeader("X-Package-Sha256")),
+		Signature: c.GetHeader("X-Package-Signature"),
+		KeyId:     c.GetHeader("X-Package-Key-Id"),
+		Body:      c.Request.Body,
+	}
+
+	var err error
+	req.Replicas, err = parseReplicas(firstNonEmpty(c.Query("replicas"), c.GetHeader("X-Package-Replicas")))
+	if err != nil {
+		return nil, noop, err
+	}
+
+	return req, noop, nil
+}
+
+// parseReplicas returns 0 for empty value which keeps current number of replicas
+func parseReplicas(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	replicas, err := strconv.Atoi(value)
+	if err != nil || replicas < 1 {
+		return 0, fmt.Errorf("%w: replicas must be positive number", ErrInvalidPackage)
+	}
+
+	return replicas, nil
+}
+
+// ReceivePackage stores body to temp file, verifies checksum, unpacks it
+// and validates its manifest before moving it into a fresh revision folder
+func ReceivePackage(req *PackageRequest) (*ReceivedPackage, error) {
+	if req.App != "" {
+		if err := ValidateAppName(req.App); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpFile, size, actualSum, err := StorePackage(req.Body, req.Sha256, getTmpDir())
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	if err := VerifyPackageSignature(actualSum, req.Signature, req.KeyId); err != nil {
+		return nil, err
+	}
+
+	revisionId := req.RevisionId
+	if revisionId == "" {
+		revisionId = primitive.NewObjectID().Hex()
+	}
+	partialDir := filepath.Join(getTmpDir(), revisionId)
+
+	if err := UnpackPackage(tmpFile, size, partialDir); err != nil {
+		os.RemoveAll(partialDir)
+		return nil, err
+	}
+
+	if req.Base != nil {
+		if err := applyDelta(partialDir, req.Base); err != nil {
+			os.RemoveAll(partialDir)
+			return nil, err
+		}
+	}
+
+	received, err := moveUnpackedRevision(req.App, revisionId, partialDir)
+	if err != nil {
+		os.RemoveAll(partialDir)
+		return nil, err
+	}
+
+	received.Files, err = artifacts.IngestDir(received.Folder)
+	if err != nil {
+		os.RemoveAll(received.Folder)
+		return nil, fmt.Errorf("failed to store files in artifact store: %w", err)
+	}
+
+	if err := artifacts.PutPackage(tmpFile.Name(), actualSum); err != nil {
+		os.RemoveAll(received.Folder)
+		return nil, fmt.Errorf("failed to store package in artifact store: %w", err)
+	}
+
+	received.Sha256 = actualSum
+	received.Size = size
+
+	if req.Base != nil {
+		received.BaseRevisionId = req.Base.Uid.Hex()
+	}
+
+	lgr.Ok("Received package for %s, revision %s (%d bytes)", received.App, revisionId, size)
+	events.Emitf(events.EVENT_PACKAGE_RECEIVED, received.App, revisionId, "received package of version %s (%d bytes)", received.Manifest.Version, size)
+
+	return received, nil
+}
+
+// DeployPackage receives package, records it as revision and starts it under supervisor
+func DeployPackage(ctx context.Context, req *PackageRequest, uploader string) (*ReceivedPackage, error) {
+	received, err := ReceivePackage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, err := CreateRevision(ctx, received, uploader)
+	if err != nil {
+		os.RemoveAll(received.Folder)
+		return nil, err
+	}
+
+	received.Processes, err = ActivateRevision(ctx, revision, req.Replicas, uploader)
+	if err != nil {
+		return nil, err
+	}
+
+	return received, nil
+}
+
+// StorePackage copies body into temp file inside dir and verifies client checksum,
+// caller is responsible for closing and removing returned file
+func StorePackage(body io.Reader, expectedSum, dir string) (*os.File, int64, string, error) {
+	expectedSum = strings.ToLower(strings.TrimSpace(expectedSum))
+
+	if len(expectedSum) != sha256.Size*2 {
+		return nil, 0, "", fmt.Errorf("%w: sha256 checksum is required (64 hex chars)", ErrInvalidPackage)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, 0, "", err
+	}
+
+	tmpFile, err := os.CreateTemp(dir, "package-*")
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	fail := func(err error) (*os.File, int64, string, error) {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return nil, 0, "", err
+	}
+
+	hasher := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(tmpFile, hasher), body)
+	if err != nil {
+		return fail(fmt.Errorf("failed to receive package: %w", err))
+	}
+
+	if size == 0 {
+		return fail(fmt.Errorf("%w: package is empty", ErrInvalidPackage))
+	}
+
+	actualSum := hex.EncodeToString(hasher.Sum(nil))
+
+	if actualSum != expectedSum {
+		return fail(fmt.Errorf("%w: sha256 mismatch, expected %s got %s", ErrInvalidPackage, expectedSum, actualSum))
+	}
+
+	return tmpFile, size, actualSum, nil
+}
+
+// moveUnpackedRevision loads manifest of unpacked package and moves it under its app folder
+func moveUnpackedRevision(app, revisionId, unpackedDir string) (*ReceivedPackage, error) {
+	appManifest, err := manifest.LoadFromDir(unpackedDir)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+	}
+
+	if app == "" {
+		app = appManifest.App
+	} else if app != appManifest.App {
+		return nil, fmt.Errorf("%w: app %q does not match manifest app %q", ErrInvalidPackage, app, appManifest.App)
+	}
+
+	revisionDir := GetRevisionDir(app, revisionId)
+
+	if err := os.MkdirAll(GetAppDir(app), 0755); err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(unpackedDir, revisionDir); err != nil {
+		return nil, err
+	}
+
+	return &ReceivedPackage{
+		App:        app,
+		RevisionId: revisionId,
+		Folder:     revisionDir,
+		Manifest:   appManifest,
+	}, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
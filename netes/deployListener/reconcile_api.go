@@ -0,0 +1,93 @@
+package deployListener
+
+import (
+	"errors"
+	"net/http"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /deplistener/reconcile?app=
+Last reconcile result of app, of all apps when app is empty
+*/
+func _GetReconcileStatus(c *gin.Context) {
+	app := c.Query("app")
+
+	if app == "" {
+		serverKit.ReturnOkJson(c, ListReconcileResults())
+		return
+	}
+
+	result, ok := GetReconcileResult(app)
+	if !ok {
+		serverKit.ReturnUnacceptable(c, ErrNoDesiredState)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, result)
+}
+
+/*
+POST /deplistener/reconcile?app=
+Reconciles app right away, all apps when app is empty
+*/
+func _RunReconcile(c *gin.Context) {
+	app := c.Query("app")
+
+	if app == "" {
+		results, err := Reconcile(c.Request.Context())
+		if err != nil {
+			serverKit.ReturnError(c, err)
+			return
+		}
+		serverKit.ReturnOkJson(c, results)
+		return
+	}
+
+	result, err := ReconcileApp(c.Request.Context(), app)
+	returnReconcileResult(c, result, err)
+}
+
+/*
+POST /deplistener/apps/config
+
+	{
+	  "app": "my-app",
+	  "config": {"LOG_LEVEL": "debug"}
+	}
+
+Replaces env variables of desired state of app, replicas are restarted with them
+*/
+func _SetAppConfig(c *gin.Context) {
+	var req struct {
+		App    string            `json:"app"`
+		Config map[string]string `json:"config"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	result, err := SetAppConfig(c.Request.Context(), req.App, req.Config, user)
+	returnReconcileResult(c, result, err)
+}
+
+func returnReconcileResult(c *gin.Context, result *ReconcileResult, err error) {
+	if errors.Is(err, ErrNoDesiredState) || errors.Is(err, ErrInvalidConfig) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else {
+		serverKit.ReturnOkJson(c, result)
+	}
+}
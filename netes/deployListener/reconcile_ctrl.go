@@ -0,0 +1,487 @@
+package deployListener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/events"
+	"turtle/netes/ingress"
+	"turtle/netes/jobs"
+	"turtle/netes/manifest"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const RECONCILER_USER = "reconciler"
+
+var (
+	ErrNoDesiredState = errors.New("app has no desired state on this node")
+	ErrInvalidConfig  = errors.New("invalid config")
+)
+
+// ReconcileResult is outcome of the last comparison of desired state of app with its replicas
+type ReconcileResult struct {
+	App        string `json:"app"`
+	RevisionId string `json:"revisionId,omitempty"`
+	Version    string `json:"version,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	// Desired and running replicas of active revision, jobs have none
+	Replicas int  `json:"replicas"`
+	Running  int  `json:"running"`
+	InSync   bool `json:"inSync"`
+	// Drift found and fixed by this pass
+	Actions      []string  `json:"actions"`
+	Error        string    `json:"error,omitempty"`
+	ReconciledAt time.Time `json:"reconciledAt"`
+}
+
+var (
+	appLocksMu sync.Mutex
+	appLocks   = map[string]*sync.Mutex{}
+
+	startedMu     sync.Mutex
+	startedConfig = map[string]map[string]string{}
+
+	resultsMu        sync.Mutex
+	reconcileResults = map[string]ReconcileResult{}
+)
+
+// lockApp serializes changes of one app between API calls and reconciler, returns unlock
+func lockApp(app string) func() {
+	appLocksMu.Lock()
+	lock, ok := appLocks[app]
+	if !ok {
+		lock = &sync.Mutex{}
+		appLocks[app] = lock
+	}
+	appLocksMu.Unlock()
+
+	lock.Lock()
+	return lock.Unlock
+}
+
+// markStarted remembers config replicas of app were started with
+func markStarted(app string, config map[string]string) {
+	startedMu.Lock()
+	startedConfig[app] = maps.Clone(config)
+	startedMu.Unlock()
+}
+
+func configChanged(app string, config map[string]string) bool {
+	startedMu.Lock()
+	defer startedMu.Unlock()
+
+	started, ok := startedConfig[app]
+	return !ok || !maps.Equal(started, config)
+}
+
+func desiredConfig(ctx context.Context, app string) (map[string]string, error) {
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil || deployment == nil {
+		return nil, err
+	}
+	return deployment.Config, nil
+}
+
+// configuredRevision returns copy of revision with config added to env of its manifest
+func configuredRevision(revision *Revision, config map[string]string) *Revision {
+	if len(config) == 0 {
+		return revision
+	}
+
+	result := *revision
+	result.Manifest.Env = make(map[string]string, len(revision.Manifest.Env)+len(config))
+	maps.Copy(result.Manifest.Env, revision.Manifest.Env)
+	maps.Copy(result.Manifest.Env, config)
+
+	return &result
+}
+
+// SetAppConfig replaces config of desired state of app, replicas are restarted with it right away
+func SetAppConfig(ctx context.Context, app string, config map[string]string, user string) (*ReconcileResult, error) {
+	for key := range config {
+		if err := manifest.ValidateEnvName(key); err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidConfig, err.Error())
+		}
+	}
+
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	if deployment == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoDesiredState, app)
+	}
+
+	_, err = appDeploymentsRepo().UpdateOne(ctx, bson.M{"_id": deployment.Uid}, bson.M{
+		"$set": bson.M{
+			"config":    config,
+			"updatedAt": time.Now(),
+			"updatedBy": user,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to set config: %w", err)
+	}
+
+	lgr.Info("Config of %s set by %s", app, user)
+	events.Emit(events.Event{
+		Type:       events.EVENT_CONFIG_CHANGED,
+		App:        app,
+		RevisionId: deployment.ActiveRevisionId.Hex(),
+		User:       user,
+		Message:    fmt.Sprintf("config with %d variables set", len(config)),
+	})
+
+	deployment.Config = config
+	result := reconcileApp(ctx, deployment)
+
+	return &result, nil
+}
+
+// Reconcile compares desired state of apps of this node with their replicas and fixes
+// drift: missing replicas are started, unexpected ones stopped and apps without desired
+// state removed. Replicas stopped through API and replicas which gave up are left alone.
+func Reconcile(ctx context.Context) ([]ReconcileResult, error) {
+	if !dbclient.IsConnected() {
+		return nil, dbclient.ErrNotConnected
+	}
+
+	deployments, err := appDeploymentsRepo().FindMany(ctx, bson.M{"node": serverKit.SERVER_CONFIG.GetNodeName()})
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ReconcileResult{}
+	desired := map[string]bool{}
+
+	for i := range deployments {
+		desired[deployments[i].App] = true
+		results = append(results, reconcileApp(ctx, &deployments[i]))
+	}
+
+	unknown := map[string]bool{}
+	for _, status := range supervisor.SUPERVISOR.List() {
+		if !desired[status.App] {
+			unknown[status.App] = true
+		}
+	}
+	for _, job := range jobs.JOBS.List() {
+		if !desired[job.App] {
+			unknown[job.App] = true
+		}
+	}
+
+	for app := range unknown {
+		if result, removed := removeUnknownApp(ctx, app); removed {
+			results = append(results, result)
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].App < results[j].App
+	})
+
+	return results, nil
+}
+
+// ReconcileApp runs one pass of reconciler for app
+func ReconcileApp(ctx context.Context, app string) (*ReconcileResult, error) {
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+	if deployment == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoDesiredState, app)
+	}
+
+	result := reconcileApp(ctx, deployment)
+
+	return &result, nil
+}
+
+func reconcileApp(ctx context.Context, deployment *AppDeployment) ReconcileResult {
+	defer lockApp(deployment.App)()
+
+	result := ReconcileResult{
+		App:        deployment.App,
+		RevisionId: deployment.ActiveRevisionId.Hex(),
+		Replicas:   max(deployment.Replicas, 1),
+		Actions:    []string{},
+	}
+
+	err := reconcileRevision(ctx, deployment, &result)
+	if err != nil {
+		result.Error = err.Error()
+		lgr.Error("Failed to reconcile %s: %s", deployment.App, err.Error())
+	}
+
+	result.InSync = err == nil && len(result.Actions) == 0 && (result.Kind != manifest.KIND_SERVICE || result.Running == result.Replicas)
+	saveResult(result)
+
+	return result
+}
+
+func reconcileRevision(ctx context.Context, deployment *AppDeployment, result *ReconcileResult) error {
+	app := deployment.App
+
+	if update, err := supervisor.SUPERVISOR.GetUpdate(app); err == nil && (update.State == supervisor.UPDATE_PROGRESSING || update.State == supervisor.UPDATE_PAUSED) {
+		return fmt.Errorf("%s update to revision %s is %s", update.Strategy, update.RevisionId, update.State)
+	}
+
+	revision, err := GetRevision(ctx, result.RevisionId)
+	if err != nil {
+		return err
+	}
+
+	result.Version = revision.Version
+	result.Kind = revision.Manifest.Kind
+
+	if _, running := supervisor.SUPERVISOR.Status(app); (running || isJobRegistered(app)) && configChanged(app, deployment.Config) {
+		// Replicas run with other config, all of them start again
+		return restartRevision(ctx, revision, deployment, result, "restarted with changed config")
+	}
+
+	if revision.Manifest.IsJob() {
+		result.Replicas = 0
+		if !isJobRegistered(app) || jobRevision(app) != result.RevisionId {
+			return restartRevision(ctx, revision, deployment, result, "registered job")
+		}
+		return nil
+	}
+
+	statuses, _ := supervisor.SUPERVISOR.Status(app)
+
+	active := []supervisor.ProcessStatus{}
+	for _, status := range statuses {
+		if status.RevisionId == result.RevisionId {
+			active = append(active, status)
+		}
+	}
+
+	if len(active) == 0 {
+		return restartRevision(ctx, revision, deployment, result, fmt.Sprintf("started %d replicas", result.Replicas))
+	}
+
+	if isJobRegistered(app) {
+		jobs.JOBS.Unregister(app)
+		result.Actions = append(result.Actions, "unregistered job")
+	}
+
+	// Other color of blue/green or canary app is expected to run
+	colors, _ := supervisor.SUPERVISOR.GetColors(app)
+	expected := map[string]bool{result.RevisionId: true}
+	for _, color := range []*supervisor.ColorStatus{colors.Blue, colors.Green} {
+		if color != nil {
+			expected[color.RevisionId] = true
+		}
+	}
+
+	present := map[int]bool{}
+
+	for _, status := range statuses {
+		switch {
+		case !expected[status.RevisionId]:
+			if err := supervisor.SUPERVISOR.StopReplica(app, status.RevisionId, status.Replica); err == nil {
+				result.Actions = append(result.Actions, fmt.Sprintf("stopped replica %d of unexpected revision %s", status.Replica, status.RevisionId))
+			}
+		case status.RevisionId != result.RevisionId:
+		case status.Replica >= result.Replicas:
+			if err := supervisor.SUPERVISOR.StopReplica(app, status.RevisionId, status.Replica); err == nil {
+				result.Actions = append(result.Actions, fmt.Sprintf("stopped extra replica %d", status.Replica))
+			}
+		default:
+			present[status.Replica] = true
+			if status.State != supervisor.STATE_STOPPED && status.State != supervisor.STATE_FAILED && status.State != supervisor.STATE_EXITED {
+				result.Running++
+			}
+		}
+	}
+
+	appManifest := configuredRevision(revision, deployment.Config).Manifest
+
+	for replica := 0; replica < result.Replicas; replica++ {
+		if present[replica] {
+			continue
+		}
+		if _, err := supervisor.SUPERVISOR.StartReplica(app, result.RevisionId, revision.GetDir(), &appManifest, replica); err != nil {
+			return err
+		}
+		result.Running++
+		result.Actions = append(result.Actions, fmt.Sprintf("started missing replica %d", replica))
+	}
+
+	if len(result.Actions) > 0 {
+		lgr.Info("Reconciled %s: %v", app, result.Actions)
+	}
+
+	return nil
+}
+
+// restartRevision starts all replicas of revision again, like a deploy of it
+func restartRevision(ctx context.Context, revision *Revision, deployment *AppDeployment, result *ReconcileResult, action string) error {
+	statuses, err := startRevision(ctx, revision, result.Replicas, "", RECONCILER_USER)
+	if err != nil {
+		return err
+	}
+
+	result.Running = 0
+	for _, status := range statuses {
+		if status.RevisionId == result.RevisionId && !revision.Manifest.IsJob() {
+			result.Running++
+		}
+	}
+	result.Actions = append(result.Actions, action)
+
+	lgr.Info("Reconciled %s: %s", deployment.App, action)
+
+	return nil
+}
+
+// removeUnknownApp removes replicas and job of app unless it got desired state since
+// the pass started, e.g. first deploy starts replicas before its desired state is saved
+func removeUnknownApp(ctx context.Context, app string) (ReconcileResult, bool) {
+	defer lockApp(app)()
+
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil {
+		lgr.Error("Failed to check desired state of %s: %s", app, err.Error())
+		return ReconcileResult{}, false
+	}
+	if deployment != nil {
+		return ReconcileResult{}, false
+	}
+
+	result := ReconcileResult{
+		App:          app,
+		Actions:      []string{},
+		ReconciledAt: time.Now(),
+	}
+
+	if _, ok := supervisor.SUPERVISOR.Status(app); ok {
+		supervisor.SUPERVISOR.Remove(app)
+		ingress.ROUTER.RemoveAppRoutes(app)
+		result.Actions = append(result.Actions, "removed replicas of app without desired state")
+	}
+	if isJobRegistered(app) {
+		jobs.JOBS.Unregister(app)
+		result.Actions = append(result.Actions, "unregistered job of app without desired state")
+	}
+
+	lgr.Info("Reconciled %s: %v", app, result.Actions)
+	saveResult(result)
+
+	return result, true
+}
+
+func isJobRegistered(app string) bool {
+	return jobRevision(app) != ""
+}
+
+func jobRevision(app string) string {
+	for _, job := range jobs.JOBS.List() {
+		if job.App == app {
+			return job.RevisionId
+		}
+	}
+	return ""
+}
+
+// saveResult stores result, drift fixed and new errors become events
+func saveResult(result ReconcileResult) {
+	if result.ReconciledAt.IsZero() {
+		result.ReconciledAt = time.Now()
+	}
+
+	resultsMu.Lock()
+	previous := reconcileResults[result.App]
+	reconcileResults[result.App] = result
+	resultsMu.Unlock()
+
+	if result.Error != "" && result.Error != previous.Error {
+		events.Warnf(events.EVENT_RECONCILED, result.App, result.RevisionId, "reconcile failed: %s", result.Error)
+	}
+	if len(result.Actions) > 0 {
+		events.Emit(events.Event{
+			Type:       events.EVENT_RECONCILED,
+			App:        result.App,
+			RevisionId: result.RevisionId,
+			User:       RECONCILER_USER,
+			Message:    strings.Join(result.Actions, ", "),
+		})
+	}
+}
+
+// ListReconcileResults returns the last reconcile result of every app
+func ListReconcileResults() []ReconcileResult {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	results := make([]ReconcileResult, 0, len(reconcileResults))
+	for _, result := range reconcileResults {
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].App < results[j].App
+	})
+
+	return results
+}
+
+func GetReconcileResult(app string) (ReconcileResult, bool) {
+	resultsMu.Lock()
+	defer resultsMu.Unlock()
+
+	result, ok := reconcileResults[app]
+	return result, ok
+}
+
+var (
+	reconcilerStop     = make(chan struct{})
+	reconcilerDone     = make(chan struct{})
+	reconcilerStopOnce sync.Once
+)
+
+// StartReconciler starts active revisions of this node and keeps them running
+func StartReconciler() {
+	go func() {
+		defer close(reconcilerDone)
+
+		ticker := time.NewTicker(serverKit.SERVER_CONFIG.GetReconcileInterval())
+		defer ticker.Stop()
+
+		for {
+			tools.SafeGoRoutine(func() {
+				if _, err := Reconcile(context.Background()); err != nil {
+					lgr.Error("Reconcile failed: %s", err.Error())
+				}
+			})
+
+			select {
+			case <-reconcilerStop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// StopReconciler stops reconciler started by StartReconciler and waits for pass in
+// progress, so it can't start replicas again while node is shutting down
+func StopReconciler() {
+	reconcilerStopOnce.Do(func() {
+		close(reconcilerStop)
+	})
+	<-reconcilerDone
+}
@@ -0,0 +1,197 @@
+package deployListener
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/appLogs"
+	"turtle/netes/artifacts"
+	"turtle/netes/events"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type RetentionResult struct {
+	RemovedRevisions int                `json:"removedRevisions"`
+	RemovedUploads   int                `json:"removedUploads"`
+	Gc               artifacts.GcResult `json:"gc"`
+}
+
+// ApplyRetention removes revisions beyond GetKeepRevisions per app,
+// active and previous revision are always kept
+func ApplyRetention(ctx context.Context) (int, error) {
+	node := serverKit.SERVER_CONFIG.GetNodeName()
+	keep := serverKit.SERVER_CONFIG.GetKeepRevisions()
+
+	apps, err := revisionsRepo().Distinct(ctx, "app", bson.M{"node": node})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, value := range apps {
+		app, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		revisions, err := ListRevisions(ctx, app)
+		if err != nil {
+			return removed, err
+		}
+
+		protected := map[primitive.ObjectID]bool{}
+
+		deployment, err := GetAppDeployment(ctx, app)
+		if err != nil {
+			return removed, err
+		}
+		if deployment != nil {
+			protected[deployment.ActiveRevisionId] = true
+			protected[deployment.PreviousRevisionId] = true
+		}
+
+		for i, revision := range revisions {
+			if i < keep || protected[revision.Uid] {
+				continue
+			}
+
+			if err := DeleteRevision(ctx, revision.Uid); err != nil {
+				lgr.Error("Failed to remove revision %s of %s: %s", revision.Uid.Hex(), app, err.Error())
+				continue
+			}
+
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// DeleteRevision removes revision files and releases its artifact references
+func DeleteRevision(ctx context.Context, uid primitive.ObjectID) error {
+	revision, err := revisionsRepo().FindByID(ctx, uid)
+	if err != nil || revision == nil {
+		return err
+	}
+
+	if err := os.RemoveAll(revision.GetDir()); err != nil {
+		return err
+	}
+
+	if err := appLogs.RemoveRevisionLogs(revision.App, uid.Hex()); err != nil {
+		lgr.Error("Failed to remove logs of revision %s: %s", uid.Hex(), err.Error())
+	}
+
+	if _, err := revisionsRepo().DeleteByID(ctx, uid); err != nil {
+		return err
+	}
+
+	lgr.Info("Removed revision %s of %s by retention policy", uid.Hex(), revision.App)
+	events.Emitf(events.EVENT_REVISION_REMOVED, revision.App, uid.Hex(), "revision of version %s removed by retention policy", revision.Version)
+
+	return artifacts.RemoveReferences(ctx, revision.ReferencedHashes())
+}
+
+// RunGarbageCollection removes abandoned uploads, applies retention and then
+// removes unreferenced artifacts
+func RunGarbageCollection(ctx context.Context) (*RetentionResult, error) {
+	result := &RetentionResult{}
+
+	if !dbclient.IsConnected() {
+		return result, dbclient.ErrNotConnected
+	}
+
+	removedUploads, err := CleanupAbandonedUploads(ctx)
+	result.RemovedUploads = removedUploads
+	if err != nil {
+		return result, err
+	}
+
+	removed, err := ApplyRetention(ctx)
+	result.RemovedRevisions = removed
+	if err != nil {
+		return result, err
+	}
+
+	result.Gc, err = artifacts.CollectGarbage(ctx)
+
+	return result, err
+}
+
+// GetStoreReport reports artifact store with bytes of revision files of this node
+// sharing or copying stored objects, sizes come from files recorded at ingest
+func GetStoreReport(ctx context.Context) (*artifacts.StoreReport, error) {
+	report, err := artifacts.GetStoreReport(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"node": serverKit.SERVER_CONFIG.GetNodeName()}}},
+		{{Key: "$unwind", Value: "$files"}},
+		{{Key: "$match", Value: bson.M{"files.sha256": bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{
+			"_id":   bson.M{"$ifNull": bson.A{"$files.copied", false}},
+			"bytes": bson.M{"$sum": "$files.size"},
+		}}},
+	}
+
+	collection, err := revisionsRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to aggregate revision files: %w", err)
+	}
+	defer cursor.Close(ctx)
+
+	var groups []struct {
+		Copied bool  `bson:"_id"`
+		Bytes  int64 `bson:"bytes"`
+	}
+
+	if err := cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		if group.Copied {
+			report.CopiedBytes += group.Bytes
+		} else {
+			report.SharedBytes += group.Bytes
+		}
+	}
+
+	return report, nil
+}
+
+// StartGarbageCollector runs RunGarbageCollection every GetGcInterval
+func StartGarbageCollector() {
+	go func() {
+		if err := artifacts.EnsureIndexes(context.Background()); err != nil {
+			lgr.Error("Failed to create artifact indexes: %s", err.Error())
+		}
+
+		ticker := time.NewTicker(serverKit.SERVER_CONFIG.GetGcInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			tools.SafeGoRoutine(func() {
+				if _, err := RunGarbageCollection(context.Background()); err != nil {
+					lgr.Error("Garbage collection failed: %s", err.Error())
+				}
+			})
+		}
+	}()
+}
@@ -0,0 +1,195 @@
+package deployListener
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+	"turtle/netes/supervisor"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+GET /deplistener/revisions?app=
+*/
+func _ListRevisions(c *gin.Context) {
+	revisions, err := ListRevisions(c.Request.Context(), c.Query("app"))
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, revisions)
+}
+
+/*
+GET /deplistener/revisions/active?app=
+*/
+func _GetActiveRevision(c *gin.Context) {
+	deployment, err := GetAppDeployment(c.Request.Context(), c.Query("app"))
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	if deployment == nil {
+		serverKit.ReturnUnacceptable(c, ErrRevisionNotFound)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, deployment)
+}
+
+/*
+GET /deplistener/revisions/files?app=&revisionId=
+File manifest (path + sha256) of revision, of active revision when revisionId is empty
+*/
+func _GetRevisionFiles(c *gin.Context) {
+	files, err := GetRevisionFiles(c.Request.Context(), c.Query("app"), c.Query("revisionId"))
+
+	if errors.Is(err, ErrRevisionNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, files)
+}
+
+/*
+POST /deplistener/revisions/delta?app=&baseRevisionId=
+Package is sent the same way as to /deplistener/receive, but contains only new
+or changed files and optional .turtle-delete file listing removed paths.
+Base is active revision when baseRevisionId is empty.
+*/
+func _ReceiveDelta(c *gin.Context) {
+	req, closeReq, err := ParsePackageRequest(c)
+	defer closeReq()
+
+	if err != nil {
+		returnPackageError(c, err)
+		return
+	}
+
+	uploader, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	received, err := DeployDelta(c.Request.Context(), req, c.Query("baseRevisionId"), uploader)
+
+	if errors.Is(err, ErrRevisionNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		returnPackageError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, received)
+}
+
+/*
+POST /deplistener/revisions/rollback
+Body:
+
+	{
+	  "app": "my-app",
+	  "revisionId": "optional, previous active revision when empty"
+	}
+*/
+func _RollbackRevision(c *gin.Context) {
+	var req struct {
+		App        string `json:"app"`
+		RevisionId string `json:"revisionId"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	revision, statuses, err := Rollback(c.Request.Context(), req.App, req.RevisionId, user)
+
+	if errors.Is(err, ErrRevisionNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, bson.M{
+		"revision":  revision,
+		"processes": statuses,
+	})
+}
+
+/*
+POST /deplistener/apps/scale?app=&replicas=
+Starts or stops replicas of active revision of app on this node
+*/
+func _ScaleApp(c *gin.Context) {
+	replicas, err := strconv.Atoi(c.Query("replicas"))
+	if err != nil {
+		serverKit.ReturnUnacceptable(c, fmt.Errorf("%w: replicas must be a number", ErrInvalidReplicas))
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	statuses, err := Scale(c.Request.Context(), c.Query("app"), replicas, user)
+
+	if errors.Is(err, ErrRevisionNotFound) || errors.Is(err, ErrInvalidReplicas) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, statuses)
+}
+
+/*
+POST /deplistener/apps/switch?app=
+Switches traffic of blue/green app to the other color, which becomes active revision
+*/
+func _SwitchAppColor(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	colors, err := SwitchColor(c.Request.Context(), c.Query("app"), user)
+
+	if errors.Is(err, supervisor.ErrColorsNotFound) || errors.Is(err, supervisor.ErrNotReady) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, colors)
+}
@@ -0,0 +1,500 @@
+package deployListener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/artifacts"
+	"turtle/netes/events"
+	"turtle/netes/ingress"
+	"turtle/netes/jobs"
+	"turtle/netes/manifest"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	REVISIONS_COLLECTION       = "revisions"
+	APP_DEPLOYMENTS_COLLECTION = "app_deployments"
+)
+
+var (
+	ErrRevisionNotFound = errors.New("revision not found")
+	ErrInvalidReplicas  = errors.New("invalid replicas")
+)
+
+// Revision is immutable record of one uploaded package, it is never updated
+type Revision struct {
+	Uid       primitive.ObjectID `json:"uid" bson:"_id"`
+	App       string             `json:"app" bson:"app"`
+	Node      string             `json:"node" bson:"node"`
+	Version   string             `json:"version" bson:"version"`
+	Sha256    string             `json:"sha256" bson:"sha256"`
+	Size      int64              `json:"size" bson:"size"`
+	Uploader  string             `json:"uploader" bson:"uploader"`
+	CreatedAt time.Time          `json:"createdAt" bson:"createdAt"`
+	Manifest  manifest.Manifest  `json:"manifest" bson:"manifest"`
+	// Set when revision was built from delta package on top of base revision
+	BaseRevisionId string `json:"baseRevisionId,omitempty" bson:"baseRevisionId,omitempty"`
+	// Files are hardlinks into artifact store, excluded from revision lists
+	Files []artifacts.FileEntry `json:"files,omitempty" bson:"files"`
+}
+
+// AppDeployment is desired state of app on node, reconciler keeps replicas in line with it
+type AppDeployment struct {
+	Uid                primitive.ObjectID `json:"uid" bson:"_id"`
+	App                string             `json:"app" bson:"app"`
+	Node               string             `json:"node" bson:"node"`
+	ActiveRevisionId   primitive.ObjectID `json:"activeRevisionId" bson:"activeRevisionId"`
+	PreviousRevisionId primitive.ObjectID `json:"previousRevisionId" bson:"previousRevisionId"`
+	// Replicas of the app on this node
+	Replicas int `json:"replicas" bson:"replicas"`
+	// Env variables set on top of env of manifest of active revision
+	Config    map[string]string `json:"config,omitempty" bson:"config,omitempty"`
+	UpdatedAt time.Time         `json:"updatedAt" bson:"updatedAt"`
+	UpdatedBy string            `json:"updatedBy" bson:"updatedBy"`
+}
+
+func revisionsRepo() *dbclient.Repository[Revision] {
+	return dbclient.NewRepository[Revision](dbclient.MongoClient, REVISIONS_COLLECTION)
+}
+
+func appDeploymentsRepo() *dbclient.Repository[AppDeployment] {
+	return dbclient.NewRepository[AppDeployment](dbclient.MongoClient, APP_DEPLOYMENTS_COLLECTION)
+}
+
+func appDeploymentUid(node, app string) primitive.ObjectID {
+	return tools.StringToObjectID(node + "/" + app)
+}
+
+func (self *Revision) GetDir() string {
+	return GetRevisionDir(self.App, self.Uid.Hex())
+}
+
+func (self *Revision) ReferencedHashes() []string {
+	return artifacts.ReferencedHashes(self.Sha256, self.Files)
+}
+
+// CreateRevision stores received package as new revision
+func CreateRevision(ctx context.Context, received *ReceivedPackage, uploader string) (*Revision, error) {
+	uid, err := primitive.ObjectIDFromHex(received.RevisionId)
+	if err != nil {
+		return nil, err
+	}
+
+	revision := &Revision{
+		Uid:       uid,
+		App:       received.App,
+		Node:      serverKit.SERVER_CONFIG.GetNodeName(),
+		Version:   received.Manifest.Version,
+		Sha256:    received.Sha256,
+		Size:      received.Size,
+		Uploader:  uploader,
+		CreatedAt: time.Now(),
+		Manifest:  *received.Manifest,
+		Files:     received.Files,
+
+		BaseRevisionId: received.BaseRevisionId,
+	}
+
+	if err := artifacts.TrackFiles(ctx, revision.Sha256, revision.Size, revision.Files); err != nil {
+		return nil, err
+	}
+
+	if _, err := revisionsRepo().InsertOne(ctx, revision); err != nil {
+		return nil, err
+	}
+
+	if err := artifacts.AddReferences(ctx, revision.ReferencedHashes()); err != nil {
+		return nil, err
+	}
+
+	events.Emit(events.Event{
+		Type:       events.EVENT_REVISION_CREATED,
+		App:        revision.App,
+		RevisionId: revision.Uid.Hex(),
+		User:       uploader,
+		Message:    fmt.Sprintf("revision of version %s created", revision.Version),
+	})
+
+	return revision, nil
+}
+
+func GetRevision(ctx context.Context, revisionId string) (*Revision, error) {
+	uid, err := primitive.ObjectIDFromHex(revisionId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRevisionNotFound, revisionId)
+	}
+
+	revision, err := revisionsRepo().FindByID(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if revision == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRevisionNotFound, revisionId)
+	}
+
+	return revision, nil
+}
+
+// ListRevisions returns revisions of app on this node, newest first
+func ListRevisions(ctx context.Context, app string) ([]Revision, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "createdAt", Value: -1}}).
+		SetProjection(bson.M{"files": 0})
+
+	return revisionsRepo().FindMany(ctx, bson.M{
+		"app":  app,
+		"node": serverKit.SERVER_CONFIG.GetNodeName(),
+	}, opts)
+}
+
+func GetAppDeployment(ctx context.Context, app string) (*AppDeployment, error) {
+	return appDeploymentsRepo().FindByID(ctx, appDeploymentUid(serverKit.SERVER_CONFIG.GetNodeName(), app))
+}
+
+// SetActiveRevision marks revision as active and remembers the previous one
+func SetActiveRevision(ctx context.Context, revision *Revision, replicas int, user string) (*AppDeployment, error) {
+	node := serverKit.SERVER_CONFIG.GetNodeName()
+
+	current, err := GetAppDeployment(ctx, revision.App)
+	if err != nil {
+		return nil, err
+	}
+
+	deployment := &AppDeployment{
+		Uid:              appDeploymentUid(node, revision.App),
+		App:              revision.App,
+		Node:             node,
+		ActiveRevisionId: revision.Uid,
+		Replicas:         replicas,
+		UpdatedAt:        time.Now(),
+		UpdatedBy:        user,
+	}
+
+	if current != nil && current.ActiveRevisionId != revision.Uid {
+		deployment.PreviousRevisionId = current.ActiveRevisionId
+	} else if current != nil {
+		deployment.PreviousRevisionId = current.PreviousRevisionId
+	}
+	if current != nil {
+		deployment.Config = current.Config
+	}
+
+	collection, err := appDeploymentsRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": deployment.Uid},
+		deployment,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set active revision: %w", err)
+	}
+
+	return deployment, nil
+}
+
+// resolveReplicas returns requested replicas, current replicas of app when 0 is
+// requested, or replicas of the manifest for the first deployment
+func resolveReplicas(ctx context.Context, revision *Revision, replicas int) (int, error) {
+	if replicas < 0 {
+		return 0, fmt.Errorf("%w: %d", ErrInvalidReplicas, replicas)
+	}
+	if replicas > 1 && revision.Manifest.HasFixedPorts() {
+		return 0, fmt.Errorf("%w: %s has fixed ports, it runs only 1 replica", ErrInvalidReplicas, revision.App)
+	}
+	if replicas > 0 {
+		return replicas, nil
+	}
+
+	// Replicas of the previous revision don't apply, fixed ports allow only one
+	if revision.Manifest.HasFixedPorts() {
+		return 1, nil
+	}
+
+	deployment, err := GetAppDeployment(ctx, revision.App)
+	if err != nil {
+		return 0, err
+	}
+	if deployment != nil && deployment.Replicas > 0 {
+		return deployment.Replicas, nil
+	}
+
+	return max(revision.Manifest.Placement.Replicas, 1), nil
+}
+
+// ActivateRevision renders templates, starts replicas of revision under supervisor
+// and marks it active, replicas 0 keeps current number of replicas
+func ActivateRevision(ctx context.Context, revision *Revision, replicas int, user string) ([]supervisor.ProcessStatus, error) {
+	defer lockApp(revision.App)()
+
+	replicas, err := resolveReplicas(ctx, revision, replicas)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := startRevision(ctx, revision, replicas, jobs.TRIGGER_DEPLOY, user)
+	if err != nil {
+		return statuses, err
+	}
+
+	if _, err := SetActiveRevision(ctx, revision, replicas, user); err != nil {
+		return statuses, err
+	}
+
+	events.Emit(events.Event{
+		Type:       events.EVENT_REVISION_ACTIVATED,
+		App:        revision.App,
+		RevisionId: revision.Uid.Hex(),
+		User:       user,
+		Message:    fmt.Sprintf("version %s activated with %d replicas", revision.Version, replicas),
+	})
+
+	return statuses, nil
+}
+
+// startRevision starts service under supervisor or registers job, job kind is run
+// right away when jobTrigger is set. Config of desired state is added to manifest env.
+func startRevision(ctx context.Context, revision *Revision, replicas int, jobTrigger, user string) ([]supervisor.ProcessStatus, error) {
+	config, err := desiredConfig(ctx, revision.App)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := startConfiguredRevision(ctx, configuredRevision(revision, config), replicas, jobTrigger, user)
+	if err == nil {
+		markStarted(revision.App, config)
+	}
+
+	return statuses, err
+}
+
+func startConfiguredRevision(ctx context.Context, revision *Revision, replicas int, jobTrigger, user string) ([]supervisor.ProcessStatus, error) {
+	dir := revision.GetDir()
+
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("revision %s files are missing: %w", revision.Uid.Hex(), err)
+	}
+
+	// Replicas render templates when they start, broken templates fail the deploy here
+	if _, err := RenderTemplates(ctx, revision, RenderOptions{DryRun: true}); err != nil {
+		return nil, err
+	}
+
+	if revision.Manifest.IsJob() {
+		return startJobRevision(revision, jobTrigger, user)
+	}
+
+	jobs.JOBS.Unregister(revision.App)
+
+	appManifest := revision.Manifest
+
+	statuses, err := supervisor.SUPERVISOR.Update(revision.App, revision.Uid.Hex(), dir, &appManifest, replicas, func(update supervisor.UpdateStatus) {
+		if update.State == supervisor.UPDATE_ROLLED_BACK {
+			revertActiveRevision(revision, update)
+		}
+	})
+	if err != nil {
+		return statuses, err
+	}
+
+	ingress.ROUTER.SetAppRoutes(revision.App, appManifest.Routes)
+
+	return statuses, nil
+}
+
+// revertActiveRevision points app back to previous revision after its rolling update
+// was rolled back, old replicas are already running again
+func revertActiveRevision(revision *Revision, update supervisor.UpdateStatus) {
+	ctx := context.Background()
+
+	deployment, err := GetAppDeployment(ctx, revision.App)
+	if err != nil {
+		lgr.Error("Failed to revert active revision of %s: %s", revision.App, err.Error())
+		return
+	}
+	if deployment == nil || deployment.ActiveRevisionId != revision.Uid || deployment.PreviousRevisionId.IsZero() {
+		return
+	}
+
+	deployment.ActiveRevisionId, deployment.PreviousRevisionId = deployment.PreviousRevisionId, deployment.ActiveRevisionId
+	deployment.UpdatedAt = time.Now()
+
+	if _, err := appDeploymentsRepo().ReplaceOne(ctx, bson.M{"_id": deployment.Uid}, deployment); err != nil {
+		lgr.Error("Failed to revert active revision of %s: %s", revision.App, err.Error())
+		return
+	}
+
+	lgr.Error("Update of %s to version %s was rolled back: %s", revision.App, revision.Version, update.Error)
+	events.Warnf(events.EVENT_REVISION_ACTIVATED, revision.App, deployment.ActiveRevisionId.Hex(), "previous revision is active again, update to version %s was rolled back", revision.Version)
+}
+
+// Scale changes number of replicas of active revision of app on this node
+func Scale(ctx context.Context, app string, replicas int, user string) ([]supervisor.ProcessStatus, error) {
+	if replicas < 1 {
+		return nil, fmt.Errorf("%w: at least 1 replica is required", ErrInvalidReplicas)
+	}
+
+	defer lockApp(app)()
+
+	revision, err := resolveBaseRevision(ctx, app, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if revision.Manifest.IsJob() {
+		return nil, fmt.Errorf("%w: %s is a %s", ErrInvalidReplicas, app, revision.Manifest.Kind)
+	}
+	if replicas > 1 && revision.Manifest.HasFixedPorts() {
+		return nil, fmt.Errorf("%w: %s has fixed ports, it runs only 1 replica", ErrInvalidReplicas, app)
+	}
+
+	config, err := desiredConfig(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	appManifest := configuredRevision(revision, config).Manifest
+
+	statuses, err := supervisor.SUPERVISOR.Scale(app, revision.Uid.Hex(), revision.GetDir(), &appManifest, replicas)
+	if err != nil {
+		return statuses, err
+	}
+
+	if _, err := SetActiveRevision(ctx, revision, replicas, user); err != nil {
+		return statuses, err
+	}
+
+	lgr.Info("Scaled %s to %d replicas by %s", app, replicas, user)
+	events.Emit(events.Event{
+		Type:       events.EVENT_SCALED,
+		App:        app,
+		RevisionId: revision.Uid.Hex(),
+		User:       user,
+		Message:    fmt.Sprintf("scaled to %d replicas", replicas),
+	})
+
+	return statuses, nil
+}
+
+func startJobRevision(revision *Revision, jobTrigger, user string) ([]supervisor.ProcessStatus, error) {
+	// App could be a service before
+	supervisor.SUPERVISOR.Remove(revision.App)
+	ingress.ROUTER.RemoveAppRoutes(revision.App)
+
+	status := supervisor.ProcessStatus{
+		App:        revision.App,
+		RevisionId: revision.Uid.Hex(),
+		Version:    revision.Version,
+		State:      jobs.STATE_REGISTERED,
+	}
+
+	statuses := []supervisor.ProcessStatus{status}
+
+	err := jobs.JOBS.Register(jobs.JobDefinition{
+		App:        revision.App,
+		RevisionId: revision.Uid.Hex(),
+		Dir:        revision.GetDir(),
+		Manifest:   revision.Manifest,
+	})
+	if err != nil {
+		return statuses, err
+	}
+
+	if jobTrigger != "" && revision.Manifest.Kind == manifest.KIND_JOB {
+		if _, err := jobs.JOBS.Trigger(revision.App, jobTrigger, user); err != nil {
+			return statuses, err
+		}
+	}
+
+	return statuses, nil
+}
+
+// Rollback switches app back to revisionId, or to previously active revision when empty
+func Rollback(ctx context.Context, app, revisionId, user string) (*Revision, []supervisor.ProcessStatus, error) {
+	if revisionId == "" {
+		deployment, err := GetAppDeployment(ctx, app)
+		if err != nil {
+			return nil, nil, err
+		}
+		if deployment == nil || deployment.PreviousRevisionId.IsZero() {
+			return nil, nil, fmt.Errorf("%w: app %s has no previous revision", ErrRevisionNotFound, app)
+		}
+		revisionId = deployment.PreviousRevisionId.Hex()
+	}
+
+	revision, err := GetRevision(ctx, revisionId)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if revision.App != app || revision.Node != serverKit.SERVER_CONFIG.GetNodeName() {
+		return nil, nil, fmt.Errorf("%w: %s does not belong to app %s on this node", ErrRevisionNotFound, revisionId, app)
+	}
+
+	statuses, err := ActivateRevision(ctx, revision, 0, user)
+	if err != nil {
+		return nil, statuses, err
+	}
+
+	lgr.Ok("Rolled back %s to revision %s by %s", app, revisionId, user)
+	events.Emit(events.Event{
+		Type:       events.EVENT_ROLLBACK,
+		App:        app,
+		RevisionId: revisionId,
+		User:       user,
+		Message:    fmt.Sprintf("rolled back to version %s", revision.Version),
+	})
+
+	return revision, statuses, nil
+}
+
+// SwitchColor sends traffic of blue/green app to its other color right away and
+// marks revision of that color active
+func SwitchColor(ctx context.Context, app, user string) (*supervisor.Colors, error) {
+	defer lockApp(app)()
+
+	deployment, err := GetAppDeployment(ctx, app)
+	if err != nil {
+		return nil, err
+	}
+
+	colors, err := supervisor.SUPERVISOR.SwitchColor(app)
+	if err != nil {
+		return nil, err
+	}
+
+	revision, err := GetRevision(ctx, colors.ActiveRevisionId)
+	if err != nil {
+		return &colors, err
+	}
+
+	replicas := 1
+	if deployment != nil {
+		replicas = max(deployment.Replicas, 1)
+	}
+
+	if _, err := SetActiveRevision(ctx, revision, replicas, user); err != nil {
+		return &colors, err
+	}
+
+	ingress.ROUTER.SetAppRoutes(app, revision.Manifest.Routes)
+
+	lgr.Ok("Switched %s to %s color, version %s by %s", app, colors.Active, revision.Version, user)
+
+	return &colors, nil
+}
@@ -0,0 +1,92 @@
+package deployListener
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+)
+
+var ErrInvalidSignature = fmt.Errorf("%w: signature", ErrInvalidPackage)
+
+/*
+Packages are signed with detached ed25519 signature over raw 32 bytes of
+package SHA-256 digest:
+
+	signature = ed25519.Sign(privateKey, sha256(package))
+
+Signature is sent base64 encoded in X-Package-Signature header (or multipart
+field "signature"), optional X-Package-Key-Id selects trusted key to check.
+Unsigned packages are accepted only when no key is trusted and requireSignatures
+is off, signature which can't be verified is always rejected.
+*/
+func VerifyPackageSignature(sha256Hex, signature, keyId string) error {
+	trusted := serverKit.SERVER_CONFIG.TrustedPublicKeys
+
+	if len(trusted) == 0 {
+		if serverKit.SERVER_CONFIG.RequireSignatures {
+			return fmt.Errorf("%w: signatures are required but no key is trusted on this node", ErrInvalidSignature)
+		}
+		if signature != "" {
+			return fmt.Errorf("%w: package is signed but no key is trusted on this node", ErrInvalidSignature)
+		}
+		return nil
+	}
+
+	if signature == "" {
+		return fmt.Errorf("%w: package is not signed, signature is required", ErrInvalidSignature)
+	}
+
+	signatureBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || len(signatureBytes) != ed25519.SignatureSize {
+		return fmt.Errorf("%w: signature must be base64 encoded %d bytes", ErrInvalidSignature, ed25519.SignatureSize)
+	}
+
+	digest, err := hex.DecodeString(sha256Hex)
+	if err != nil {
+		return fmt.Errorf("%w: invalid package checksum", ErrInvalidSignature)
+	}
+
+	keyIds := []string{keyId}
+
+	if keyId == "" {
+		keyIds = make([]string, 0, len(trusted))
+		for id := range trusted {
+			keyIds = append(keyIds, id)
+		}
+		sort.Strings(keyIds)
+	} else if _, ok := trusted[keyId]; !ok {
+		return fmt.Errorf("%w: key %q is not trusted", ErrInvalidSignature, keyId)
+	}
+
+	for _, id := range keyIds {
+		publicKey, err := parsePublicKey(trusted[id])
+		if err != nil {
+			lgr.Error("Trusted key %q is invalid, skipping it: %s", id, err.Error())
+			continue
+		}
+
+		if ed25519.Verify(publicKey, digest, signatureBytes) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: signature does not match any trusted key, package was tampered with or signed by unknown key", ErrInvalidSignature)
+}
+
+func parsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("expected %d bytes, got %d", ed25519.PublicKeySize, len(data))
+	}
+
+	return ed25519.PublicKey(data), nil
+}
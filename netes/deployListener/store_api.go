@@ -0,0 +1,37 @@
+package deployListener
+
+import (
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /deplistener/store
+Size of artifact store and how much space GC can reclaim
+*/
+func _GetStoreReport(c *gin.Context) {
+	report, err := GetStoreReport(c.Request.Context())
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, report)
+}
+
+/*
+POST /deplistener/store/gc
+Applies revision retention and removes unreferenced artifacts now
+*/
+func _RunStoreGc(c *gin.Context) {
+	result, err := RunGarbageCollection(c.Request.Context())
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, result)
+}
@@ -0,0 +1,51 @@
+package deployListener
+
+import (
+	"errors"
+	"strconv"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+POST /deplistener/templates/render?app=&revisionId=&env=&replica=
+Dry run, returns rendered manifest templates of replica without writing them. Secret
+values are replaced with <secret:name>. Active revision is used when revisionId is empty.
+*/
+func _RenderTemplates(c *gin.Context) {
+	revision, err := resolveBaseRevision(c.Request.Context(), c.Query("app"), c.Query("revisionId"))
+
+	if errors.Is(err, ErrRevisionNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	opts := RenderOptions{
+		Env:    c.Query("env"),
+		DryRun: true,
+	}
+
+	if value := c.Query("replica"); value != "" {
+		opts.Replica, err = strconv.Atoi(value)
+		if err != nil || opts.Replica < 0 {
+			serverKit.ReturnUnacceptable(c, errors.New("replica must be positive number"))
+			return
+		}
+	}
+
+	rendered, err := RenderTemplates(c.Request.Context(), revision, opts)
+
+	if errors.Is(err, ErrInvalidPackage) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, rendered)
+}
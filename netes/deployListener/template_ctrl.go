@@ -0,0 +1,328 @@
+package deployListener
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"turtle/core/serverKit"
+	"turtle/netes/artifacts"
+	"turtle/netes/manifest"
+	"turtle/netes/nodeInfo"
+	"turtle/netes/secrets"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var ErrInvalidTemplate = fmt.Errorf("%w: template", ErrInvalidPackage)
+
+const (
+	MAX_TEMPLATE_SIZE          = 1 << 20
+	MAX_RENDERED_SIZE          = 10 << 20
+	DRY_RUN_SECRET_PLACEHOLDER = "<secret:%s>"
+)
+
+// TemplateData is passed to manifest templates, e.g. {{ .Node.Labels.zone }}.
+// Templates are rendered for every replica into its instance folder.
+type TemplateData struct {
+	App        string
+	Version    string
+	RevisionId string
+	Replica    int               // replica index, 0 for job runs
+	Env        string            // environment name of this node from config
+	Vars       map[string]string // env of the manifest
+	Node       *nodeInfo.NodeInfo
+}
+
+type RenderOptions struct {
+	// Env overrides configured environment name, used by dry run
+	Env string
+	// DryRun returns rendered content instead of writing it, secrets are masked
+	DryRun bool
+	// Replica is index of replica templates are rendered for
+	Replica int
+	// Dir is where rendered files are written, not used by dry run
+	Dir string
+}
+
+func init() {
+	supervisor.RenderInstanceTemplates = renderInstanceTemplates
+}
+
+type RenderedTemplate struct {
+	Source  string `json:"source"`
+	Target  string `json:"target"`
+	Size    int    `json:"size"`
+	Content string `json:"content,omitempty"`
+}
+
+// RenderTemplates renders manifest templates of revision into opts.Dir, sources are
+// read from the revision folder
+func RenderTemplates(ctx context.Context, revision *Revision, opts RenderOptions) ([]RenderedTemplate, error) {
+	return renderTemplates(ctx, revision, revision.GetDir(), opts)
+}
+
+func renderTemplates(ctx context.Context, revision *Revision, dir string, opts RenderOptions) ([]RenderedTemplate, error) {
+	result := []RenderedTemplate{}
+
+	if len(revision.Manifest.Templates) == 0 {
+		return result, nil
+	}
+
+	data := &TemplateData{
+		App:        revision.App,
+		Version:    revision.Version,
+		RevisionId: revision.Uid.Hex(),
+		Replica:    opts.Replica,
+		Env:        firstNonEmpty(opts.Env, serverKit.SERVER_CONFIG.Environment),
+		Vars:       revision.Manifest.Env,
+		Node:       nodeInfo.Collect(),
+	}
+
+	packageFiles := map[string]bool{}
+	for _, file := range revision.Files {
+		packageFiles[file.Path] = true
+	}
+
+	for _, entry := range revision.Manifest.Templates {
+		// Package files must match their artifacts, delta revisions are built from them
+		if packageFiles[entry.Target] {
+			return nil, fmt.Errorf("%w: target %s is a file of the package", ErrInvalidTemplate, entry.Target)
+		}
+
+		allowedSecrets := templateSecrets(&revision.Manifest, entry)
+
+		content, err := renderTemplate(ctx, dir, entry.Source, data, allowedSecrets, opts.DryRun)
+		if err != nil {
+			return nil, err
+		}
+
+		rendered := RenderedTemplate{
+			Source: entry.Source,
+			Target: entry.Target,
+			Size:   len(content),
+		}
+
+		if opts.DryRun {
+			rendered.Content = string(content)
+		} else if err := writeRenderedFile(opts.Dir, entry.Target, content); err != nil {
+			return nil, err
+		}
+
+		result = append(result, rendered)
+	}
+
+	return result, nil
+}
+
+// renderInstanceTemplates links files of revision into instance folder of replica
+// or job run and renders templates for it next to them. Folder is named after the
+// revision, restarts of replica keep its links and only render templates again.
+func renderInstanceTemplates(ctx context.Context, instance *supervisor.TemplateInstance) error {
+	revisionUid, err := primitive.ObjectIDFromHex(instance.RevisionId)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(instance.InstanceDir); err != nil {
+		if err := prepareInstanceDir(instance.Dir, instance.InstanceDir); err != nil {
+			return fmt.Errorf("failed to prepare instance folder: %w", err)
+		}
+	}
+
+	revision := &Revision{
+		Uid:      revisionUid,
+		App:      instance.App,
+		Version:  instance.Manifest.Version,
+		Manifest: *instance.Manifest,
+	}
+
+	_, err = renderTemplates(ctx, revision, instance.Dir, RenderOptions{
+		Replica: instance.Replica,
+		Dir:     instance.InstanceDir,
+	})
+
+	return err
+}
+
+// prepareInstanceDir links revision files into partial folder renamed to dir when
+// complete, so existing instance folder always has every file of the revision
+func prepareInstanceDir(revisionDir, dir string) error {
+	partialDir := dir + ".partial"
+
+	if err := os.RemoveAll(partialDir); err != nil {
+		return err
+	}
+
+	if err := linkRevisionFiles(revisionDir, partialDir); err != nil {
+		os.RemoveAll(partialDir)
+		return err
+	}
+
+	if err := os.Rename(partialDir, dir); err != nil {
+		os.RemoveAll(partialDir)
+		return err
+	}
+
+	return nil
+}
+
+// linkRevisionFiles recreates folder tree of revision in dir, files are hardlinks of
+// the read-only revision files, so no content is copied. Rendered templates replace
+// no package file.
+func linkRevisionFiles(revisionDir, dir string) error {
+	return filepath.WalkDir(revisionDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(revisionDir, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return artifacts.CopyFile(path, target, info.Mode().Perm())
+		}
+	})
+}
+
+// templateSecrets returns secrets template may read, secrets of the manifest and
+// secrets listed by the template itself
+func templateSecrets(appManifest *manifest.Manifest, entry manifest.Template) map[string]bool {
+	allowed := map[string]bool{}
+
+	for _, ref := range appManifest.Secrets {
+		allowed[ref.Name] = true
+	}
+	for _, name := range entry.Secrets {
+		allowed[name] = true
+	}
+
+	return allowed
+}
+
+func renderTemplate(ctx context.Context, dir, source string, data *TemplateData, allowedSecrets map[string]bool, dryRun bool) ([]byte, error) {
+	sourcePath, err := safeArchivePath(dir, source)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(sourcePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: source %s is not a file of the package", ErrInvalidTemplate, source)
+	}
+	if info.Size() > MAX_TEMPLATE_SIZE {
+		return nil, fmt.Errorf("%w: source %s is larger than %d bytes", ErrInvalidTemplate, source, MAX_TEMPLATE_SIZE)
+	}
+
+	text, err := os.ReadFile(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl, err := template.New(source).
+		Funcs(templateFuncs(ctx, allowedSecrets, dryRun)).
+		Parse(string(text))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTemplate, strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	out := &limitedBuffer{limit: MAX_RENDERED_SIZE}
+
+	if err := tmpl.Execute(out, data); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidTemplate, strings.TrimPrefix(err.Error(), "template: "))
+	}
+
+	return out.Bytes(), nil
+}
+
+func templateFuncs(ctx context.Context, allowedSecrets map[string]bool, dryRun bool) template.FuncMap {
+	return template.FuncMap{
+		// {{ secret "db-password" }}, only secrets of the manifest or of the template entry
+		"secret": func(name string) (string, error) {
+			if !allowedSecrets[name] {
+				return "", fmt.Errorf("secret %q is not listed in secrets of the manifest or of the template", name)
+			}
+			secret, err := secrets.GetSecret(ctx, name)
+			if err != nil {
+				return "", err
+			}
+			if dryRun {
+				return fmt.Sprintf(DRY_RUN_SECRET_PLACEHOLDER, secret.Name), nil
+			}
+			value, err := secret.Reveal()
+			return string(value), err
+		},
+		// {{ default "8080" .Vars.PORT }}
+		"default": func(fallback string, value any) any {
+			if value == nil || value == "" {
+				return fallback
+			}
+			return value
+		},
+	}
+}
+
+// writeRenderedFile replaces target atomically, rendered files may contain secrets
+func writeRenderedFile(dir, target string, content []byte) error {
+	path, err := safeArchivePath(dir, target)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureNoSymlinkParents(dir, path); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	tmp := path + ".rendering"
+
+	if err := os.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (self *limitedBuffer) Write(data []byte) (int, error) {
+	if self.Len()+len(data) > self.limit {
+		return 0, fmt.Errorf("rendered output is larger than %d bytes", self.limit)
+	}
+	return self.Buffer.Write(data)
+}
@@ -0,0 +1,424 @@
+package deployListener
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"turtle/netes/manifest"
+)
+
+const (
+	PACKAGE_FORMAT_TARGZ = "tar.gz"
+	PACKAGE_FORMAT_ZIP   = "zip"
+)
+
+// DetectPackageFormat sniffs the archive type from its magic bytes
+func DetectPackageFormat(file *os.File) (string, error) {
+	header := make([]byte, 4)
+
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	header = header[:n]
+
+	if bytes.HasPrefix(header, []byte{0x1f, 0x8b}) {
+		return PACKAGE_FORMAT_TARGZ, nil
+	}
+
+	if bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06")) {
+		return PACKAGE_FORMAT_ZIP, nil
+	}
+
+	return "", fmt.Errorf("%w: unsupported archive format, expected tar.gz or zip", ErrInvalidPackage)
+}
+
+// UnpackPackage extracts archive into destDir, destDir must not exist yet
+func UnpackPackage(file *os.File, size int64, destDir string) error {
+	format, err := DetectPackageFormat(file)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+
+	switch format {
+	case PACKAGE_FORMAT_TARGZ:
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return unpackTarGz(file, destDir)
+	case PACKAGE_FORMAT_ZIP:
+		return unpackZip(file, size, destDir)
+	}
+
+	return fmt.Errorf("%w: unsupported archive format %s", ErrInvalidPackage, format)
+}
+
+// ReadPackageManifest reads and validates manifest straight from archive without unpacking it
+func ReadPackageManifest(file *os.File, size int64) (*manifest.Manifest, error) {
+	format, err := DetectPackageFormat(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var files map[string][]byte
+
+	switch format {
+	case PACKAGE_FORMAT_TARGZ:
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		files, err = readTarGzManifests(file)
+	case PACKAGE_FORMAT_ZIP:
+		files, err = readZipManifests(file, size)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range manifest.MANIFEST_FILE_NAMES {
+		data, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		result, err := manifest.Parse(name, data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPackage, err)
+		}
+
+		result.ApplyDefaults()
+
+		if err := result.Validate(); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidPackage, name, err)
+		}
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("%w: %w", ErrInvalidPackage, manifest.ErrManifestNotFound)
+}
+
+const MAX_MANIFEST_SIZE = 1 << 20
+
+func isManifestEntry(name string) bool {
+	name = strings.TrimPrefix(name, "./")
+	for _, manifestName := range manifest.MANIFEST_FILE_NAMES {
+		if name == manifestName {
+			return true
+		}
+	}
+	return false
+}
+
+func readTarGzManifests(reader io.Reader) (map[string][]byte, error) {
+	result := map[string][]byte{}
+
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+		}
+
+		if header.Typeflag != tar.TypeReg || !isManifestEntry(header.Name) {
+			continue
+		}
+
+		data, err := io.ReadAll(io.LimitReader(tr, MAX_MANIFEST_SIZE))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+		}
+
+		result[strings.TrimPrefix(header.Name, "./")] = data
+	}
+}
+
+func readZipManifests(file *os.File, size int64) (map[string][]byte, error) {
+	result := map[string][]byte{}
+
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+
+	for _, entry := range zr.File {
+		if !entry.Mode().IsRegular() || !isManifestEntry(entry.Name) {
+			continue
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+		}
+
+		data, err := io.ReadAll(io.LimitReader(rc, MAX_MANIFEST_SIZE))
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+		}
+
+		result[strings.TrimPrefix(entry.Name, "./")] = data
+	}
+
+	return result, nil
+}
+
+func unpackTarGz(reader io.Reader, destDir string) error {
+	gz, err := gzip.NewReader(reader)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+		}
+
+		target, err := safeArchivePath(destDir, header.Name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := mkdirInRoot(destDir, target); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := writeFileInRoot(destDir, target, tr, header.FileInfo().Mode()); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := symlinkInRoot(destDir, target, header.Linkname); err != nil {
+				return err
+			}
+		case tar.TypeXGlobalHeader:
+			// pax metadata only, nothing to extract
+		default:
+			return fmt.Errorf("%w: entry %s has unsupported type %c", ErrInvalidPackage, header.Name, header.Typeflag)
+		}
+	}
+}
+
+func unpackZip(file *os.File, size int64, destDir string) error {
+	zr, err := zip.NewReader(file, size)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+
+	for _, entry := range zr.File {
+		target, err := safeArchivePath(destDir, entry.Name)
+		if err != nil {
+			return err
+		}
+
+		mode := entry.Mode()
+
+		switch {
+		case mode.IsDir():
+			if err := mkdirInRoot(destDir, target); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			linkname, err := readZipEntry(entry)
+			if err != nil {
+				return err
+			}
+			if err := symlinkInRoot(destDir, target, linkname); err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			rc, err := entry.Open()
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+			}
+			err = writeFileInRoot(destDir, target, rc, mode)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%w: entry %s has unsupported type", ErrInvalidPackage, entry.Name)
+		}
+	}
+
+	return nil
+}
+
+func readZipEntry(entry *zip.File) (string, error) {
+	rc, err := entry.Open()
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+	defer rc.Close()
+
+	data, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+
+	return string(data), nil
+}
+
+// safeArchivePath resolves archive entry name inside root and rejects traversal
+func safeArchivePath(root, name string) (string, error) {
+	if name == "" || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("%w: invalid entry name %q", ErrInvalidPackage, name)
+	}
+
+	normalized := strings.ReplaceAll(name, "\\", "/")
+
+	if strings.HasPrefix(normalized, "/") || filepath.IsAbs(normalized) || filepath.VolumeName(normalized) != "" {
+		return "", fmt.Errorf("%w: absolute path %q is not allowed", ErrInvalidPackage, name)
+	}
+
+	for _, part := range strings.Split(normalized, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%w: path traversal in %q", ErrInvalidPackage, name)
+		}
+	}
+
+	target := filepath.Join(root, filepath.FromSlash(normalized))
+
+	if !isInsideRoot(root, target) {
+		return "", fmt.Errorf("%w: path %q escapes package root", ErrInvalidPackage, name)
+	}
+
+	return target, nil
+}
+
+func isInsideRoot(root, target string) bool {
+	rel, err := filepath.Rel(root, target)
+	if err != nil {
+		return false
+	}
+	return rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)))
+}
+
+// ensureNoSymlinkParents rejects writes through symlinks created by earlier entries
+func ensureNoSymlinkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidPackage, err.Error())
+	}
+
+	if rel == "." {
+		return nil
+	}
+
+	current := root
+
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%w: entry %s is written through a symlink", ErrInvalidPackage, target)
+		}
+	}
+
+	return nil
+}
+
+func mkdirInRoot(root, target string) error {
+	if err := ensureNoSymlinkParents(root, target); err != nil {
+		return err
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+func writeFileInRoot(root, target string, reader io.Reader, mode os.FileMode) error {
+	if err := ensureNoSymlinkParents(root, target); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	// Only keep permission bits, never setuid/setgid from archive
+	perm := mode.Perm() | 0600
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_EXCL, perm)
+	if err != nil {
+		return fmt.Errorf("%w: cannot create %s: %s", ErrInvalidPackage, target, err.Error())
+	}
+
+	_, err = io.Copy(out, reader)
+	closeErr := out.Close()
+
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func symlinkInRoot(root, target, linkname string) error {
+	if err := ensureNoSymlinkParents(root, target); err != nil {
+		return err
+	}
+
+	if linkname == "" || filepath.IsAbs(linkname) || strings.HasPrefix(linkname, "/") {
+		return fmt.Errorf("%w: symlink %s must be relative", ErrInvalidPackage, target)
+	}
+
+	// ".." is only allowed as leading components, otherwise a chain of links
+	// like "a -> ." and "b -> a/.." would resolve outside of root
+	leading := true
+	for _, part := range strings.Split(filepath.ToSlash(linkname), "/") {
+		if part == ".." {
+			if !leading {
+				return fmt.Errorf("%w: symlink %s has non-leading '..'", ErrInvalidPackage, target)
+			}
+			continue
+		}
+		leading = false
+	}
+
+	resolved := filepath.Join(filepath.Dir(target), filepath.FromSlash(linkname))
+
+	if !isInsideRoot(root, resolved) {
+		return fmt.Errorf("%w: symlink %s escapes package root", ErrInvalidPackage, target)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, target)
+}
@@ -0,0 +1,138 @@
+package deployListener
+
+import (
+	"errors"
+	"net/http"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+POST /deplistener/uploads
+Body:
+
+	{
+	  "app": "my-app",
+	  "sha256": "checksum of whole package",
+	  "signature": "optional ed25519 signature",
+	  "keyId": "optional",
+	  "totalSize": 734003200,
+	  "chunkSize": 8388608
+	}
+*/
+func _StartUpload(c *gin.Context) {
+	var req StartUploadRequest
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	session, err := StartUpload(c.Request.Context(), &req, user)
+	if err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, session)
+}
+
+/*
+PUT /deplistener/uploads/chunk?uid=&index=
+Raw chunk body with X-Chunk-Sha256 header
+*/
+func _PutChunk(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	index, err := parseChunkIndex(c.Query("index"))
+	if err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	err = PutChunk(c.Request.Context(), c.Query("uid"), user, index, c.GetHeader("X-Chunk-Sha256"), c.Request.Body)
+	if err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, gin.H{"status": "ok", "index": index})
+}
+
+/*
+GET /deplistener/uploads/get?uid=
+Session with received and missing chunk indexes
+*/
+func _GetUpload(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	status, err := GetUploadStatus(c.Request.Context(), c.Query("uid"), user)
+	if err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, status)
+}
+
+/*
+POST /deplistener/uploads/finalize?uid=
+Joins chunks and deploys package, response is the same as of /deplistener/receive
+*/
+func _FinalizeUpload(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	received, err := FinalizeUpload(c.Request.Context(), c.Query("uid"), user)
+	if err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, received)
+}
+
+/*
+DELETE /deplistener/uploads?uid=
+*/
+func _AbortUpload(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	if err := AbortUpload(c.Request.Context(), c.Query("uid"), user); err != nil {
+		returnUploadError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, gin.H{"status": "ok"})
+}
+
+func returnUploadError(c *gin.Context, err error) {
+	if errors.Is(err, ErrUploadSessionNotFound) || errors.Is(err, ErrUploadFinalizing) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else {
+		returnPackageError(c, err)
+	}
+}
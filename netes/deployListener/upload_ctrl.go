@@ -0,0 +1,471 @@
+package deployListener
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const UPLOAD_SESSIONS_COLLECTION = "upload_sessions"
+
+const (
+	DEFAULT_CHUNK_SIZE = 8 << 20
+	MAX_CHUNK_SIZE     = 64 << 20
+	// Status and finalize look at every chunk, larger packages need larger chunks
+	MAX_CHUNK_COUNT = 10000
+)
+
+// Sessions without any chunk for this long are removed
+var UPLOAD_SESSION_TTL = 24 * time.Hour
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadFinalizing      = errors.New("upload session is already being finalized")
+)
+
+var (
+	finalizingMu sync.Mutex
+	finalizing   = map[string]bool{}
+)
+
+// UploadSession is resumable upload of one package split into numbered chunks.
+// Verified chunks live on disk so session survives listener restart.
+type UploadSession struct {
+	Uid        primitive.ObjectID `json:"uid" bson:"_id"`
+	App        string             `json:"app" bson:"app"`
+	Node       string             `json:"node" bson:"node"`
+	Sha256     string             `json:"sha256" bson:"sha256"`
+	Signature  string             `json:"signature" bson:"signature"`
+	KeyId      string             `json:"keyId" bson:"keyId"`
+	TotalSize  int64              `json:"totalSize" bson:"totalSize"`
+	ChunkSize  int64              `json:"chunkSize" bson:"chunkSize"`
+	ChunkCount int                `json:"chunkCount" bson:"chunkCount"`
+	CreatedBy  string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+type UploadSessionStatus struct {
+	UploadSession
+	Received []int `json:"received"`
+	Missing  []int `json:"missing"`
+}
+
+type StartUploadRequest struct {
+	App       string `json:"app"`
+	Sha256    string `json:"sha256"`
+	Signature string `json:"signature"`
+	KeyId     string `json:"keyId"`
+	TotalSize int64  `json:"totalSize"`
+	ChunkSize int64  `json:"chunkSize"`
+}
+
+func uploadSessionsRepo() *dbclient.Repository[UploadSession] {
+	return dbclient.NewRepository[UploadSession](dbclient.MongoClient, UPLOAD_SESSIONS_COLLECTION)
+}
+
+func getUploadsDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".uploads")
+}
+
+func (self *UploadSession) GetDir() string {
+	return filepath.Join(getUploadsDir(), self.Uid.Hex())
+}
+
+func (self *UploadSession) chunkPath(index int) string {
+	return filepath.Join(self.GetDir(), fmt.Sprintf("%06d.chunk", index))
+}
+
+// ExpectedChunkSize is ChunkSize for all chunks except possibly shorter last one
+func (self *UploadSession) ExpectedChunkSize(index int) int64 {
+	if index == self.ChunkCount-1 {
+		return self.TotalSize - int64(index)*self.ChunkSize
+	}
+	return self.ChunkSize
+}
+
+func StartUpload(ctx context.Context, req *StartUploadRequest, user string) (*UploadSession, error) {
+	if req.App != "" {
+		if err := ValidateAppName(req.App); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(req.Sha256) != sha256.Size*2 {
+		return nil, fmt.Errorf("%w: sha256 checksum is required (64 hex chars)", ErrInvalidPackage)
+	}
+
+	if req.TotalSize <= 0 {
+		return nil, fmt.Errorf("%w: totalSize must be positive", ErrInvalidPackage)
+	}
+
+	if req.ChunkSize == 0 {
+		req.ChunkSize = DEFAULT_CHUNK_SIZE
+	}
+
+	if req.ChunkSize < 0 || req.ChunkSize > MAX_CHUNK_SIZE {
+		return nil, fmt.Errorf("%w: chunkSize must be between 1 and %d", ErrInvalidPackage, MAX_CHUNK_SIZE)
+	}
+
+	if maxSize := serverKit.SERVER_CONFIG.GetMaxUploadBytes(); req.TotalSize > maxSize {
+		return nil, fmt.Errorf("%w: totalSize must be at most %d bytes", ErrInvalidPackage, maxSize)
+	}
+
+	chunkCount := (req.TotalSize + req.ChunkSize - 1) / req.ChunkSize
+	if chunkCount > MAX_CHUNK_COUNT {
+		return nil, fmt.Errorf("%w: package needs %d chunks, at most %d are allowed, use larger chunkSize", ErrInvalidPackage, chunkCount, MAX_CHUNK_COUNT)
+	}
+
+	now := time.Now()
+
+	session := &UploadSession{
+		Uid:        primitive.NewObjectID(),
+		App:        req.App,
+		Node:       serverKit.SERVER_CONFIG.GetNodeName(),
+		Sha256:     strings.ToLower(req.Sha256),
+		Signature:  req.Signature,
+		KeyId:      req.KeyId,
+		TotalSize:  req.TotalSize,
+		ChunkSize:  req.ChunkSize,
+		ChunkCount: int(chunkCount),
+		CreatedBy:  user,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+
+	// Session is stored first, cleanup removes upload folders without session
+	if _, err := uploadSessionsRepo().InsertOne(ctx, session); err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(session.GetDir(), 0755); err != nil {
+		if _, deleteErr := uploadSessionsRepo().DeleteByID(ctx, session.Uid); deleteErr != nil {
+			lgr.Error("Failed to remove upload session %s: %s", session.Uid.Hex(), deleteErr.Error())
+		}
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetUploadSession returns session of this node started by user, session of another
+// user is reported as not found
+func GetUploadSession(ctx context.Context, uid, user string) (*UploadSession, error) {
+	objectId, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrUploadSessionNotFound, uid)
+	}
+
+	session, err := uploadSessionsRepo().FindOne(ctx, bson.M{
+		"_id":       objectId,
+		"node":      serverKit.SERVER_CONFIG.GetNodeName(),
+		"createdBy": user,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if session == nil {
+		return nil, fmt.Errorf("%w: %s", ErrUploadSessionNotFound, uid)
+	}
+
+	return session, nil
+}
+
+// GetUploadStatus lists received and missing chunks, chunk is received when its verified file exists
+func GetUploadStatus(ctx context.Context, uid, user string) (*UploadSessionStatus, error) {
+	session, err := GetUploadSession(ctx, uid, user)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &UploadSessionStatus{
+		UploadSession: *session,
+		Received:      []int{},
+		Missing:       []int{},
+	}
+
+	for i := 0; i < session.ChunkCount; i++ {
+		if session.hasChunk(i) {
+			status.Received = append(status.Received, i)
+		} else {
+			status.Missing = append(status.Missing, i)
+		}
+	}
+
+	return status, nil
+}
+
+func (self *UploadSession) hasChunk(index int) bool {
+	info, err := os.Stat(self.chunkPath(index))
+	return err == nil && info.Size() == self.ExpectedChunkSize(index)
+}
+
+// PutChunk stores chunk after verifying its size and checksum, re-sending a chunk overwrites it
+func PutChunk(ctx context.Context, uid, user string, index int, chunkSha256 string, body io.Reader) error {
+	session, err := GetUploadSession(ctx, uid, user)
+	if err != nil {
+		return err
+	}
+
+	if index < 0 || index >= session.ChunkCount {
+		return fmt.Errorf("%w: chunk index must be between 0 and %d", ErrInvalidPackage, session.ChunkCount-1)
+	}
+
+	expectedSize := session.ExpectedChunkSize(index)
+
+	tmpFile, err := os.CreateTemp(session.GetDir(), "chunk-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+	}()
+
+	hasher := sha256.New()
+
+	// Read one byte more to detect oversized chunk
+	size, err := io.Copy(io.MultiWriter(tmpFile, hasher), io.LimitReader(body, expectedSize+1))
+	if err != nil {
+		return fmt.Errorf("failed to receive chunk: %w", err)
+	}
+
+	if size != expectedSize {
+		return fmt.Errorf("%w: chunk %d must have %d bytes, got %d", ErrInvalidPackage, index, expectedSize, size)
+	}
+
+	actualSum := hex.EncodeToString(hasher.Sum(nil))
+
+	if !strings.EqualFold(actualSum, strings.TrimSpace(chunkSha256)) {
+		return fmt.Errorf("%w: chunk %d sha256 mismatch, expected %s got %s", ErrInvalidPackage, index, chunkSha256, actualSum)
+	}
+
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpFile.Name(), session.chunkPath(index)); err != nil {
+		return err
+	}
+
+	_, err = uploadSessionsRepo().UpdateByID(ctx, session.Uid, bson.M{"$set": bson.M{"updatedAt": time.Now()}})
+
+	return err
+}
+
+// startFinalize marks session as being finalized, returns false when it already is
+func startFinalize(uid string) bool {
+	finalizingMu.Lock()
+	defer finalizingMu.Unlock()
+
+	if finalizing[uid] {
+		return false
+	}
+	finalizing[uid] = true
+	return true
+}
+
+func finishFinalize(uid string) {
+	finalizingMu.Lock()
+	delete(finalizing, uid)
+	finalizingMu.Unlock()
+}
+
+// FinalizeUpload joins chunks and deploys them as if package was uploaded at once.
+// Revision gets uid of the session, so retry after a failure creates it only once.
+func FinalizeUpload(ctx context.Context, uid, user string) (*ReceivedPackage, error) {
+	if !startFinalize(uid) {
+		return nil, fmt.Errorf("%w: %s", ErrUploadFinalizing, uid)
+	}
+	defer finishFinalize(uid)
+
+	status, err := GetUploadStatus(ctx, uid, user)
+	if err != nil {
+		return nil, err
+	}
+
+	received, err := finalizeCreatedRevision(ctx, &status.UploadSession, user)
+	if err != nil {
+		return nil, err
+	}
+	if received != nil {
+		if abortErr := removeUploadSession(ctx, &status.UploadSession); abortErr != nil {
+			lgr.Error("Failed to remove upload session %s: %s", uid, abortErr.Error())
+		}
+		return received, nil
+	}
+
+	if len(status.Missing) > 0 {
+		return nil, fmt.Errorf("%w: %d chunks are missing: %v", ErrInvalidPackage, len(status.Missing), status.Missing)
+	}
+
+	session := &status.UploadSession
+
+	readers := make([]io.Reader, 0, session.ChunkCount)
+
+	for i := 0; i < session.ChunkCount; i++ {
+		file, err := os.Open(session.chunkPath(i))
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	received, err = DeployPackage(ctx, &PackageRequest{
+		App:        session.App,
+		Sha256:     session.Sha256,
+		Signature:  session.Signature,
+		KeyId:      session.KeyId,
+		Body:       io.MultiReader(readers...),
+		RevisionId: session.Uid.Hex(),
+	}, user)
+
+	// Keep session on server errors so finalize can be retried, invalid
+	// package can't be fixed by re-sending chunks so it is removed then too
+	if err != nil && !errors.Is(err, ErrInvalidPackage) {
+		return nil, err
+	}
+
+	if abortErr := removeUploadSession(ctx, session); abortErr != nil {
+		lgr.Error("Failed to remove upload session %s: %s", uid, abortErr.Error())
+	}
+
+	return received, err
+}
+
+// finalizeCreatedRevision activates revision created by earlier finalize of session,
+// it returns nil when finalize did not get that far. Revision replaced by another
+// deploy in the meantime is not activated again.
+func finalizeCreatedRevision(ctx context.Context, session *UploadSession, user string) (*ReceivedPackage, error) {
+	revision, err := GetRevision(ctx, session.Uid.Hex())
+	if errors.Is(err, ErrRevisionNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	received := &ReceivedPackage{
+		App:            revision.App,
+		RevisionId:     revision.Uid.Hex(),
+		Sha256:         revision.Sha256,
+		Size:           revision.Size,
+		Folder:         revision.GetDir(),
+		Manifest:       &revision.Manifest,
+		BaseRevisionId: revision.BaseRevisionId,
+		Processes:      []supervisor.ProcessStatus{},
+	}
+
+	deployment, err := GetAppDeployment(ctx, revision.App)
+	if err != nil {
+		return nil, err
+	}
+	if deployment != nil && deployment.ActiveRevisionId != revision.Uid && deployment.UpdatedAt.After(revision.CreatedAt) {
+		lgr.Info("Revision %s of upload was replaced by revision %s, it is not activated", revision.Uid.Hex(), deployment.ActiveRevisionId.Hex())
+		return received, nil
+	}
+
+	received.Processes, err = ActivateRevision(ctx, revision, 0, user)
+	if err != nil {
+		return nil, err
+	}
+
+	return received, nil
+}
+
+func AbortUpload(ctx context.Context, uid, user string) error {
+	session, err := GetUploadSession(ctx, uid, user)
+	if err != nil {
+		return err
+	}
+
+	return removeUploadSession(ctx, session)
+}
+
+// removeUploadSession deletes received chunks and the session
+func removeUploadSession(ctx context.Context, session *UploadSession) error {
+	if err := os.RemoveAll(session.GetDir()); err != nil {
+		return err
+	}
+
+	_, err := uploadSessionsRepo().DeleteByID(ctx, session.Uid)
+	return err
+}
+
+// CleanupAbandonedUploads removes sessions idle for UPLOAD_SESSION_TTL and
+// upload folders without session
+func CleanupAbandonedUploads(ctx context.Context) (int, error) {
+	node := serverKit.SERVER_CONFIG.GetNodeName()
+
+	abandoned, err := uploadSessionsRepo().FindMany(ctx, bson.M{
+		"node":      node,
+		"updatedAt": bson.M{"$lt": time.Now().Add(-UPLOAD_SESSION_TTL)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, session := range abandoned {
+		if err := removeUploadSession(ctx, &session); err != nil {
+			lgr.Error("Failed to remove abandoned upload %s: %s", session.Uid.Hex(), err.Error())
+			continue
+		}
+		removed++
+	}
+
+	entries, err := os.ReadDir(getUploadsDir())
+	if err != nil {
+		return removed, nil
+	}
+
+	known, err := uploadSessionsRepo().Distinct(ctx, "_id", bson.M{"node": node})
+	if err != nil {
+		return removed, err
+	}
+
+	knownDirs := map[string]bool{}
+	for _, value := range known {
+		if uid, ok := value.(primitive.ObjectID); ok {
+			knownDirs[uid.Hex()] = true
+		}
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() && !knownDirs[entry.Name()] {
+			os.RemoveAll(filepath.Join(getUploadsDir(), entry.Name()))
+			removed++
+		}
+	}
+
+	if removed > 0 {
+		lgr.Info("Removed %d abandoned upload sessions", removed)
+	}
+
+	return removed, nil
+}
+
+func parseChunkIndex(value string) (int, error) {
+	index, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid chunk index %q", ErrInvalidPackage, value)
+	}
+	return index, nil
+}
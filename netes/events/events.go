@@ -0,0 +1,292 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const EVENTS_COLLECTION = "events"
+
+const (
+	EVENT_PACKAGE_RECEIVED   = "PackageReceived"
+	EVENT_REVISION_CREATED   = "RevisionCreated"
+	EVENT_REVISION_ACTIVATED = "RevisionActivated"
+	EVENT_REVISION_REMOVED   = "RevisionRemoved"
+	EVENT_ROLLBACK           = "Rollback"
+	EVENT_SCALED             = "Scaled"
+	EVENT_CONFIG_CHANGED     = "ConfigChanged"
+	EVENT_RECONCILED         = "Reconciled"
+	EVENT_PROCESS_STARTED    = "ProcessStarted"
+	EVENT_PROCESS_EXITED     = "ProcessExited"
+	EVENT_PROCESS_FAILED     = "ProcessFailed"
+	EVENT_PROBE_FAILED       = "ProbeFailed"
+	EVENT_UPDATE_STARTED     = "UpdateStarted"
+	EVENT_UPDATE_PAUSED      = "UpdatePaused"
+	EVENT_UPDATE_FINISHED    = "UpdateFinished"
+	EVENT_CANARY_WEIGHT      = "CanaryWeight"
+	EVENT_COLOR_SWITCHED     = "ColorSwitched"
+)
+
+const (
+	LEVEL_NORMAL  = "normal"
+	LEVEL_WARNING = "warning"
+)
+
+const (
+	DEFAULT_EVENTS_LIMIT = 100
+	MAX_EVENTS_LIMIT     = 1000
+)
+
+var (
+	// Events waiting to be stored, when it is full new events are dropped
+	EVENTS_QUEUE_SIZE = 4096
+	// Events stored by one insert
+	EVENTS_BATCH_SIZE = 100
+)
+
+var ErrInvalidEventQuery = errors.New("invalid event query")
+
+// Event is a state change of app on node, uid is resource version of watch
+type Event struct {
+	Uid        primitive.ObjectID `json:"uid" bson:"_id"`
+	Type       string             `json:"type" bson:"type"`
+	Level      string             `json:"level" bson:"level"`
+	App        string             `json:"app" bson:"app"`
+	Node       string             `json:"node" bson:"node"`
+	RevisionId string             `json:"revisionId,omitempty" bson:"revisionId,omitempty"`
+	Replica    *int               `json:"replica,omitempty" bson:"replica,omitempty"`
+	Message    string             `json:"message" bson:"message"`
+	User       string             `json:"user,omitempty" bson:"user,omitempty"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+}
+
+// EventQuery selects events, After is resource version, only newer events match
+type EventQuery struct {
+	App   string
+	Node  string
+	Type  string
+	Since time.Time
+	Until time.Time
+	After primitive.ObjectID
+	Limit int64
+}
+
+var queue = make(chan Event, EVENTS_QUEUE_SIZE)
+
+func eventsRepo() *dbclient.Repository[Event] {
+	return dbclient.NewRepository[Event](dbclient.MongoClient, EVENTS_COLLECTION)
+}
+
+// Emit queues event for storing, it never blocks caller
+func Emit(event Event) {
+	// Events are not kept without MongoDB
+	if !dbclient.IsConnected() {
+		return
+	}
+
+	event.Uid = primitive.NewObjectID()
+	event.CreatedAt = time.Now()
+	if event.Node == "" {
+		event.Node = serverKit.SERVER_CONFIG.GetNodeName()
+	}
+	if event.Level == "" {
+		event.Level = LEVEL_NORMAL
+	}
+
+	select {
+	case queue <- event:
+	default:
+		lgr.Error("Event queue is full, dropped %s event of %s", event.Type, event.App)
+	}
+}
+
+// Emitf queues normal event of app
+func Emitf(eventType, app, revisionId, format string, args ...any) {
+	Emit(Event{
+		Type:       eventType,
+		App:        app,
+		RevisionId: revisionId,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// Warnf queues warning event of app
+func Warnf(eventType, app, revisionId, format string, args ...any) {
+	Emit(Event{
+		Type:       eventType,
+		Level:      LEVEL_WARNING,
+		App:        app,
+		RevisionId: revisionId,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// Start creates indexes of events and stores queued events in background
+func Start() {
+	if !dbclient.IsConnected() {
+		lgr.Error("Deployment events are disabled: %s", dbclient.ErrNotConnected.Error())
+		return
+	}
+
+	if err := ensureIndexes(context.Background()); err != nil {
+		lgr.Error("Failed to create event indexes: %s", err.Error())
+	}
+
+	go func() {
+		for event := range queue {
+			batch := []Event{event}
+
+		drain:
+			for len(batch) < EVENTS_BATCH_SIZE {
+				select {
+				case next := <-queue:
+					batch = append(batch, next)
+				default:
+					break drain
+				}
+			}
+
+			tools.SafeGoRoutine(func() {
+				if _, err := eventsRepo().InsertMany(context.Background(), batch); err != nil {
+					lgr.Error("Failed to store %d events: %s", len(batch), err.Error())
+				}
+			})
+		}
+	}()
+}
+
+// ensureIndexes creates TTL index removing old events and indexes of queries
+func ensureIndexes(ctx context.Context) error {
+	ttl := int32(serverKit.SERVER_CONFIG.GetEventsTtl().Seconds())
+
+	collection, err := eventsRepo().Collection()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "createdAt", Value: 1}},
+			Options: options.Index().SetName("ttl").SetExpireAfterSeconds(ttl),
+		},
+		{
+			Keys: bson.D{{Key: "app", Value: 1}, {Key: "_id", Value: -1}},
+		},
+		{
+			Keys: bson.D{{Key: "node", Value: 1}, {Key: "_id", Value: -1}},
+		},
+	})
+	if err == nil {
+		return nil
+	}
+
+	// TTL changed in config, index is created again with the new one
+	var commandErr mongo.CommandError
+	if errors.As(err, &commandErr) && commandErr.Name == "IndexOptionsConflict" {
+		if _, dropErr := collection.Indexes().DropOne(ctx, "ttl"); dropErr != nil {
+			return dropErr
+		}
+		return ensureIndexes(ctx)
+	}
+
+	return err
+}
+
+// ParseEventQuery reads query parameters, since and until are RFC3339 times or
+// durations back from now like 1h, resourceVersion is uid of the last seen event
+func ParseEventQuery(app, node, eventType, since, until, limit, resourceVersion string) (EventQuery, error) {
+	query := EventQuery{
+		App:   app,
+		Node:  node,
+		Type:  eventType,
+		Limit: DEFAULT_EVENTS_LIMIT,
+	}
+
+	var err error
+
+	if query.Since, err = parseEventTime(since); err != nil {
+		return query, fmt.Errorf("%w: since: %s", ErrInvalidEventQuery, err.Error())
+	}
+	if query.Until, err = parseEventTime(until); err != nil {
+		return query, fmt.Errorf("%w: until: %s", ErrInvalidEventQuery, err.Error())
+	}
+
+	if limit != "" {
+		if query.Limit, err = strconv.ParseInt(limit, 10, 64); err != nil || query.Limit < 1 {
+			return query, fmt.Errorf("%w: limit must be positive number", ErrInvalidEventQuery)
+		}
+		query.Limit = min(query.Limit, MAX_EVENTS_LIMIT)
+	}
+
+	if resourceVersion != "" {
+		if query.After, err = primitive.ObjectIDFromHex(resourceVersion); err != nil {
+			return query, fmt.Errorf("%w: resourceVersion must be uid of an event", ErrInvalidEventQuery)
+		}
+	}
+
+	return query, nil
+}
+
+func parseEventTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
+
+func (self *EventQuery) filter() bson.M {
+	filter := bson.M{}
+
+	if self.App != "" {
+		filter["app"] = self.App
+	}
+	if self.Node != "" {
+		filter["node"] = self.Node
+	}
+	if self.Type != "" {
+		filter["type"] = self.Type
+	}
+
+	createdAt := bson.M{}
+	if !self.Since.IsZero() {
+		createdAt["$gte"] = self.Since
+	}
+	if !self.Until.IsZero() {
+		createdAt["$lte"] = self.Until
+	}
+	if len(createdAt) > 0 {
+		filter["createdAt"] = createdAt
+	}
+
+	if !self.After.IsZero() {
+		filter["_id"] = bson.M{"$gt": self.After}
+	}
+
+	return filter
+}
+
+// ListEvents returns matching events, newest first
+func ListEvents(ctx context.Context, query EventQuery) ([]Event, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: -1}}).
+		SetLimit(query.Limit)
+
+	return eventsRepo().FindMany(ctx, query.filter(), opts)
+}
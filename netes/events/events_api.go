@@ -0,0 +1,113 @@
+package events
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+	"turtle/core/auth"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Comment sent to watchers so dead connections are detected
+const EVENTS_WATCH_KEEPALIVE = 15 * time.Second
+
+/*
+GET /deplistener/events?app=&node=&type=&since=&until=&limit=100
+since/until are RFC3339 or duration back from now ("15m"), newest events first
+*/
+func _ListEvents(c *gin.Context) {
+	query, err := ParseEventQuery(c.Query("app"), c.Query("node"), c.Query("type"), c.Query("since"), c.Query("until"), c.Query("limit"), "")
+	if err != nil {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	}
+
+	events, err := ListEvents(c.Request.Context(), query)
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+	if events == nil {
+		events = []Event{}
+	}
+
+	serverKit.ReturnOkJson(c, events)
+}
+
+/*
+GET /deplistener/events/watch?app=&node=&type=&resourceVersion=
+Response is text/event-stream of "event" events, id of every one is its uid.
+Events after resourceVersion (or Last-Event-ID header on reconnect) are sent first,
+without it only new events are sent.
+*/
+func _WatchEvents(c *gin.Context) {
+	resourceVersion := c.Query("resourceVersion")
+	if resourceVersion == "" {
+		resourceVersion = c.GetHeader("Last-Event-ID")
+	}
+
+	query, err := ParseEventQuery(c.Query("app"), c.Query("node"), c.Query("type"), "", "", "", resourceVersion)
+	if err != nil {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	eventsCh := make(chan Event, 64)
+
+	go tools.SafeGoRoutine(func() {
+		defer close(eventsCh)
+
+		err := Watch(ctx, query, func(event Event) error {
+			select {
+			case eventsCh <- event:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			lgr.Error("Watch of events failed: %s", err.Error())
+		}
+	})
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+
+	keepalive := time.NewTicker(EVENTS_WATCH_KEEPALIVE)
+	defer keepalive.Stop()
+
+	// Server WriteTimeout would cut long watches, deadline is moved with every write
+	controller := http.NewResponseController(c.Writer)
+
+	c.Stream(func(w io.Writer) bool {
+		controller.SetWriteDeadline(time.Now().Add(2 * EVENTS_WATCH_KEEPALIVE))
+
+		select {
+		case <-ctx.Done():
+			return false
+		case <-keepalive.C:
+			io.WriteString(w, ": keepalive\n\n")
+			return true
+		case event, ok := <-eventsCh:
+			if !ok {
+				return false
+			}
+			io.WriteString(w, "id: "+event.Uid.Hex()+"\n")
+			c.SSEvent("event", event)
+			return true
+		}
+	})
+}
+
+func InitEventsApi(r *gin.Engine) {
+	r.GET("/deplistener/events", auth.ApiKeysRequired, _ListEvents)
+	r.GET("/deplistener/events/watch", auth.ApiKeysRequired, _WatchEvents)
+}
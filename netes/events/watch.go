@@ -0,0 +1,169 @@
+package events
+
+import (
+	"context"
+	"time"
+	"turtle/core/lgr"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	// How often watch reads new events when Mongo has no change streams
+	EVENTS_POLL_INTERVAL = 1 * time.Second
+	// Polling reads this far back, events are stored in batches and nodes clocks differ
+	EVENTS_POLL_LAG = 5 * time.Second
+)
+
+// Watch sends events matching query as they are stored until ctx is done or send fails.
+// Events after query.After are sent first, without it only new events are sent.
+// Mongo change stream is used when it is available, standalone Mongo is polled.
+func Watch(ctx context.Context, query EventQuery, send func(Event) error) error {
+	if query.After.IsZero() {
+		query.After = primitive.NewObjectIDFromTimestamp(time.Now())
+	}
+
+	collection, err := eventsRepo().Collection()
+	if err != nil {
+		return err
+	}
+
+	stream, err := collection.Watch(ctx, query.pipeline())
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		lgr.Info("Event change stream is not available, polling events: %s", err.Error())
+		return poll(ctx, query, send)
+	}
+	defer stream.Close(context.Background())
+
+	// Events stored before the stream was opened
+	sent := map[primitive.ObjectID]bool{}
+	newest, err := sendAfter(ctx, query, query.After, send, func(event Event) {
+		sent[event.Uid] = true
+	})
+	if err != nil {
+		return err
+	}
+
+	for stream.Next(ctx) {
+		var change struct {
+			FullDocument Event `bson:"fullDocument"`
+		}
+		if err := stream.Decode(&change); err != nil {
+			return err
+		}
+
+		event := change.FullDocument
+		if sent[event.Uid] {
+			continue
+		}
+		if err := send(event); err != nil {
+			return err
+		}
+		if event.Uid.Timestamp().After(newest.Timestamp()) {
+			newest = event.Uid
+		}
+	}
+
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	lgr.Error("Event change stream failed, polling events: %s", stream.Err())
+
+	query.After = newest
+	return poll(ctx, query, send)
+}
+
+// poll reads events newer than the last sent one, recent ones are read again and
+// sent when they were not seen yet
+func poll(ctx context.Context, query EventQuery, send func(Event) error) error {
+	ticker := time.NewTicker(EVENTS_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	newest := query.After
+	seen := map[primitive.ObjectID]bool{}
+
+	for {
+		lower := primitive.NewObjectIDFromTimestamp(time.Now().Add(-EVENTS_POLL_LAG))
+		if newest.Timestamp().Before(lower.Timestamp()) {
+			lower = newest
+		}
+
+		for uid := range seen {
+			if uid.Timestamp().Before(lower.Timestamp()) {
+				delete(seen, uid)
+			}
+		}
+
+		last, err := sendAfter(ctx, query, lower, func(event Event) error {
+			if seen[event.Uid] {
+				return nil
+			}
+			seen[event.Uid] = true
+			return send(event)
+		}, nil)
+		if err != nil {
+			return err
+		}
+		if last.Timestamp().After(newest.Timestamp()) {
+			newest = last
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// sendAfter sends stored events newer than after, oldest first, returns uid of the newest one
+func sendAfter(ctx context.Context, query EventQuery, after primitive.ObjectID, send func(Event) error, onSent func(Event)) (primitive.ObjectID, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetLimit(MAX_EVENTS_LIMIT)
+
+	for {
+		query.After = after
+		events, err := eventsRepo().FindMany(ctx, query.filter(), opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return after, nil
+			}
+			return after, err
+		}
+
+		for _, event := range events {
+			if err := send(event); err != nil {
+				return after, err
+			}
+			if onSent != nil {
+				onSent(event)
+			}
+			after = event.Uid
+		}
+
+		if len(events) < MAX_EVENTS_LIMIT {
+			return after, nil
+		}
+	}
+}
+
+// pipeline matches inserted events of query in change stream
+func (self *EventQuery) pipeline() mongo.Pipeline {
+	match := bson.M{"operationType": "insert"}
+
+	for key, value := range self.filter() {
+		if key != "_id" {
+			match["fullDocument."+key] = value
+		}
+	}
+
+	return mongo.Pipeline{{{Key: "$match", Value: match}}}
+}
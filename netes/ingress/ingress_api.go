@@ -0,0 +1,81 @@
+package ingress
+
+import (
+	"errors"
+	"net/http"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /api/ingress/routes
+Manifest and API routes of this node in the order they are matched
+*/
+func _ListRoutes(c *gin.Context) {
+	serverKit.ReturnOkJson(c, ROUTER.Routes())
+}
+
+/*
+POST /api/ingress/routes
+
+	{
+	  "app": "my-app",
+	  "host": "my-app.example.com",
+	  "pathPrefix": "/",
+	  "port": "http",
+	  "stripPrefix": false,
+	  "timeoutSeconds": 60
+	}
+
+Creates route or replaces route with the same host and path prefix
+*/
+func _PutRoute(c *gin.Context) {
+	var req struct {
+		App string `json:"app"`
+		manifest.Route
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	route, err := PutRoute(c.Request.Context(), req.App, req.Route, user)
+	returnRoute(c, route, err)
+}
+
+/*
+DELETE /api/ingress/routes?uid=
+Only API routes can be deleted, manifest routes go away with the app
+*/
+func _DeleteRoute(c *gin.Context) {
+	err := DeleteRoute(c.Request.Context(), c.Query("uid"))
+	returnRoute(c, nil, err)
+}
+
+func returnRoute(c *gin.Context, route *Route, err error) {
+	if errors.Is(err, ErrRouteNotFound) || errors.Is(err, ErrInvalidRoute) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else if route == nil {
+		serverKit.ReturnOkJson(c, gin.H{"status": "ok"})
+	} else {
+		serverKit.ReturnOkJson(c, route)
+	}
+}
+
+func InitIngressApi(r *gin.Engine) {
+	r.GET("/api/ingress/routes", auth.ApiKeysRequired, _ListRoutes)
+	r.POST("/api/ingress/routes", auth.ApiKeysRequired, _PutRoute)
+	r.DELETE("/api/ingress/routes", auth.ApiKeysRequired, _DeleteRoute)
+}
@@ -0,0 +1,173 @@
+package ingress
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/supervisor"
+)
+
+// Replicas listen on the node itself
+const BACKEND_HOST = "127.0.0.1"
+
+var BACKEND_DIAL_TIMEOUT = 5 * time.Second
+
+// Proxy is http.Handler of ingress listener, it forwards requests to replicas of matched route
+type Proxy struct {
+	router    *Router
+	transport *http.Transport
+}
+
+func NewProxy(router *Router) *Proxy {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: BACKEND_DIAL_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext
+	transport.MaxIdleConnsPerHost = 32
+	transport.Proxy = nil
+
+	return &Proxy{
+		router:    router,
+		transport: transport,
+	}
+}
+
+func (self *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	entry := self.router.Match(r.Host, r.URL.Path)
+	if entry == nil {
+		http.Error(w, "no route for "+r.Host+r.URL.Path, http.StatusNotFound)
+		return
+	}
+
+	backend, err := entry.pick()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	route := entry.route
+
+	// Upgraded connections live as long as the client wants
+	if route.TimeoutSeconds > 0 && !isUpgrade(r) {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(route.TimeoutSeconds)*time.Second)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+
+	target := &url.URL{Scheme: "http", Host: net.JoinHostPort(BACKEND_HOST, strconv.Itoa(backend.port))}
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.Out.Host = pr.In.Host
+			pr.SetXForwarded()
+			if route.StripPrefix {
+				stripPrefix(pr.Out.URL, route.PathPrefix)
+			}
+		},
+		Transport: self.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			switch {
+			case errors.Is(err, context.DeadlineExceeded):
+				http.Error(w, "app did not respond in time", http.StatusGatewayTimeout)
+			case errors.Is(err, context.Canceled):
+				// Client went away, nobody reads the response
+			default:
+				lgr.Error("Ingress failed to proxy %s%s to %s: %s", r.Host, r.URL.Path, route.App, err.Error())
+				http.Error(w, "app is not reachable", http.StatusBadGateway)
+			}
+		},
+	}
+
+	recorder := &statusRecorder{ResponseWriter: w}
+
+	proxy.ServeHTTP(recorder, r)
+
+	if recorder.status != 0 {
+		supervisor.SUPERVISOR.RecordResponse(route.App, backend.revisionId, recorder.status)
+	}
+}
+
+// statusRecorder remembers response status for canary error rate
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (self *statusRecorder) WriteHeader(status int) {
+	// Informational responses precede the final one
+	if self.status == 0 && status >= 200 {
+		self.status = status
+	}
+	self.ResponseWriter.WriteHeader(status)
+}
+
+func (self *statusRecorder) Write(data []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	return self.ResponseWriter.Write(data)
+}
+
+// Unwrap lets reverse proxy flush and hijack the original writer
+func (self *statusRecorder) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+func isUpgrade(r *http.Request) bool {
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func stripPrefix(target *url.URL, prefix string) {
+	prefix = strings.TrimSuffix(prefix, "/")
+
+	target.Path = "/" + strings.TrimPrefix(strings.TrimPrefix(target.Path, prefix), "/")
+
+	if target.RawPath != "" {
+		target.RawPath = "/" + strings.TrimPrefix(strings.TrimPrefix(target.RawPath, prefix), "/")
+	}
+}
+
+// Start serves ingress on configured address, nothing is started when address is empty
+func Start() {
+	addr := serverKit.SERVER_CONFIG.IngressAddr
+	if addr == "" {
+		return
+	}
+
+	if err := ReloadRoutes(context.Background()); err != nil {
+		lgr.Error("Failed to load ingress routes: %s", err.Error())
+	}
+	StartRouteRefresher()
+
+	// No read/write timeouts, every route has its own and websockets have none
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           NewProxy(ROUTER),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       2 * time.Minute,
+		MaxHeaderBytes:    1 << 20,
+	}
+
+	go tools.SafeGoRoutine(func() {
+		lgr.Ok("Ingress is listening at %s", addr)
+
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lgr.ErrorStack("Failed to start ingress: %v", err)
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package ingress
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"turtle/core/tools"
+	"turtle/netes/manifest"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	SOURCE_MANIFEST = "manifest"
+	SOURCE_API      = "api"
+)
+
+var (
+	ErrRouteNotFound = errors.New("route not found")
+	ErrInvalidRoute  = errors.New("invalid route")
+	ErrNoBackend     = errors.New("no ready replica")
+)
+
+// Route sends matching requests to ready replicas of app
+type Route struct {
+	Uid            primitive.ObjectID `json:"uid" bson:"_id"`
+	App            string             `json:"app" bson:"app"`
+	manifest.Route `bson:",inline"`
+	// manifest or api
+	Source    string    `json:"source" bson:"-"`
+	CreatedBy string    `json:"createdBy,omitempty" bson:"createdBy"`
+	CreatedAt time.Time `json:"createdAt,omitempty" bson:"createdAt"`
+}
+
+// Router keeps routes of manifests of running apps and routes created through API,
+// API route wins over manifest route with the same host and path prefix
+type Router struct {
+	mu        sync.RWMutex
+	appRoutes map[string][]Route
+	apiRoutes []Route
+	// Routes in match order
+	table []*routeEntry
+}
+
+type routeEntry struct {
+	route Route
+	// Round robin counter
+	next atomic.Uint64
+}
+
+var ROUTER = NewRouter()
+
+func NewRouter() *Router {
+	return &Router{
+		appRoutes: map[string][]Route{},
+	}
+}
+
+// SetAppRoutes replaces routes declared by manifest of app
+func (self *Router) SetAppRoutes(app string, routes []manifest.Route) {
+	result := make([]Route, 0, len(routes))
+
+	for _, route := range routes {
+		result = append(result, Route{
+			Uid:    tools.StringToObjectID(fmt.Sprintf("route/%s/%s%s", app, route.Host, route.PathPrefix)),
+			App:    app,
+			Route:  route,
+			Source: SOURCE_MANIFEST,
+		})
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if len(result) == 0 {
+		delete(self.appRoutes, app)
+	} else {
+		self.appRoutes[app] = result
+	}
+	self.rebuildLocked()
+}
+
+func (self *Router) RemoveAppRoutes(app string) {
+	self.SetAppRoutes(app, nil)
+}
+
+func (self *Router) SetApiRoutes(routes []Route) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.apiRoutes = routes
+	self.rebuildLocked()
+}
+
+// Routes returns all routes in the order they are matched
+func (self *Router) Routes() []Route {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	result := make([]Route, len(self.table))
+	for i, entry := range self.table {
+		result[i] = entry.route
+	}
+	return result
+}
+
+// Match returns the most specific route of host and path, nil when nothing matches
+func (self *Router) Match(host, path string) *routeEntry {
+	host = normalizeHost(host)
+
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+
+	for _, entry := range self.table {
+		if matchHost(entry.route.Host, host) && matchPath(entry.route.PathPrefix, path) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (self *Router) rebuildLocked() {
+	// Counters survive rebuild so balancing does not restart from the first replica
+	previous := map[primitive.ObjectID]*routeEntry{}
+	for _, entry := range self.table {
+		previous[entry.route.Uid] = entry
+	}
+
+	table := []*routeEntry{}
+	seen := map[string]bool{}
+
+	add := func(route Route) {
+		key := route.Host + route.PathPrefix
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+
+		entry := &routeEntry{route: route}
+		if old, ok := previous[route.Uid]; ok {
+			entry.next.Store(old.next.Load())
+		}
+		table = append(table, entry)
+	}
+
+	for _, route := range self.apiRoutes {
+		add(route)
+	}
+
+	apps := make([]string, 0, len(self.appRoutes))
+	for app := range self.appRoutes {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+
+	for _, app := range apps {
+		for _, route := range self.appRoutes[app] {
+			add(route)
+		}
+	}
+
+	sort.SliceStable(table, func(i, j int) bool {
+		a, b := table[i].route, table[j].route
+		if hostRank(a.Host) != hostRank(b.Host) {
+			return hostRank(a.Host) > hostRank(b.Host)
+		}
+		if len(a.Host) != len(b.Host) {
+			return len(a.Host) > len(b.Host)
+		}
+		return len(a.PathPrefix) > len(b.PathPrefix)
+	})
+
+	self.table = table
+}
+
+// backend is ready replica and its port of the route
+type backend struct {
+	revisionId string
+	port       int
+}
+
+// pick returns next ready replica, canary replicas get their percent of requests,
+// replicas of one revision take turns
+func (self *routeEntry) pick() (backend, error) {
+	stable, canary, weight := supervisor.SUPERVISOR.Backends(self.route.App)
+
+	backends := self.backends(stable)
+	if weight > 0 {
+		if canaryBackends := self.backends(canary); len(canaryBackends) > 0 && (len(backends) == 0 || rand.IntN(100) < weight) {
+			backends = canaryBackends
+		}
+	}
+
+	if len(backends) == 0 {
+		return backend{}, fmt.Errorf("%w: %s", ErrNoBackend, self.route.App)
+	}
+
+	n := self.next.Add(1) - 1
+
+	return backends[n%uint64(len(backends))], nil
+}
+
+func (self *routeEntry) backends(statuses []supervisor.ProcessStatus) []backend {
+	result := []backend{}
+	for _, status := range statuses {
+		if port, ok := status.PortOf(self.route.Port); ok {
+			result = append(result, backend{revisionId: status.RevisionId, port: port})
+		}
+	}
+	return result
+}
+
+// hostRank orders exact hosts before wildcards and wildcards before any host
+func hostRank(host string) int {
+	switch {
+	case host == "":
+		return 0
+	case strings.HasPrefix(host, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+func normalizeHost(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func matchHost(pattern, host string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		return strings.HasSuffix(host, pattern[1:]) && len(host) > len(pattern)-1
+	default:
+		return pattern == host
+	}
+}
+
+// matchPath matches whole path segments, "/api" matches "/api" and "/api/x" but not "/apix"
+func matchPath(prefix, path string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
+	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
@@ -0,0 +1,101 @@
+package ingress
+
+import (
+	"testing"
+	"turtle/netes/manifest"
+)
+
+func TestRouterMatch(t *testing.T) {
+	router := NewRouter()
+	router.SetAppRoutes("shop", []manifest.Route{
+		{Host: "shop.example.com"},
+		{Host: "shop.example.com", PathPrefix: "/api"},
+		{Host: "*.example.com", PathPrefix: "/static/"},
+	})
+	router.SetAppRoutes("fallback", []manifest.Route{
+		{},
+		{Host: "*.example.com"},
+	})
+	router.SetAppRoutes("admin", []manifest.Route{
+		{Host: "shop.example.com", PathPrefix: "/admin"},
+	})
+	router.SetApiRoutes([]Route{
+		{App: "maintenance", Route: manifest.Route{Host: "shop.example.com", PathPrefix: "/admin"}, Source: SOURCE_API},
+	})
+
+	tests := []struct {
+		name string
+		host string
+		path string
+		// App of matched route, empty when nothing matches
+		wantApp    string
+		wantPrefix string
+	}{
+		{name: "exact host", host: "shop.example.com", path: "/", wantApp: "shop"},
+		{name: "longest path prefix", host: "shop.example.com", path: "/api/orders", wantApp: "shop", wantPrefix: "/api"},
+		{name: "path prefix itself", host: "shop.example.com", path: "/api", wantApp: "shop", wantPrefix: "/api"},
+		{name: "prefix matches whole segments", host: "shop.example.com", path: "/apix", wantApp: "shop"},
+		{name: "host port is ignored", host: "shop.example.com:8080", path: "/api", wantApp: "shop", wantPrefix: "/api"},
+		{name: "host case and trailing dot", host: "Shop.Example.COM.", path: "/api", wantApp: "shop", wantPrefix: "/api"},
+		{name: "exact host wins over wildcard", host: "shop.example.com", path: "/static/app.js", wantApp: "shop"},
+		{name: "wildcard host", host: "blog.example.com", path: "/static/app.js", wantApp: "shop", wantPrefix: "/static/"},
+		{name: "prefix with slash needs the slash", host: "blog.example.com", path: "/static", wantApp: "fallback"},
+		{name: "wildcard of deeper host", host: "a.b.example.com", path: "/", wantApp: "fallback"},
+		{name: "wildcard needs subdomain", host: "example.com", path: "/", wantApp: "fallback"},
+		{name: "any host", host: "other.org", path: "/", wantApp: "fallback"},
+		{name: "api route wins over manifest route", host: "shop.example.com", path: "/admin/users", wantApp: "maintenance", wantPrefix: "/admin"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entry := router.Match(test.host, test.path)
+
+			if entry == nil {
+				t.Fatalf("Match(%q, %q) = nil, want route of %s", test.host, test.path, test.wantApp)
+			}
+			if entry.route.App != test.wantApp || entry.route.PathPrefix != test.wantPrefix {
+				t.Fatalf("Match(%q, %q) = %s %s%s, want %s with prefix %q", test.host, test.path, entry.route.App, entry.route.Host, entry.route.PathPrefix, test.wantApp, test.wantPrefix)
+			}
+		})
+	}
+}
+
+func TestRouterMatchNothing(t *testing.T) {
+	router := NewRouter()
+	router.SetAppRoutes("shop", []manifest.Route{
+		{Host: "shop.example.com", PathPrefix: "/api"},
+		{Host: "*.example.org"},
+	})
+
+	tests := []struct {
+		name string
+		host string
+		path string
+	}{
+		{name: "other host", host: "example.net", path: "/api"},
+		{name: "wildcard without subdomain", host: "example.org", path: "/"},
+		{name: "suffix is not subdomain", host: "badexample.org", path: "/"},
+		{name: "other path", host: "shop.example.com", path: "/web"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if entry := router.Match(test.host, test.path); entry != nil {
+				t.Fatalf("Match(%q, %q) = route of %s %s%s, want nil", test.host, test.path, entry.route.App, entry.route.Host, entry.route.PathPrefix)
+			}
+		})
+	}
+}
+
+func TestRouterRemoveAppRoutes(t *testing.T) {
+	router := NewRouter()
+	router.SetAppRoutes("shop", []manifest.Route{{Host: "shop.example.com"}})
+	router.RemoveAppRoutes("shop")
+
+	if entry := router.Match("shop.example.com", "/"); entry != nil {
+		t.Fatalf("Match() = route of %s, want nil after RemoveAppRoutes()", entry.route.App)
+	}
+	if routes := router.Routes(); len(routes) != 0 {
+		t.Fatalf("Routes() = %v, want none", routes)
+	}
+}
@@ -0,0 +1,137 @@
+package ingress
+
+import (
+	"context"
+	"fmt"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/tools"
+	"turtle/netes/manifest"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const ROUTES_COLLECTION = "ingress_routes"
+
+// API routes can be changed through any node, every node reloads them this often
+var ROUTES_REFRESH_INTERVAL = 10 * time.Second
+
+func routesRepo() *dbclient.Repository[Route] {
+	return dbclient.NewRepository[Route](dbclient.MongoClient, ROUTES_COLLECTION)
+}
+
+// There is at most one API route per host and path prefix
+func routeUid(host, pathPrefix string) primitive.ObjectID {
+	return tools.StringToObjectID("route/" + host + pathPrefix)
+}
+
+// PutRoute creates API route or replaces route with the same host and path prefix
+func PutRoute(ctx context.Context, app string, route manifest.Route, user string) (*Route, error) {
+	if err := manifest.ValidateAppName(app); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidRoute, err.Error())
+	}
+
+	route.ApplyDefaults()
+
+	if err := manifest.ValidateRoute(&route); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidRoute, err)
+	}
+
+	result := &Route{
+		Uid:       routeUid(route.Host, route.PathPrefix),
+		App:       app,
+		Route:     route,
+		Source:    SOURCE_API,
+		CreatedBy: user,
+		CreatedAt: time.Now(),
+	}
+
+	collection, err := routesRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": result.Uid},
+		result,
+		options.Replace().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ReloadRoutes(ctx); err != nil {
+		return nil, err
+	}
+
+	lgr.Info("Ingress route %s%s -> %s set by %s", route.Host, route.PathPrefix, app, user)
+
+	return result, nil
+}
+
+func DeleteRoute(ctx context.Context, uid string) error {
+	id, err := primitive.ObjectIDFromHex(uid)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, uid)
+	}
+
+	deleted, err := routesRepo().DeleteByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrRouteNotFound, uid)
+	}
+
+	return ReloadRoutes(ctx)
+}
+
+func ListApiRoutes(ctx context.Context) ([]Route, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "host", Value: 1}, {Key: "pathPrefix", Value: 1}})
+
+	routes, err := routesRepo().FindMany(ctx, bson.M{}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range routes {
+		routes[i].Source = SOURCE_API
+	}
+
+	return routes, nil
+}
+
+// ReloadRoutes loads API routes into ROUTER
+func ReloadRoutes(ctx context.Context) error {
+	if !dbclient.IsConnected() {
+		return dbclient.ErrNotConnected
+	}
+
+	routes, err := ListApiRoutes(ctx)
+	if err != nil {
+		return err
+	}
+
+	ROUTER.SetApiRoutes(routes)
+
+	return nil
+}
+
+func StartRouteRefresher() {
+	go func() {
+		ticker := time.NewTicker(ROUTES_REFRESH_INTERVAL)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			tools.SafeGoRoutine(func() {
+				if err := ReloadRoutes(context.Background()); err != nil {
+					lgr.Error("Failed to reload ingress routes: %s", err.Error())
+				}
+			})
+		}
+	}()
+}
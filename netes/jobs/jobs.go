@@ -0,0 +1,447 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/cron"
+	"turtle/netes/manifest"
+	"turtle/netes/supervisor"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	// Returned when forbid concurrency policy rejects new run
+	ErrRunActive = errors.New("job is already running")
+
+	errRunCanceled      = errors.New("run was canceled")
+	errRunReplaced      = errors.New("run was replaced by newer run")
+	errDeadlineExceeded = errors.New("run exceeded its deadline")
+)
+
+// State reported for app of job kind instead of supervisor process state
+const STATE_REGISTERED = "registered"
+
+// Time limit of Mongo writes of one run
+const SAVE_RUN_TIMEOUT = 10 * time.Second
+
+// JobDefinition is active revision of job or cronjob app on this node
+type JobDefinition struct {
+	App        string
+	RevisionId string
+	Dir        string
+	Manifest   manifest.Manifest
+}
+
+// JobStatus describes registered job, safe to serialize
+type JobStatus struct {
+	App               string    `json:"app"`
+	RevisionId        string    `json:"revisionId"`
+	Version           string    `json:"version"`
+	Kind              string    `json:"kind"`
+	Schedule          string    `json:"schedule,omitempty"`
+	ConcurrencyPolicy string    `json:"concurrencyPolicy"`
+	NextRunAt         time.Time `json:"nextRunAt"`
+	ActiveRuns        []string  `json:"activeRuns"`
+}
+
+type registeredJob struct {
+	definition JobDefinition
+	schedule   *cron.Schedule
+	nextRunAt  time.Time
+	stop       chan struct{}
+}
+
+type activeRun struct {
+	app    string
+	cancel context.CancelCauseFunc
+	done   chan struct{}
+}
+
+// JobManager runs jobs and cronjobs of this node, every app has at most one
+// registered definition and any number of active runs
+type JobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*registeredJob
+	running map[primitive.ObjectID]*activeRun
+}
+
+var JOBS = NewJobManager()
+
+func NewJobManager() *JobManager {
+	return &JobManager{
+		jobs:    map[string]*registeredJob{},
+		running: map[primitive.ObjectID]*activeRun{},
+	}
+}
+
+// Register replaces job definition of app, cronjobs start to be scheduled.
+// Runs of the previous definition are left to finish.
+func (self *JobManager) Register(definition JobDefinition) error {
+	job := &registeredJob{
+		definition: definition,
+		stop:       make(chan struct{}),
+	}
+
+	if definition.Manifest.Kind == manifest.KIND_CRONJOB {
+		schedule, err := cron.Parse(definition.Manifest.Job.Schedule)
+		if err != nil {
+			return err
+		}
+		job.schedule = schedule
+	}
+
+	self.mu.Lock()
+	previous := self.jobs[definition.App]
+	self.jobs[definition.App] = job
+	self.mu.Unlock()
+
+	if previous != nil {
+		close(previous.stop)
+	}
+
+	if job.schedule != nil {
+		go tools.SafeGoRoutine(func() {
+			self.scheduleLoop(job)
+		})
+	}
+
+	lgr.Info("Registered %s %s revision %s", definition.Manifest.Kind, definition.App, definition.RevisionId)
+
+	return nil
+}
+
+// Unregister stops scheduling of app, active runs are left to finish
+func (self *JobManager) Unregister(app string) {
+	self.mu.Lock()
+	job := self.jobs[app]
+	delete(self.jobs, app)
+	self.mu.Unlock()
+
+	if job != nil {
+		close(job.stop)
+	}
+}
+
+func (self *JobManager) scheduleLoop(job *registeredJob) {
+	for {
+		next := job.schedule.Next(time.Now())
+		if next.IsZero() {
+			lgr.Error("Schedule of cronjob %s never matches", job.definition.App)
+			return
+		}
+
+		self.mu.Lock()
+		job.nextRunAt = next
+		self.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(next))
+
+		select {
+		case <-job.stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		_, err := self.startRun(job, TRIGGER_SCHEDULE, "", next)
+		if err != nil && !errors.Is(err, ErrRunActive) {
+			lgr.Error("Failed to start scheduled run of %s: %s", job.definition.App, err.Error())
+		}
+	}
+}
+
+// Trigger starts run of registered job of app now
+func (self *JobManager) Trigger(app, trigger, user string) (*JobRun, error) {
+	self.mu.Lock()
+	job := self.jobs[app]
+	self.mu.Unlock()
+
+	if job == nil {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, app)
+	}
+
+	return self.startRun(job, trigger, user, time.Now())
+}
+
+// startRun applies concurrency policy, records the run and executes it in background
+func (self *JobManager) startRun(job *registeredJob, trigger, user string, scheduledAt time.Time) (*JobRun, error) {
+	definition := job.definition
+	spec := definition.Manifest.Job
+
+	run := &JobRun{
+		Uid:         primitive.NewObjectID(),
+		App:         definition.App,
+		Node:        serverKit.SERVER_CONFIG.GetNodeName(),
+		RevisionId:  definition.RevisionId,
+		Version:     definition.Manifest.Version,
+		Kind:        definition.Manifest.Kind,
+		Trigger:     trigger,
+		TriggeredBy: user,
+		Status:      RUN_RUNNING,
+		ScheduledAt: scheduledAt,
+		StartedAt:   time.Now(),
+		Attempts:    []JobAttemptRecord{},
+	}
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	current := &activeRun{
+		app:    definition.App,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	// Check and registration happen under one lock so forbid can't be raced
+	self.mu.Lock()
+	active := self.activeRunsLocked(definition.App)
+	forbidden := len(active) > 0 && spec.ConcurrencyPolicy == manifest.CONCURRENCY_FORBID
+	if !forbidden {
+		self.running[run.Uid] = current
+	}
+	self.mu.Unlock()
+
+	if forbidden {
+		cancel(nil)
+		if trigger == TRIGGER_SCHEDULE {
+			run.Status = RUN_SKIPPED
+			run.FinishedAt = run.StartedAt
+			run.Error = ErrRunActive.Error()
+			self.save(run)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrRunActive, definition.App)
+	}
+
+	if len(active) > 0 && spec.ConcurrencyPolicy == manifest.CONCURRENCY_REPLACE {
+		for _, previous := range active {
+			previous.cancel(errRunReplaced)
+			<-previous.done
+		}
+	}
+
+	if err := self.save(run); err != nil {
+		self.finishActive(run.Uid, current)
+		return nil, err
+	}
+
+	snapshot := *run
+
+	go tools.SafeGoRoutine(func() {
+		defer self.finishActive(run.Uid, current)
+		self.execute(ctx, &definition, run)
+	})
+
+	return &snapshot, nil
+}
+
+func (self *JobManager) finishActive(uid primitive.ObjectID, run *activeRun) {
+	self.mu.Lock()
+	delete(self.running, uid)
+	self.mu.Unlock()
+
+	run.cancel(nil)
+	close(run.done)
+}
+
+// execute runs attempts until success, retries are used up or deadline passes
+func (self *JobManager) execute(ctx context.Context, definition *JobDefinition, run *JobRun) {
+	spec := definition.Manifest.Job
+
+	if spec.DeadlineSeconds > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, time.Duration(spec.DeadlineSeconds)*time.Second, errDeadlineExceeded)
+		defer cancel()
+	}
+
+	output := &tailBuffer{limit: MAX_RUN_OUTPUT}
+
+	var exitCode int
+	var err error
+
+	for attempt := 0; attempt <= spec.Retries; attempt++ {
+		record := JobAttemptRecord{
+			Number:    attempt + 1,
+			StartedAt: time.Now(),
+		}
+		run.Attempts = append(run.Attempts, record)
+		self.save(run)
+
+		exitCode, err = supervisor.RunAttempt(ctx, &supervisor.JobAttempt{
+			App:        definition.App,
+			RevisionId: definition.RevisionId,
+			Dir:        definition.Dir,
+			Manifest:   &definition.Manifest,
+			Instance:   run.Uid.Hex(),
+			Output:     output,
+			OnStart: func(pid int) {
+				run.Attempts[len(run.Attempts)-1].Pid = pid
+			},
+		})
+
+		last := &run.Attempts[len(run.Attempts)-1]
+		last.ExitCode = exitCode
+		last.FinishedAt = time.Now()
+		if err != nil {
+			last.Error = err.Error()
+		}
+
+		if err == nil && exitCode == 0 {
+			break
+		}
+
+		if ctx.Err() != nil || attempt == spec.Retries {
+			break
+		}
+
+		delay := supervisor.NextBackoff(attempt)
+
+		lgr.Error("Job %s run %s attempt %d failed with code %d, retrying in %s", definition.App, run.Uid.Hex(), attempt+1, exitCode, delay)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	run.ExitCode = exitCode
+	run.FinishedAt = time.Now()
+	run.Output, run.OutputTruncated = output.String()
+
+	cause := context.Cause(ctx)
+
+	switch {
+	case errors.Is(cause, errDeadlineExceeded):
+		run.Status = RUN_DEADLINE_EXCEEDED
+		run.Error = cause.Error()
+	case errors.Is(cause, errRunCanceled), errors.Is(cause, errRunReplaced):
+		run.Status = RUN_CANCELED
+		run.Error = cause.Error()
+	case err != nil:
+		run.Status = RUN_FAILED
+		run.Error = err.Error()
+	case exitCode != 0:
+		run.Status = RUN_FAILED
+		run.Error = fmt.Sprintf("exited with code %d", exitCode)
+	default:
+		run.Status = RUN_SUCCEEDED
+	}
+
+	if err := self.save(run); err != nil {
+		lgr.Error("Failed to save job run %s: %s", run.Uid.Hex(), err.Error())
+	}
+
+	lgr.Info("Job %s run %s finished: %s", definition.App, run.Uid.Hex(), run.Status)
+
+	ctxPrune, cancel := context.WithTimeout(context.Background(), SAVE_RUN_TIMEOUT)
+	defer cancel()
+
+	if err := pruneHistory(ctxPrune, definition.App, spec.HistoryLimit); err != nil {
+		lgr.Error("Failed to prune history of job %s: %s", definition.App, err.Error())
+	}
+}
+
+func (self *JobManager) save(run *JobRun) error {
+	ctx, cancel := context.WithTimeout(context.Background(), SAVE_RUN_TIMEOUT)
+	defer cancel()
+
+	return saveRun(ctx, run)
+}
+
+func (self *JobManager) activeRunsLocked(app string) []*activeRun {
+	result := []*activeRun{}
+	for _, run := range self.running {
+		if run.app == app {
+			result = append(result, run)
+		}
+	}
+	return result
+}
+
+// Cancel stops active run, it is recorded as canceled
+func (self *JobManager) Cancel(runId string) error {
+	uid, err := primitive.ObjectIDFromHex(runId)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrRunNotFound, runId)
+	}
+
+	self.mu.Lock()
+	run := self.running[uid]
+	self.mu.Unlock()
+
+	if run == nil {
+		return fmt.Errorf("%w: %s is not running", ErrRunNotFound, runId)
+	}
+
+	run.cancel(errRunCanceled)
+	<-run.done
+
+	return nil
+}
+
+// CancelAll stops scheduling of every job and every active run, used on shutdown
+func (self *JobManager) CancelAll() {
+	self.mu.Lock()
+	for app, job := range self.jobs {
+		close(job.stop)
+		delete(self.jobs, app)
+	}
+
+	runs := make([]*activeRun, 0, len(self.running))
+	for _, run := range self.running {
+		runs = append(runs, run)
+	}
+	self.mu.Unlock()
+
+	for _, run := range runs {
+		run.cancel(errRunCanceled)
+	}
+	for _, run := range runs {
+		<-run.done
+	}
+}
+
+func (self *JobManager) List() []JobStatus {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	result := make([]JobStatus, 0, len(self.jobs))
+
+	for app, job := range self.jobs {
+		status := JobStatus{
+			App:               app,
+			RevisionId:        job.definition.RevisionId,
+			Version:           job.definition.Manifest.Version,
+			Kind:              job.definition.Manifest.Kind,
+			Schedule:          job.definition.Manifest.Job.Schedule,
+			ConcurrencyPolicy: job.definition.Manifest.Job.ConcurrencyPolicy,
+			NextRunAt:         job.nextRunAt,
+			ActiveRuns:        []string{},
+		}
+
+		for uid, run := range self.running {
+			if run.app == app {
+				status.ActiveRuns = append(status.ActiveRuns, uid.Hex())
+			}
+		}
+
+		result = append(result, status)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].App < result[j].App
+	})
+
+	return result
+}
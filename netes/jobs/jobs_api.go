@@ -0,0 +1,109 @@
+package jobs
+
+import (
+	"errors"
+	"strconv"
+	"time"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /deplistener/jobs
+Registered jobs and cronjobs with next scheduled run
+*/
+func _ListJobs(c *gin.Context) {
+	serverKit.ReturnOkJson(c, JOBS.List())
+}
+
+/*
+POST /deplistener/jobs/run?app=
+*/
+func _RunJob(c *gin.Context) {
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	run, err := JOBS.Trigger(c.Query("app"), TRIGGER_MANUAL, user)
+	returnRun(c, run, err)
+}
+
+/*
+GET /deplistener/jobs/runs?app=&status=&since=&limit=
+since is RFC3339, output of runs is returned only by /deplistener/jobs/runs/get
+*/
+func _ListRuns(c *gin.Context) {
+	query := RunsQuery{
+		App:    c.Query("app"),
+		Status: c.Query("status"),
+	}
+
+	if value := c.Query("since"); value != "" {
+		since, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			serverKit.ReturnUnacceptable(c, err)
+			return
+		}
+		query.Since = since
+	}
+
+	if value := c.Query("limit"); value != "" {
+		limit, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			serverKit.ReturnUnacceptable(c, err)
+			return
+		}
+		query.Limit = limit
+	}
+
+	runs, err := ListRuns(c.Request.Context(), query)
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, runs)
+}
+
+/*
+GET /deplistener/jobs/runs/get?uid=
+*/
+func _GetRun(c *gin.Context) {
+	run, err := GetRun(c.Request.Context(), c.Query("uid"))
+	returnRun(c, run, err)
+}
+
+/*
+POST /deplistener/jobs/runs/cancel?uid=
+*/
+func _CancelRun(c *gin.Context) {
+	if err := JOBS.Cancel(c.Query("uid")); err != nil {
+		returnRun(c, nil, err)
+		return
+	}
+
+	run, err := GetRun(c.Request.Context(), c.Query("uid"))
+	returnRun(c, run, err)
+}
+
+func returnRun(c *gin.Context, run *JobRun, err error) {
+	if errors.Is(err, ErrRunNotFound) || errors.Is(err, ErrJobNotFound) || errors.Is(err, ErrRunActive) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else {
+		serverKit.ReturnOkJson(c, run)
+	}
+}
+
+func InitJobsApi(r *gin.Engine) {
+	r.GET("/deplistener/jobs", auth.ApiKeysRequired, _ListJobs)
+	r.POST("/deplistener/jobs/run", auth.ApiKeysRequired, _RunJob)
+	r.GET("/deplistener/jobs/runs", auth.ApiKeysRequired, _ListRuns)
+	r.GET("/deplistener/jobs/runs/get", auth.ApiKeysRequired, _GetRun)
+	r.POST("/deplistener/jobs/runs/cancel", auth.ApiKeysRequired, _CancelRun)
+}
@@ -0,0 +1,221 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/serverKit"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const JOB_RUNS_COLLECTION = "job_runs"
+
+const (
+	RUN_RUNNING           = "running"
+	RUN_SUCCEEDED         = "succeeded"
+	RUN_FAILED            = "failed"
+	RUN_DEADLINE_EXCEEDED = "deadlineExceeded"
+	RUN_CANCELED          = "canceled"
+	// Scheduled run not started because of forbid concurrency policy
+	RUN_SKIPPED = "skipped"
+)
+
+const (
+	TRIGGER_DEPLOY   = "deploy"
+	TRIGGER_SCHEDULE = "schedule"
+	TRIGGER_MANUAL   = "manual"
+)
+
+// Tail of process output stored with the run, whole output is in app logs
+var MAX_RUN_OUTPUT = 64 << 10
+
+const MAX_RUNS_QUERY = 500
+
+var ErrRunNotFound = errors.New("job run not found")
+
+type JobAttemptRecord struct {
+	Number     int       `json:"number" bson:"number"`
+	Pid        int       `json:"pid" bson:"pid"`
+	ExitCode   int       `json:"exitCode" bson:"exitCode"`
+	Error      string    `json:"error,omitempty" bson:"error,omitempty"`
+	StartedAt  time.Time `json:"startedAt" bson:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt" bson:"finishedAt"`
+}
+
+// JobRun is one execution of job, it may consist of several attempts
+type JobRun struct {
+	Uid             primitive.ObjectID `json:"uid" bson:"_id"`
+	App             string             `json:"app" bson:"app"`
+	Node            string             `json:"node" bson:"node"`
+	RevisionId      string             `json:"revisionId" bson:"revisionId"`
+	Version         string             `json:"version" bson:"version"`
+	Kind            string             `json:"kind" bson:"kind"`
+	Trigger         string             `json:"trigger" bson:"trigger"`
+	TriggeredBy     string             `json:"triggeredBy,omitempty" bson:"triggeredBy,omitempty"`
+	Status          string             `json:"status" bson:"status"`
+	ScheduledAt     time.Time          `json:"scheduledAt" bson:"scheduledAt"`
+	StartedAt       time.Time          `json:"startedAt" bson:"startedAt"`
+	FinishedAt      time.Time          `json:"finishedAt" bson:"finishedAt"`
+	ExitCode        int                `json:"exitCode" bson:"exitCode"`
+	Error           string             `json:"error,omitempty" bson:"error,omitempty"`
+	Attempts        []JobAttemptRecord `json:"attempts" bson:"attempts"`
+	Output          string             `json:"output,omitempty" bson:"output"`
+	OutputTruncated bool               `json:"outputTruncated" bson:"outputTruncated"`
+}
+
+func jobRunsRepo() *dbclient.Repository[JobRun] {
+	return dbclient.NewRepository[JobRun](dbclient.MongoClient, JOB_RUNS_COLLECTION)
+}
+
+func (self *JobRun) IsFinished() bool {
+	return self.Status != RUN_RUNNING
+}
+
+func saveRun(ctx context.Context, run *JobRun) error {
+	collection, err := jobRunsRepo().Collection()
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.ReplaceOne(
+		ctx,
+		bson.M{"_id": run.Uid},
+		run,
+		options.Replace().SetUpsert(true),
+	)
+	return err
+}
+
+func GetRun(ctx context.Context, runId string) (*JobRun, error) {
+	uid, err := primitive.ObjectIDFromHex(runId)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, runId)
+	}
+
+	run, err := jobRunsRepo().FindByID(ctx, uid)
+	if err != nil {
+		return nil, err
+	}
+	if run == nil {
+		return nil, fmt.Errorf("%w: %s", ErrRunNotFound, runId)
+	}
+
+	return run, nil
+}
+
+type RunsQuery struct {
+	App    string
+	Status string
+	Since  time.Time
+	Limit  int64
+}
+
+// ListRuns returns runs of this node newest first, output is left out
+func ListRuns(ctx context.Context, query RunsQuery) ([]JobRun, error) {
+	filter := bson.M{"node": serverKit.SERVER_CONFIG.GetNodeName()}
+
+	if query.App != "" {
+		filter["app"] = query.App
+	}
+	if query.Status != "" {
+		filter["status"] = query.Status
+	}
+	if !query.Since.IsZero() {
+		filter["scheduledAt"] = bson.M{"$gte": query.Since}
+	}
+
+	if query.Limit <= 0 || query.Limit > MAX_RUNS_QUERY {
+		query.Limit = MAX_RUNS_QUERY
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "scheduledAt", Value: -1}}).
+		SetLimit(query.Limit).
+		SetProjection(bson.M{"output": 0})
+
+	return jobRunsRepo().FindMany(ctx, filter, opts)
+}
+
+// pruneHistory keeps newest limit finished runs of app
+func pruneHistory(ctx context.Context, app string, limit int) error {
+	if limit <= 0 {
+		return nil
+	}
+
+	filter := bson.M{
+		"app":    app,
+		"node":   serverKit.SERVER_CONFIG.GetNodeName(),
+		"status": bson.M{"$ne": RUN_RUNNING},
+	}
+
+	opts := options.Find().
+		SetSort(bson.D{{Key: "scheduledAt", Value: -1}}).
+		SetSkip(int64(limit)).
+		SetProjection(bson.M{"_id": 1})
+
+	old, err := jobRunsRepo().FindMany(ctx, filter, opts)
+	if err != nil || len(old) == 0 {
+		return err
+	}
+
+	ids := make([]primitive.ObjectID, len(old))
+	for i, run := range old {
+		ids[i] = run.Uid
+	}
+
+	_, err = jobRunsRepo().DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+// RecoverInterruptedRuns fails runs left running by previous listener process
+func RecoverInterruptedRuns(ctx context.Context) (int64, error) {
+	if !dbclient.IsConnected() {
+		return 0, dbclient.ErrNotConnected
+	}
+
+	return jobRunsRepo().UpdateMany(ctx,
+		bson.M{
+			"node":   serverKit.SERVER_CONFIG.GetNodeName(),
+			"status": RUN_RUNNING,
+		},
+		bson.M{"$set": bson.M{
+			"status":     RUN_FAILED,
+			"error":      "listener restarted while job was running",
+			"finishedAt": time.Now(),
+		}},
+	)
+}
+
+// tailBuffer keeps last limit bytes written by stdout and stderr
+type tailBuffer struct {
+	mu        sync.Mutex
+	data      []byte
+	limit     int
+	truncated bool
+}
+
+func (self *tailBuffer) Write(data []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.data = append(self.data, data...)
+
+	if len(self.data) > self.limit {
+		self.data = append([]byte{}, self.data[len(self.data)-self.limit:]...)
+		self.truncated = true
+	}
+
+	return len(data), nil
+}
+
+func (self *tailBuffer) String() (string, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return string(self.data), self.truncated
+}
@@ -0,0 +1,303 @@
+package manifest
+
+const (
+	RESTART_ALWAYS     = "always"
+	RESTART_ON_FAILURE = "on-failure"
+	RESTART_NEVER      = "never"
+)
+
+const (
+	KIND_SERVICE = "service"
+	KIND_JOB     = "job"
+	KIND_CRONJOB = "cronjob"
+)
+
+const (
+	CONCURRENCY_ALLOW   = "allow"
+	CONCURRENCY_FORBID  = "forbid"
+	CONCURRENCY_REPLACE = "replace"
+)
+
+const (
+	STRATEGY_RECREATE   = "recreate"
+	STRATEGY_ROLLING    = "rolling"
+	STRATEGY_BLUE_GREEN = "blueGreen"
+	STRATEGY_CANARY     = "canary"
+)
+
+const (
+	SPREAD_NONE    = "none"
+	SPREAD_PREFER  = "prefer"
+	SPREAD_REQUIRE = "require"
+)
+
+const (
+	HEALTH_CHECK_HTTP = "http"
+	HEALTH_CHECK_TCP  = "tcp"
+	HEALTH_CHECK_EXEC = "exec"
+)
+
+// Manifest file names searched in the root of a deployment package, in order
+var MANIFEST_FILE_NAMES = []string{"turtle.yaml", "turtle.yml", "turtle.json"}
+
+// Manifest describes how a deployed application is started and supervised
+type Manifest struct {
+	App     string `json:"app" bson:"app"`
+	Version string `json:"version" bson:"version"`
+	// service (long running, default), job (runs to completion on deploy) or cronjob
+	Kind    string            `json:"kind,omitempty" bson:"kind,omitempty"`
+	Job     *JobSpec          `json:"job,omitempty" bson:"job,omitempty"`
+	Command string            `json:"command" bson:"command"`
+	Args    []string          `json:"args,omitempty" bson:"args,omitempty"`
+	Env     map[string]string `json:"env,omitempty" bson:"env,omitempty"`
+	Ports   []Port            `json:"ports,omitempty" bson:"ports,omitempty"`
+	// Failing liveness probe restarts the process
+	LivenessProbe *HealthCheck `json:"livenessProbe,omitempty" bson:"livenessProbe,omitempty"`
+	// Replica gets traffic and counts as updated only while readiness probe passes
+	ReadinessProbe *HealthCheck `json:"readinessProbe,omitempty" bson:"readinessProbe,omitempty"`
+	// Older name of readinessProbe
+	HealthCheck   *HealthCheck   `json:"healthCheck,omitempty" bson:"healthCheck,omitempty"`
+	RestartPolicy string         `json:"restartPolicy,omitempty" bson:"restartPolicy,omitempty"`
+	Resources     Resources      `json:"resources,omitempty" bson:"resources,omitempty"`
+	Placement     Placement      `json:"placement,omitempty" bson:"placement,omitempty"`
+	Secrets       []SecretRef    `json:"secrets,omitempty" bson:"secrets,omitempty"`
+	Templates     []Template     `json:"templates,omitempty" bson:"templates,omitempty"`
+	Routes        []Route        `json:"routes,omitempty" bson:"routes,omitempty"`
+	Update        UpdateStrategy `json:"update,omitempty" bson:"update,omitempty"`
+}
+
+type Port struct {
+	Name     string `json:"name,omitempty" bson:"name,omitempty"`
+	Port     int    `json:"port" bson:"port"`
+	Protocol string `json:"protocol,omitempty" bson:"protocol,omitempty"`
+}
+
+// HealthCheck is a probe of one replica, http GET succeeds with status 200-399,
+// exec with exit code 0
+type HealthCheck struct {
+	Type string `json:"type" bson:"type"`
+	Path string `json:"path,omitempty" bson:"path,omitempty"`
+	// Port of http and tcp checks, portName or the first port of replica when 0
+	Port                int      `json:"port,omitempty" bson:"port,omitempty"`
+	PortName            string   `json:"portName,omitempty" bson:"portName,omitempty"`
+	Command             []string `json:"command,omitempty" bson:"command,omitempty"`
+	InitialDelaySeconds int      `json:"initialDelaySeconds,omitempty" bson:"initialDelaySeconds,omitempty"`
+	IntervalSeconds     int      `json:"intervalSeconds,omitempty" bson:"intervalSeconds,omitempty"`
+	TimeoutSeconds      int      `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+	// Consecutive failures that make replica unready or restart it
+	FailureThreshold int `json:"failureThreshold,omitempty" bson:"failureThreshold,omitempty"`
+	// Consecutive successes that make replica ready again
+	SuccessThreshold int `json:"successThreshold,omitempty" bson:"successThreshold,omitempty"`
+}
+
+type Resources struct {
+	// Cpu in cores, 0.5 means half of one core
+	Cpu      float64 `json:"cpu,omitempty" bson:"cpu,omitempty"`
+	MemoryMb int64   `json:"memoryMb,omitempty" bson:"memoryMb,omitempty"`
+	MaxPids  int64   `json:"maxPids,omitempty" bson:"maxPids,omitempty"`
+}
+
+// Placement tells controller on how many and which nodes the app runs
+type Placement struct {
+	Replicas     int               `json:"replicas,omitempty" bson:"replicas,omitempty"`
+	NodeSelector map[string]string `json:"nodeSelector,omitempty" bson:"nodeSelector,omitempty"`
+	// none, prefer (spread replicas when possible) or require (at most one replica per node)
+	Spread string `json:"spread,omitempty" bson:"spread,omitempty"`
+}
+
+// JobSpec configures job and cronjob kinds
+type JobSpec struct {
+	// Failed run is retried this many times
+	Retries int `json:"retries,omitempty" bson:"retries,omitempty"`
+	// All attempts of one run are killed after the deadline, 0 means no deadline
+	DeadlineSeconds int `json:"deadlineSeconds,omitempty" bson:"deadlineSeconds,omitempty"`
+	// Standard 5 field cron expression or macro like @daily, cronjob only
+	Schedule string `json:"schedule,omitempty" bson:"schedule,omitempty"`
+	// allow, forbid or replace runs still running when the next one is due
+	ConcurrencyPolicy string `json:"concurrencyPolicy,omitempty" bson:"concurrencyPolicy,omitempty"`
+	// Finished runs kept in history
+	HistoryLimit int `json:"historyLimit,omitempty" bson:"historyLimit,omitempty"`
+}
+
+// SecretRef injects secret from secrets store into the process when it starts.
+// With env the value is set as environment variable, with file it is written to
+// the app secrets dir, with both the env variable holds the file path.
+type SecretRef struct {
+	Name string `json:"name" bson:"name"`
+	Env  string `json:"env,omitempty" bson:"env,omitempty"`
+	File string `json:"file,omitempty" bson:"file,omitempty"`
+}
+
+// Template is Go text/template file of the package rendered into target before the
+// process starts, paths are relative to the revision folder. It is rendered for every
+// replica into its instance folder, the replica runs there with package files next to it.
+type Template struct {
+	Source string `json:"source" bson:"source"`
+	Target string `json:"target" bson:"target"`
+	// Secret names the template may read besides the secrets of the manifest
+	Secrets []string `json:"secrets,omitempty" bson:"secrets,omitempty"`
+}
+
+// Route exposes port of the app through the ingress proxy of the node
+type Route struct {
+	// Host header to match, "*.example.com" matches any subdomain, empty matches every host
+	Host       string `json:"host,omitempty" bson:"host,omitempty"`
+	PathPrefix string `json:"pathPrefix,omitempty" bson:"pathPrefix,omitempty"`
+	// Name or index of the port requests are sent to, first port when empty
+	Port string `json:"port,omitempty" bson:"port,omitempty"`
+	// Removes path prefix before request is forwarded
+	StripPrefix bool `json:"stripPrefix,omitempty" bson:"stripPrefix,omitempty"`
+	// Time limit of one request, websockets are not limited
+	TimeoutSeconds int `json:"timeoutSeconds,omitempty" bson:"timeoutSeconds,omitempty"`
+}
+
+// UpdateStrategy tells how replicas of the previous revision are replaced on a node
+type UpdateStrategy struct {
+	// rolling (default), recreate which stops all old replicas first, blueGreen
+	// which starts new revision next to the old one and switches traffic when ready
+	// or canary which moves traffic to new revision in steps
+	Type string `json:"type,omitempty" bson:"type,omitempty"`
+	// Replicas started above desired count during update, 1 when both limits are 0
+	MaxSurge int `json:"maxSurge,omitempty" bson:"maxSurge,omitempty"`
+	// Replicas that may be missing during update
+	MaxUnavailable int `json:"maxUnavailable,omitempty" bson:"maxUnavailable,omitempty"`
+	// New replicas must become ready in this time
+	ReadyTimeoutSeconds int `json:"readyTimeoutSeconds,omitempty" bson:"readyTimeoutSeconds,omitempty"`
+	// Failed update is rolled back by default, with false it is paused
+	AutoRollback *bool `json:"autoRollback,omitempty" bson:"autoRollback,omitempty"`
+	// Steps of canary strategy
+	Canary *CanaryStrategy `json:"canary,omitempty" bson:"canary,omitempty"`
+}
+
+// CanaryStrategy sends growing percent of ingress requests to new revision
+type CanaryStrategy struct {
+	// Percent of requests of every step, 100 is always the last step
+	Steps []int `json:"steps,omitempty" bson:"steps,omitempty"`
+	// Step is promoted after this time, 0 waits for manual promotion
+	StepSeconds int `json:"stepSeconds,omitempty" bson:"stepSeconds,omitempty"`
+	// Canary is aborted when ratio of its 5xx responses passes this, 0-1
+	MaxErrorRate float64 `json:"maxErrorRate,omitempty" bson:"maxErrorRate,omitempty"`
+	// Error rate of a step is judged only after this many requests
+	MinRequests int `json:"minRequests,omitempty" bson:"minRequests,omitempty"`
+}
+
+// ApplyDefaults fills optional fields that have a sensible default
+func (self *Manifest) ApplyDefaults() {
+	if self.Kind == "" {
+		self.Kind = KIND_SERVICE
+	}
+
+	if self.IsJob() {
+		if self.Job == nil {
+			self.Job = &JobSpec{}
+		}
+		if self.Job.ConcurrencyPolicy == "" {
+			self.Job.ConcurrencyPolicy = CONCURRENCY_ALLOW
+		}
+		if self.Job.HistoryLimit == 0 {
+			self.Job.HistoryLimit = 20
+		}
+	}
+
+	if self.RestartPolicy == "" {
+		self.RestartPolicy = RESTART_ON_FAILURE
+	}
+
+	for i := range self.Ports {
+		if self.Ports[i].Protocol == "" {
+			self.Ports[i].Protocol = "tcp"
+		}
+	}
+
+	if self.ReadinessProbe == nil && self.HealthCheck != nil {
+		self.ReadinessProbe = self.HealthCheck
+	}
+	if self.LivenessProbe != nil {
+		self.LivenessProbe.ApplyDefaults()
+	}
+	if self.ReadinessProbe != nil {
+		self.ReadinessProbe.ApplyDefaults()
+	}
+
+	for i := range self.Routes {
+		self.Routes[i].ApplyDefaults()
+	}
+
+	self.Update.ApplyDefaults()
+
+	if self.Placement.Replicas == 0 {
+		self.Placement.Replicas = 1
+	}
+	if self.Placement.Spread == "" {
+		self.Placement.Spread = SPREAD_PREFER
+	}
+}
+
+func (self *HealthCheck) ApplyDefaults() {
+	if self.IntervalSeconds == 0 {
+		self.IntervalSeconds = 10
+	}
+	if self.TimeoutSeconds == 0 {
+		self.TimeoutSeconds = 1
+	}
+	if self.FailureThreshold == 0 {
+		self.FailureThreshold = 3
+	}
+	if self.SuccessThreshold == 0 {
+		self.SuccessThreshold = 1
+	}
+	if self.Type == HEALTH_CHECK_HTTP && self.Path == "" {
+		self.Path = "/"
+	}
+}
+
+func (self *Route) ApplyDefaults() {
+	if self.PathPrefix == "" {
+		self.PathPrefix = "/"
+	}
+	if self.TimeoutSeconds == 0 {
+		self.TimeoutSeconds = 60
+	}
+}
+
+func (self *UpdateStrategy) ApplyDefaults() {
+	if self.Type == "" {
+		self.Type = STRATEGY_ROLLING
+	}
+	if self.MaxSurge == 0 && self.MaxUnavailable == 0 {
+		self.MaxSurge = 1
+	}
+	if self.ReadyTimeoutSeconds == 0 {
+		self.ReadyTimeoutSeconds = 300
+	}
+	if self.Type == STRATEGY_CANARY {
+		if self.Canary == nil {
+			self.Canary = &CanaryStrategy{}
+		}
+		self.Canary.ApplyDefaults()
+	}
+}
+
+func (self *CanaryStrategy) ApplyDefaults() {
+	if len(self.Steps) == 0 {
+		self.Steps = []int{5, 25}
+	}
+	if self.Steps[len(self.Steps)-1] != 100 {
+		self.Steps = append(self.Steps, 100)
+	}
+	if self.MaxErrorRate == 0 {
+		self.MaxErrorRate = 0.05
+	}
+	if self.MinRequests == 0 {
+		self.MinRequests = 20
+	}
+}
+
+func (self *UpdateStrategy) RollbackOnFailure() bool {
+	return self.AutoRollback == nil || *self.AutoRollback
+}
+
+// IsJob is true for kinds that run to completion
+func (self *Manifest) IsJob() bool {
+	return self.Kind == KIND_JOB || self.Kind == KIND_CRONJOB
+}
@@ -0,0 +1,87 @@
+package manifest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/goccy/go-yaml"
+)
+
+var ErrManifestNotFound = errors.New("manifest not found")
+
+// ParseYaml parses manifest from YAML, unknown fields are rejected
+func ParseYaml(data []byte) (*Manifest, error) {
+	var result Manifest
+
+	if err := yaml.UnmarshalWithOptions(data, &result, yaml.Strict()); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest yaml: %s", yaml.FormatError(err, false, false))
+	}
+
+	return &result, nil
+}
+
+// ParseJson parses manifest from JSON, unknown fields are rejected
+func ParseJson(data []byte) (*Manifest, error) {
+	var result Manifest
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest json: %w", err)
+	}
+
+	return &result, nil
+}
+
+// Parse picks parser by file name extension
+func Parse(fileName string, data []byte) (*Manifest, error) {
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		return ParseJson(data)
+	}
+	return ParseYaml(data)
+}
+
+// LoadFromDir finds manifest in the root of unpacked package, parses,
+// defaults and validates it
+func LoadFromDir(dir string) (*Manifest, error) {
+	for _, name := range MANIFEST_FILE_NAMES {
+		path := filepath.Join(dir, name)
+
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%s must be a regular file", name)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := Parse(name, data)
+		if err != nil {
+			return nil, err
+		}
+
+		result.ApplyDefaults()
+
+		if err := result.Validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+
+		return result, nil
+	}
+
+	return nil, fmt.Errorf("%w: expected one of %s", ErrManifestNotFound, strings.Join(MANIFEST_FILE_NAMES, ", "))
+}
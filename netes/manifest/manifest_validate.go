@@ -0,0 +1,469 @@
+package manifest
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"turtle/netes/cron"
+)
+
+var appNameRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+var envNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+var secretNameRegex = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._-]{0,127}$`)
+
+var hostRegex = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+
+// Port names end up in TURTLE_PORT_<NAME> variables
+var portNameRegex = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_-]{0,31}$`)
+
+// ValidationError points to the manifest field that is wrong, e.g. "ports[1].port"
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (self ValidationError) Error() string {
+	return self.Field + ": " + self.Message
+}
+
+type ValidationErrors []ValidationError
+
+func (self ValidationErrors) Error() string {
+	messages := make([]string, len(self))
+	for i, err := range self {
+		messages[i] = err.Error()
+	}
+	return "invalid manifest: " + strings.Join(messages, "; ")
+}
+
+func (self *ValidationErrors) add(field, format string, args ...any) {
+	*self = append(*self, ValidationError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+func ValidateAppName(app string) error {
+	if !appNameRegex.MatchString(app) {
+		return fmt.Errorf("app name %q must match %s", app, appNameRegex.String())
+	}
+	return nil
+}
+
+func ValidateEnvName(name string) error {
+	if !envNameRegex.MatchString(name) {
+		return fmt.Errorf("env name %q must match %s", name, envNameRegex.String())
+	}
+	return nil
+}
+
+func ValidateSecretName(name string) error {
+	if !secretNameRegex.MatchString(name) {
+		return fmt.Errorf("secret name %q must match %s", name, secretNameRegex.String())
+	}
+	return nil
+}
+
+// ValidateRelativePath accepts slash separated path staying inside of its root
+func ValidateRelativePath(path string) error {
+	if path == "" || strings.HasPrefix(path, "/") || strings.Contains(path, "\\") || strings.Contains(path, "\x00") {
+		return fmt.Errorf("path %q must be relative", path)
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("path %q must not contain empty, '.' or '..' parts", path)
+		}
+	}
+	return nil
+}
+
+// Validate checks whole manifest and returns ValidationErrors with all problems found
+func (self *Manifest) Validate() error {
+	errs := ValidationErrors{}
+
+	if self.App == "" {
+		errs.add("app", "is required")
+	} else if err := ValidateAppName(self.App); err != nil {
+		errs.add("app", "%s", err.Error())
+	}
+
+	if self.Version == "" {
+		errs.add("version", "is required")
+	}
+
+	if self.Command == "" {
+		errs.add("command", "is required")
+	} else if strings.Contains(self.Command, "..") {
+		errs.add("command", "must not contain '..'")
+	}
+
+	for key := range self.Env {
+		if !envNameRegex.MatchString(key) {
+			errs.add(fmt.Sprintf("env.%s", key), "is not a valid environment variable name")
+		}
+	}
+
+	portNames := map[string]bool{}
+	// tcp and udp port with the same number don't conflict
+	portNumbers := map[string]bool{}
+
+	for i, port := range self.Ports {
+		field := fmt.Sprintf("ports[%d]", i)
+
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		slot := fmt.Sprintf("%s/%d", protocol, port.Port)
+
+		// 0 means port is allocated for every replica when it starts
+		if port.Port < 0 || port.Port > 65535 {
+			errs.add(field+".port", "must be between 1 and 65535, or 0 for automatic port")
+		} else if port.Port > 0 && portNumbers[slot] {
+			errs.add(field+".port", "duplicate %s port %d", protocol, port.Port)
+		}
+		portNumbers[slot] = true
+
+		if port.Name != "" {
+			if !portNameRegex.MatchString(port.Name) {
+				errs.add(field+".name", "must start with a letter and contain only letters, digits, '_' and '-'")
+			} else if portNames[port.Name] {
+				errs.add(field+".name", "duplicate port name %q", port.Name)
+			}
+			portNames[port.Name] = true
+		}
+
+		if port.Protocol != "" && port.Protocol != "tcp" && port.Protocol != "udp" {
+			errs.add(field+".protocol", "must be tcp or udp")
+		}
+	}
+
+	probes := []struct {
+		field string
+		check *HealthCheck
+	}{
+		{"livenessProbe", self.LivenessProbe},
+		{"readinessProbe", self.ReadinessProbe},
+		{"healthCheck", self.HealthCheck},
+	}
+
+	for _, probe := range probes {
+		if probe.check == nil || (probe.field == "healthCheck" && probe.check == self.ReadinessProbe) {
+			continue
+		}
+		probe.check.validate(probe.field, &errs)
+
+		if probe.check.Type == HEALTH_CHECK_HTTP || probe.check.Type == HEALTH_CHECK_TCP {
+			if probe.check.PortName != "" && !self.hasPort(probe.check.PortName) {
+				errs.add(probe.field+".portName", "port %q is not declared in ports", probe.check.PortName)
+			} else if probe.check.PortName == "" && probe.check.Port == 0 && len(self.Ports) == 0 {
+				errs.add(probe.field+".port", "is required when app has no ports")
+			}
+		}
+	}
+
+	switch self.RestartPolicy {
+	case "", RESTART_ALWAYS, RESTART_ON_FAILURE, RESTART_NEVER:
+	default:
+		errs.add("restartPolicy", "must be one of %s, %s, %s", RESTART_ALWAYS, RESTART_ON_FAILURE, RESTART_NEVER)
+	}
+
+	if self.Resources.Cpu < 0 {
+		errs.add("resources.cpu", "must not be negative")
+	}
+	if self.Resources.MemoryMb < 0 {
+		errs.add("resources.memoryMb", "must not be negative")
+	}
+	if self.Resources.MaxPids < 0 {
+		errs.add("resources.maxPids", "must not be negative")
+	}
+
+	if self.Placement.Replicas < 0 {
+		errs.add("placement.replicas", "must not be negative")
+	}
+
+	switch self.Placement.Spread {
+	case "", SPREAD_NONE, SPREAD_PREFER, SPREAD_REQUIRE:
+	default:
+		errs.add("placement.spread", "must be one of %s, %s, %s", SPREAD_NONE, SPREAD_PREFER, SPREAD_REQUIRE)
+	}
+
+	switch self.Kind {
+	case "", KIND_SERVICE:
+		if self.Job != nil {
+			errs.add("job", "is allowed only for %s and %s kinds", KIND_JOB, KIND_CRONJOB)
+		}
+	case KIND_JOB, KIND_CRONJOB:
+		if self.Job != nil {
+			self.Job.validate(self.Kind, "job", &errs)
+		} else if self.Kind == KIND_CRONJOB {
+			errs.add("job.schedule", "is required for %s", KIND_CRONJOB)
+		}
+	default:
+		errs.add("kind", "must be one of %s, %s, %s", KIND_SERVICE, KIND_JOB, KIND_CRONJOB)
+	}
+
+	secretEnvs := map[string]bool{}
+	secretFiles := map[string]bool{}
+
+	for i, ref := range self.Secrets {
+		field := fmt.Sprintf("secrets[%d]", i)
+
+		if err := ValidateSecretName(ref.Name); err != nil {
+			errs.add(field+".name", "%s", err.Error())
+		}
+
+		if ref.Env == "" && ref.File == "" {
+			errs.add(field, "env or file is required")
+		}
+
+		if ref.Env != "" {
+			if !envNameRegex.MatchString(ref.Env) {
+				errs.add(field+".env", "is not a valid environment variable name")
+			} else if secretEnvs[ref.Env] {
+				errs.add(field+".env", "duplicate env %s", ref.Env)
+			} else if _, ok := self.Env[ref.Env]; ok {
+				errs.add(field+".env", "%s is already set in env", ref.Env)
+			}
+			secretEnvs[ref.Env] = true
+		}
+
+		if ref.File != "" {
+			if err := ValidateRelativePath(ref.File); err != nil {
+				errs.add(field+".file", "%s", err.Error())
+			} else if secretFiles[ref.File] {
+				errs.add(field+".file", "duplicate file %s", ref.File)
+			}
+			secretFiles[ref.File] = true
+		}
+	}
+
+	templateTargets := map[string]bool{}
+
+	for i, template := range self.Templates {
+		field := fmt.Sprintf("templates[%d]", i)
+
+		if err := ValidateRelativePath(template.Source); err != nil {
+			errs.add(field+".source", "%s", err.Error())
+		}
+
+		if err := ValidateRelativePath(template.Target); err != nil {
+			errs.add(field+".target", "%s", err.Error())
+		} else if templateTargets[template.Target] {
+			errs.add(field+".target", "duplicate target %s", template.Target)
+		} else if template.Target == template.Source {
+			errs.add(field+".target", "must differ from source")
+		}
+		templateTargets[template.Target] = true
+
+		for j, name := range template.Secrets {
+			if err := ValidateSecretName(name); err != nil {
+				errs.add(fmt.Sprintf("%s.secrets[%d]", field, j), "%s", err.Error())
+			}
+		}
+	}
+
+	switch self.Update.Type {
+	case "", STRATEGY_ROLLING, STRATEGY_RECREATE, STRATEGY_BLUE_GREEN, STRATEGY_CANARY:
+	default:
+		errs.add("update.type", "must be one of %s, %s, %s, %s", STRATEGY_ROLLING, STRATEGY_RECREATE, STRATEGY_BLUE_GREEN, STRATEGY_CANARY)
+	}
+	if self.Update.Canary != nil {
+		self.Update.Canary.validate("update.canary", &errs)
+	}
+	if self.Update.MaxSurge < 0 {
+		errs.add("update.maxSurge", "must not be negative")
+	}
+	if self.Update.MaxUnavailable < 0 {
+		errs.add("update.maxUnavailable", "must not be negative")
+	}
+	if self.Update.ReadyTimeoutSeconds < 0 {
+		errs.add("update.readyTimeoutSeconds", "must not be negative")
+	}
+
+	// Fixed port is bound by one replica of a node, rolling update then runs without
+	// surge and green replicas of blueGreen and canary get allocated ports
+	if port, ok := self.fixedPort(); ok && !self.IsJob() && self.Placement.Replicas > 1 && self.Placement.Spread != SPREAD_REQUIRE {
+		errs.add("placement.replicas", "must be 1 with fixed port %d unless spread is %s, use port 0 to allocate port for every replica", port, SPREAD_REQUIRE)
+	}
+
+	if len(self.Routes) > 0 && self.IsJob() {
+		errs.add("routes", "are allowed only for %s kind", KIND_SERVICE)
+	}
+
+	routeKeys := map[string]bool{}
+
+	for i := range self.Routes {
+		route := &self.Routes[i]
+		field := fmt.Sprintf("routes[%d]", i)
+
+		route.validate(field, &errs)
+
+		if !self.hasPort(route.Port) {
+			if route.Port == "" {
+				errs.add(field+".port", "app has no ports")
+			} else {
+				errs.add(field+".port", "port %q is not declared in ports", route.Port)
+			}
+		}
+
+		key := route.Host + route.PathPrefix
+		if routeKeys[key] {
+			errs.add(field, "duplicate route %s", key)
+		}
+		routeKeys[key] = true
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// fixedPort returns the first port with a fixed number
+func (self *Manifest) fixedPort() (int, bool) {
+	for _, port := range self.Ports {
+		if port.Port > 0 {
+			return port.Port, true
+		}
+	}
+	return 0, false
+}
+
+// HasFixedPorts tells that replicas can't run side by side on one node
+func (self *Manifest) HasFixedPorts() bool {
+	_, ok := self.fixedPort()
+	return ok
+}
+
+// hasPort tells if key is name of a port or index of unnamed port, empty key means the first port
+func (self *Manifest) hasPort(key string) bool {
+	if key == "" {
+		return len(self.Ports) > 0
+	}
+	for i, port := range self.Ports {
+		if port.Name == key || (port.Name == "" && strconv.Itoa(i) == key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateRoute checks route that does not come from a manifest
+func ValidateRoute(route *Route) error {
+	errs := ValidationErrors{}
+
+	route.validate("route", &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (self *Route) validate(field string, errs *ValidationErrors) {
+	if self.Host != "" && !hostRegex.MatchString(self.Host) {
+		errs.add(field+".host", "must be lowercase host name without port, optionally starting with '*.'")
+	}
+
+	if !strings.HasPrefix(self.PathPrefix, "/") {
+		errs.add(field+".pathPrefix", "must start with /")
+	} else if strings.ContainsAny(self.PathPrefix, "?# \x00") {
+		errs.add(field+".pathPrefix", "must be a plain path")
+	} else if strings.Contains(self.PathPrefix, "/../") || strings.HasSuffix(self.PathPrefix, "/..") {
+		errs.add(field+".pathPrefix", "must not contain '..' parts")
+	}
+
+	if self.TimeoutSeconds < 0 {
+		errs.add(field+".timeoutSeconds", "must not be negative")
+	}
+}
+
+func (self *HealthCheck) validate(field string, errs *ValidationErrors) {
+	switch self.Type {
+	case HEALTH_CHECK_HTTP:
+		if !strings.HasPrefix(self.Path, "/") {
+			errs.add(field+".path", "must start with /")
+		}
+		if self.Port < 0 || self.Port > 65535 {
+			errs.add(field+".port", "must be between 1 and 65535")
+		}
+	case HEALTH_CHECK_TCP:
+		if self.Port < 0 || self.Port > 65535 {
+			errs.add(field+".port", "must be between 1 and 65535")
+		}
+	case HEALTH_CHECK_EXEC:
+		if len(self.Command) == 0 {
+			errs.add(field+".command", "is required for exec health check")
+		}
+	case "":
+		errs.add(field+".type", "is required")
+	default:
+		errs.add(field+".type", "must be one of %s, %s, %s", HEALTH_CHECK_HTTP, HEALTH_CHECK_TCP, HEALTH_CHECK_EXEC)
+	}
+
+	if self.IntervalSeconds < 0 {
+		errs.add(field+".intervalSeconds", "must not be negative")
+	}
+	if self.TimeoutSeconds < 0 {
+		errs.add(field+".timeoutSeconds", "must not be negative")
+	}
+	if self.FailureThreshold < 0 {
+		errs.add(field+".failureThreshold", "must not be negative")
+	}
+	if self.SuccessThreshold < 0 {
+		errs.add(field+".successThreshold", "must not be negative")
+	}
+	if self.InitialDelaySeconds < 0 {
+		errs.add(field+".initialDelaySeconds", "must not be negative")
+	}
+}
+
+func (self *CanaryStrategy) validate(field string, errs *ValidationErrors) {
+	previous := 0
+	for i, step := range self.Steps {
+		if step <= previous || step > 100 {
+			errs.add(fmt.Sprintf("%s.steps[%d]", field, i), "must be growing percent between 1 and 100")
+		}
+		previous = step
+	}
+
+	if self.StepSeconds < 0 {
+		errs.add(field+".stepSeconds", "must not be negative")
+	}
+	if self.MaxErrorRate < 0 || self.MaxErrorRate > 1 {
+		errs.add(field+".maxErrorRate", "must be between 0 and 1")
+	}
+	if self.MinRequests < 0 {
+		errs.add(field+".minRequests", "must not be negative")
+	}
+}
+
+func (self *JobSpec) validate(kind, field string, errs *ValidationErrors) {
+	if self.Retries < 0 {
+		errs.add(field+".retries", "must not be negative")
+	}
+	if self.DeadlineSeconds < 0 {
+		errs.add(field+".deadlineSeconds", "must not be negative")
+	}
+	if self.HistoryLimit < 0 {
+		errs.add(field+".historyLimit", "must not be negative")
+	}
+
+	if kind != KIND_CRONJOB {
+		if self.Schedule != "" {
+			errs.add(field+".schedule", "is allowed only for %s", KIND_CRONJOB)
+		}
+		return
+	}
+
+	if self.Schedule == "" {
+		errs.add(field+".schedule", "is required for %s", KIND_CRONJOB)
+	} else if _, err := cron.Parse(self.Schedule); err != nil {
+		errs.add(field+".schedule", "%s", err.Error())
+	}
+
+	switch self.ConcurrencyPolicy {
+	case "", CONCURRENCY_ALLOW, CONCURRENCY_FORBID, CONCURRENCY_REPLACE:
+	default:
+		errs.add(field+".concurrencyPolicy", "must be one of %s, %s, %s", CONCURRENCY_ALLOW, CONCURRENCY_FORBID, CONCURRENCY_REPLACE)
+	}
+}
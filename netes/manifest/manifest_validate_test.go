@@ -0,0 +1,158 @@
+package manifest
+
+import (
+	"errors"
+	"testing"
+)
+
+func validManifest() *Manifest {
+	return &Manifest{
+		App:     "shop-api",
+		Version: "1.0.0",
+		Command: "./server",
+		Env:     map[string]string{"MODE": "prod"},
+		Ports:   []Port{{Name: "http"}},
+	}
+}
+
+func TestManifestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(*Manifest)
+		// Field of the expected error, empty when manifest is valid
+		field string
+	}{
+		{"valid", func(m *Manifest) {}, ""},
+		{"missing app", func(m *Manifest) { m.App = "" }, "app"},
+		{"invalid app name", func(m *Manifest) { m.App = "Shop API" }, "app"},
+		{"missing version", func(m *Manifest) { m.Version = "" }, "version"},
+		{"missing command", func(m *Manifest) { m.Command = "" }, "command"},
+		{"command leaving package", func(m *Manifest) { m.Command = "../bin/server" }, "command"},
+		{"invalid env name", func(m *Manifest) { m.Env["1BAD"] = "x" }, "env.1BAD"},
+		{"port out of range", func(m *Manifest) { m.Ports[0].Port = 70000 }, "ports[0].port"},
+		{"duplicate port", func(m *Manifest) { m.Ports = []Port{{Port: 8080}, {Port: 8080}} }, "ports[1].port"},
+		{"duplicate port of default protocol", func(m *Manifest) { m.Ports = []Port{{Port: 53}, {Port: 53, Protocol: "tcp"}} }, "ports[1].port"},
+		{"same port for tcp and udp", func(m *Manifest) { m.Ports = []Port{{Port: 53}, {Port: 53, Protocol: "udp"}} }, ""},
+		{"duplicate port name", func(m *Manifest) { m.Ports = append(m.Ports, Port{Name: "http"}) }, "ports[1].name"},
+		{"invalid port name", func(m *Manifest) { m.Ports[0].Name = "1http" }, "ports[0].name"},
+		{"invalid protocol", func(m *Manifest) { m.Ports[0].Protocol = "sctp" }, "ports[0].protocol"},
+		{"fixed port with replicas", func(m *Manifest) {
+			m.Ports[0].Port = 8080
+			m.Placement.Replicas = 3
+		}, "placement.replicas"},
+		{"fixed port with replicas spread over nodes", func(m *Manifest) {
+			m.Ports[0].Port = 8080
+			m.Placement.Replicas = 3
+			m.Placement.Spread = SPREAD_REQUIRE
+		}, ""},
+		{"allocated ports with replicas", func(m *Manifest) { m.Placement.Replicas = 3 }, ""},
+		{"probe without type", func(m *Manifest) { m.LivenessProbe = &HealthCheck{} }, "livenessProbe.type"},
+		{"http probe path", func(m *Manifest) {
+			m.ReadinessProbe = &HealthCheck{Type: HEALTH_CHECK_HTTP, Path: "health"}
+		}, "readinessProbe.path"},
+		{"probe of unknown port", func(m *Manifest) {
+			m.ReadinessProbe = &HealthCheck{Type: HEALTH_CHECK_TCP, PortName: "admin"}
+		}, "readinessProbe.portName"},
+		{"probe without ports", func(m *Manifest) {
+			m.Ports = nil
+			m.LivenessProbe = &HealthCheck{Type: HEALTH_CHECK_TCP}
+		}, "livenessProbe.port"},
+		{"exec probe without command", func(m *Manifest) {
+			m.LivenessProbe = &HealthCheck{Type: HEALTH_CHECK_EXEC}
+		}, "livenessProbe.command"},
+		{"unknown restart policy", func(m *Manifest) { m.RestartPolicy = "sometimes" }, "restartPolicy"},
+		{"negative cpu", func(m *Manifest) { m.Resources.Cpu = -1 }, "resources.cpu"},
+		{"negative replicas", func(m *Manifest) { m.Placement.Replicas = -1 }, "placement.replicas"},
+		{"unknown spread", func(m *Manifest) { m.Placement.Spread = "everywhere" }, "placement.spread"},
+		{"unknown kind", func(m *Manifest) { m.Kind = "daemon" }, "kind"},
+		{"job spec of service", func(m *Manifest) { m.Job = &JobSpec{} }, "job"},
+		{"cronjob without schedule", func(m *Manifest) { m.Kind = KIND_CRONJOB }, "job.schedule"},
+		{"cronjob with invalid schedule", func(m *Manifest) {
+			m.Kind = KIND_CRONJOB
+			m.Job = &JobSpec{Schedule: "every day"}
+		}, "job.schedule"},
+		{"schedule of job", func(m *Manifest) {
+			m.Kind = KIND_JOB
+			m.Job = &JobSpec{Schedule: "@daily"}
+		}, "job.schedule"},
+		{"cronjob", func(m *Manifest) {
+			m.Kind = KIND_CRONJOB
+			m.Job = &JobSpec{Schedule: "*/5 * * * *", ConcurrencyPolicy: CONCURRENCY_FORBID}
+		}, ""},
+		{"secret without env or file", func(m *Manifest) { m.Secrets = []SecretRef{{Name: "db"}} }, "secrets[0]"},
+		{"secret env set in env", func(m *Manifest) {
+			m.Secrets = []SecretRef{{Name: "db", Env: "MODE"}}
+		}, "secrets[0].env"},
+		{"secret file leaving dir", func(m *Manifest) {
+			m.Secrets = []SecretRef{{Name: "db", File: "../db"}}
+		}, "secrets[0].file"},
+		{"template target equal to source", func(m *Manifest) {
+			m.Templates = []Template{{Source: "app.conf", Target: "app.conf"}}
+		}, "templates[0].target"},
+		{"template secret name", func(m *Manifest) {
+			m.Templates = []Template{{Source: "app.tmpl", Target: "app.conf", Secrets: []string{"bad name"}}}
+		}, "templates[0].secrets[0]"},
+		{"unknown update type", func(m *Manifest) { m.Update.Type = "instant" }, "update.type"},
+		{"negative surge", func(m *Manifest) { m.Update.MaxSurge = -1 }, "update.maxSurge"},
+		{"canary steps not growing", func(m *Manifest) {
+			m.Update = UpdateStrategy{Type: STRATEGY_CANARY, Canary: &CanaryStrategy{Steps: []int{50, 20}}}
+		}, "update.canary.steps[1]"},
+		{"route of job", func(m *Manifest) {
+			m.Kind = KIND_JOB
+			m.Routes = []Route{{Host: "shop.example.com"}}
+		}, "routes"},
+		{"route host with port", func(m *Manifest) { m.Routes = []Route{{Host: "shop.example.com:80"}} }, "routes[0].host"},
+		{"route of unknown port", func(m *Manifest) { m.Routes = []Route{{Port: "admin"}} }, "routes[0].port"},
+		{"route path prefix", func(m *Manifest) { m.Routes = []Route{{PathPrefix: "/api/../admin"}} }, "routes[0].pathPrefix"},
+		{"duplicate route", func(m *Manifest) {
+			m.Routes = []Route{{Host: "*.example.com", PathPrefix: "/api"}, {Host: "*.example.com", PathPrefix: "/api"}}
+		}, "routes[1]"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			appManifest := validManifest()
+			test.modify(appManifest)
+			appManifest.ApplyDefaults()
+
+			err := appManifest.Validate()
+
+			if test.field == "" {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want no error", err)
+				}
+				return
+			}
+
+			var errs ValidationErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate() = %v, want ValidationErrors", err)
+			}
+			for _, fieldErr := range errs {
+				if fieldErr.Field == test.field {
+					return
+				}
+			}
+			t.Fatalf("Validate() = %v, want error of field %s", err, test.field)
+		})
+	}
+}
+
+func TestParseRejectsUnknownFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		data     string
+	}{
+		{"yaml", "turtle.yaml", "app: shop\nversion: '1'\ncommand: ./server\nreplicas: 2\n"},
+		{"json", "turtle.json", `{"app": "shop", "version": "1", "command": "./server", "replicas": 2}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Parse(test.fileName, []byte(test.data)); err == nil {
+				t.Fatalf("Parse(%s) accepted unknown field", test.fileName)
+			}
+		})
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package nodeInfo
+
+// readDisk has no statfs here, disk is reported without sizes
+func readDisk(path string) DiskInfo {
+	return DiskInfo{
+		Path: path,
+	}
+}
@@ -0,0 +1,35 @@
+//go:build linux || darwin || freebsd
+
+package nodeInfo
+
+import (
+	"os"
+	"syscall"
+)
+
+func readDisk(path string) DiskInfo {
+	result := DiskInfo{
+		Path: path,
+	}
+
+	// Deploy folder may not exist before first deployment, measure working dir then
+	if _, err := os.Stat(path); err != nil {
+		path = "."
+	}
+
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return result
+	}
+
+	result.TotalBytes = uint64(stat.Blocks) * uint64(stat.Bsize)
+	// Field types differ between platforms, Bavail is signed on freebsd
+	result.FreeBytes = uint64(stat.Bavail) * uint64(stat.Bsize)
+
+	if result.TotalBytes > result.FreeBytes {
+		result.UsedBytes = result.TotalBytes - result.FreeBytes
+	}
+
+	return result
+}
@@ -0,0 +1,74 @@
+package nodeInfo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+)
+
+var heartbeatClient = &http.Client{Timeout: 10 * time.Second}
+
+// StartHeartbeat periodically posts node info to controller, used in agent mode
+func StartHeartbeat() {
+	config := serverKit.SERVER_CONFIG
+
+	if config.ControllerUrl == "" {
+		lgr.Error("Agent mode requires controllerUrl in ginconfig.json, heartbeat disabled")
+		return
+	}
+
+	lgr.Info("Sending heartbeat to %s every %s", config.ControllerUrl, config.GetHeartbeatInterval())
+
+	go func() {
+		ticker := time.NewTicker(config.GetHeartbeatInterval())
+		defer ticker.Stop()
+
+		for {
+			tools.SafeGoRoutine(func() {
+				if err := SendHeartbeat(); err != nil {
+					lgr.Error("Heartbeat to controller failed: %s", err.Error())
+				}
+			})
+			<-ticker.C
+		}
+	}()
+}
+
+func SendHeartbeat() error {
+	config := serverKit.SERVER_CONFIG
+
+	body, err := json.Marshal(Collect())
+	if err != nil {
+		return err
+	}
+
+	url := strings.TrimSuffix(config.ControllerUrl, "/") + "/deplistener/info"
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Api-Key", config.ControllerApiKey)
+
+	resp, err := heartbeatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("controller responded %d: %s", resp.StatusCode, string(message))
+	}
+
+	return nil
+}
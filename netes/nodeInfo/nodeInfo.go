@@ -0,0 +1,92 @@
+package nodeInfo
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"time"
+	"turtle/core/serverKit"
+	"turtle/netes/jobs"
+	"turtle/netes/supervisor"
+)
+
+// Overridden at build time with -ldflags "-X turtle/netes/nodeInfo.VERSION=..."
+var VERSION = "0.1.0"
+
+var PROC_DIR = "/proc"
+
+var listenerStartedAt = time.Now()
+
+type NodeInfo struct {
+	Node                  string                     `json:"node" bson:"node"`
+	Url                   string                     `json:"url" bson:"url"`
+	Labels                map[string]string          `json:"labels" bson:"labels"`
+	Hostname              string                     `json:"hostname" bson:"hostname"`
+	Os                    string                     `json:"os" bson:"os"`
+	Arch                  string                     `json:"arch" bson:"arch"`
+	Kernel                string                     `json:"kernel" bson:"kernel"`
+	Version               string                     `json:"version" bson:"version"`
+	UptimeSeconds         float64                    `json:"uptimeSeconds" bson:"uptimeSeconds"`
+	ListenerUptimeSeconds float64                    `json:"listenerUptimeSeconds" bson:"listenerUptimeSeconds"`
+	Cpu                   CpuInfo                    `json:"cpu" bson:"cpu"`
+	Memory                MemoryInfo                 `json:"memory" bson:"memory"`
+	Disk                  DiskInfo                   `json:"disk" bson:"disk"`
+	Apps                  []supervisor.ProcessStatus `json:"apps" bson:"apps"`
+	Jobs                  []jobs.JobStatus           `json:"jobs" bson:"jobs"`
+	CollectedAt           time.Time                  `json:"collectedAt" bson:"collectedAt"`
+}
+
+type CpuInfo struct {
+	Count  int     `json:"count" bson:"count"`
+	Load1  float64 `json:"load1" bson:"load1"`
+	Load5  float64 `json:"load5" bson:"load5"`
+	Load15 float64 `json:"load15" bson:"load15"`
+}
+
+type MemoryInfo struct {
+	TotalBytes     uint64 `json:"totalBytes" bson:"totalBytes"`
+	AvailableBytes uint64 `json:"availableBytes" bson:"availableBytes"`
+	UsedBytes      uint64 `json:"usedBytes" bson:"usedBytes"`
+}
+
+type DiskInfo struct {
+	Path       string `json:"path" bson:"path"`
+	TotalBytes uint64 `json:"totalBytes" bson:"totalBytes"`
+	FreeBytes  uint64 `json:"freeBytes" bson:"freeBytes"`
+	UsedBytes  uint64 `json:"usedBytes" bson:"usedBytes"`
+}
+
+// Collect gathers information about this node, missing /proc values stay zero.
+// Services are listed in apps with their replicas, job and cronjob apps in jobs.
+func Collect() *NodeInfo {
+	hostname, _ := os.Hostname()
+
+	info := &NodeInfo{
+		Node:                  serverKit.SERVER_CONFIG.GetNodeName(),
+		Url:                   serverKit.SERVER_CONFIG.GetNodeUrl(),
+		Labels:                serverKit.SERVER_CONFIG.NodeLabels,
+		Hostname:              hostname,
+		Os:                    runtime.GOOS,
+		Arch:                  runtime.GOARCH,
+		Kernel:                readKernel(),
+		Version:               VERSION,
+		UptimeSeconds:         readUptime(),
+		ListenerUptimeSeconds: time.Since(listenerStartedAt).Seconds(),
+		Cpu:                   readCpu(),
+		Memory:                readMemory(),
+		Disk:                  readDisk(serverKit.SERVER_CONFIG.GetDeployDir()),
+		Apps:                  supervisor.SUPERVISOR.List(),
+		Jobs:                  jobs.JOBS.List(),
+		CollectedAt:           time.Now(),
+	}
+
+	return info
+}
+
+func readProcFile(name string) string {
+	data, err := os.ReadFile(PROC_DIR + "/" + name)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
@@ -0,0 +1,79 @@
+package nodeInfo
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+func readKernel() string {
+	return readProcFile("sys/kernel/osrelease")
+}
+
+// /proc/uptime: "350735.47 234388.90"
+func readUptime() float64 {
+	fields := strings.Fields(readProcFile("uptime"))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	uptime, _ := strconv.ParseFloat(fields[0], 64)
+	return uptime
+}
+
+// /proc/loadavg: "0.20 0.18 0.12 1/80 11206"
+func readCpu() CpuInfo {
+	result := CpuInfo{
+		Count: runtime.NumCPU(),
+	}
+
+	fields := strings.Fields(readProcFile("loadavg"))
+	if len(fields) < 3 {
+		return result
+	}
+
+	result.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	result.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	result.Load15, _ = strconv.ParseFloat(fields[2], 64)
+
+	return result
+}
+
+// /proc/meminfo lines: "MemTotal:       16384256 kB"
+func readMemory() MemoryInfo {
+	values := map[string]uint64{}
+
+	for _, line := range strings.Split(readProcFile("meminfo"), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		value, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		if len(fields) > 2 && fields[2] == "kB" {
+			value *= 1024
+		}
+
+		values[strings.TrimSuffix(fields[0], ":")] = value
+	}
+
+	result := MemoryInfo{
+		TotalBytes:     values["MemTotal"],
+		AvailableBytes: values["MemAvailable"],
+	}
+
+	// Kernels older than 3.14 have no MemAvailable
+	if _, ok := values["MemAvailable"]; !ok {
+		result.AvailableBytes = values["MemFree"] + values["Buffers"] + values["Cached"]
+	}
+
+	if result.TotalBytes > result.AvailableBytes {
+		result.UsedBytes = result.TotalBytes - result.AvailableBytes
+	}
+
+	return result
+}
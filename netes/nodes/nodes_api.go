@@ -0,0 +1,57 @@
+package nodes
+
+import (
+	"errors"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /api/nodes
+*/
+func _ListNodes(c *gin.Context) {
+	result, err := ListNodes(c.Request.Context())
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, result)
+}
+
+/*
+GET /api/nodes/get?name=
+*/
+func _GetNode(c *gin.Context) {
+	node, err := GetNode(c.Request.Context(), c.Query("name"))
+	returnNode(c, node, err)
+}
+
+/*
+DELETE /api/nodes?name=
+*/
+func _DeleteNode(c *gin.Context) {
+	err := DeleteNode(c.Request.Context(), c.Query("name"))
+	returnNode(c, nil, err)
+}
+
+func returnNode(c *gin.Context, node *Node, err error) {
+	if errors.Is(err, ErrNodeNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else if node == nil {
+		serverKit.ReturnOkJson(c, gin.H{"status": "ok"})
+	} else {
+		serverKit.ReturnOkJson(c, node)
+	}
+}
+
+func InitNodesApi(r *gin.Engine) {
+	r.GET("/api/nodes", auth.ApiKeysRequired, _ListNodes)
+	r.GET("/api/nodes/get", auth.ApiKeysRequired, _GetNode)
+	r.DELETE("/api/nodes", auth.ApiKeysRequired, _DeleteNode)
+}
@@ -0,0 +1,178 @@
+package nodes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/core/tools"
+	"turtle/netes/nodeInfo"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const NODES_COLLECTION = "nodes"
+
+const (
+	NODE_READY     = "Ready"
+	NODE_NOT_READY = "NotReady"
+	NODE_LOST      = "Lost"
+)
+
+// Node is NotReady after this many missed heartbeats and Lost after LOST_AFTER_MISSED
+const (
+	NOT_READY_AFTER_MISSED = 3
+	LOST_AFTER_MISSED      = 10
+)
+
+var ErrNodeNotFound = errors.New("node not found")
+
+// Node is controller's record about one registered listener
+type Node struct {
+	Uid          primitive.ObjectID `json:"uid" bson:"_id"`
+	Name         string             `json:"name" bson:"name"`
+	Url          string             `json:"url" bson:"url"`
+	Status       string             `json:"status" bson:"status"`
+	RegisteredBy string             `json:"registeredBy" bson:"registeredBy"`
+	RegisteredAt time.Time          `json:"registeredAt" bson:"registeredAt"`
+	LastSeen     time.Time          `json:"lastSeen" bson:"lastSeen"`
+	Info         nodeInfo.NodeInfo  `json:"info" bson:"info"`
+}
+
+func nodesRepo() *dbclient.Repository[Node] {
+	return dbclient.NewRepository[Node](dbclient.MongoClient, NODES_COLLECTION)
+}
+
+func nodeUid(name string) primitive.ObjectID {
+	return tools.StringToObjectID("node/" + name)
+}
+
+// RegisterHeartbeat creates or refreshes node from info posted by agent
+func RegisterHeartbeat(ctx context.Context, info *nodeInfo.NodeInfo, user string) (*Node, error) {
+	if info.Node == "" {
+		return nil, fmt.Errorf("node name is required")
+	}
+	if info.Url == "" {
+		return nil, fmt.Errorf("node url is required")
+	}
+
+	now := time.Now()
+	uid := nodeUid(info.Node)
+
+	collection, err := nodesRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = collection.UpdateOne(
+		ctx,
+		bson.M{"_id": uid},
+		bson.M{
+			"$set": bson.M{
+				"name":     info.Node,
+				"url":      info.Url,
+				"status":   NODE_READY,
+				"lastSeen": now,
+				"info":     info,
+			},
+			"$setOnInsert": bson.M{
+				"registeredBy": user,
+				"registeredAt": now,
+			},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register node: %w", err)
+	}
+
+	return nodesRepo().FindByID(ctx, uid)
+}
+
+func ListNodes(ctx context.Context) ([]Node, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	return nodesRepo().FindMany(ctx, bson.M{}, opts)
+}
+
+// ListReadyNodes returns nodes which can receive deployments
+func ListReadyNodes(ctx context.Context) ([]Node, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "name", Value: 1}})
+	return nodesRepo().FindMany(ctx, bson.M{"status": NODE_READY}, opts)
+}
+
+func GetNode(ctx context.Context, name string) (*Node, error) {
+	node, err := nodesRepo().FindByID(ctx, nodeUid(name))
+	if err != nil {
+		return nil, err
+	}
+	if node == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNodeNotFound, name)
+	}
+	return node, nil
+}
+
+func DeleteNode(ctx context.Context, name string) error {
+	deleted, err := nodesRepo().DeleteByID(ctx, nodeUid(name))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrNodeNotFound, name)
+	}
+	return nil
+}
+
+// MarkStaleNodes moves nodes with missed heartbeats to NotReady or Lost
+func MarkStaleNodes(ctx context.Context) {
+	if !dbclient.IsConnected() {
+		return
+	}
+
+	interval := serverKit.SERVER_CONFIG.GetHeartbeatInterval()
+	now := time.Now()
+
+	lost, err := nodesRepo().UpdateMany(ctx,
+		bson.M{
+			"status":   bson.M{"$ne": NODE_LOST},
+			"lastSeen": bson.M{"$lt": now.Add(-LOST_AFTER_MISSED * interval)},
+		},
+		bson.M{"$set": bson.M{"status": NODE_LOST}},
+	)
+	if err != nil {
+		lgr.Error("Failed to mark lost nodes: %s", err.Error())
+	}
+
+	notReady, err := nodesRepo().UpdateMany(ctx,
+		bson.M{
+			"status":   NODE_READY,
+			"lastSeen": bson.M{"$lt": now.Add(-NOT_READY_AFTER_MISSED * interval)},
+		},
+		bson.M{"$set": bson.M{"status": NODE_NOT_READY}},
+	)
+	if err != nil {
+		lgr.Error("Failed to mark not ready nodes: %s", err.Error())
+	}
+
+	if lost > 0 || notReady > 0 {
+		lgr.Error("Missed heartbeats: %d nodes NotReady, %d nodes Lost", notReady, lost)
+	}
+}
+
+// StartNodeMonitor periodically checks heartbeats, used in controller mode
+func StartNodeMonitor() {
+	go func() {
+		ticker := time.NewTicker(serverKit.SERVER_CONFIG.GetHeartbeatInterval())
+		defer ticker.Stop()
+
+		for range ticker.C {
+			tools.SafeGoRoutine(func() {
+				MarkStaleNodes(context.Background())
+			})
+		}
+	}()
+}
@@ -0,0 +1,155 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"turtle/netes/manifest"
+)
+
+// BinPackScheduler places each replica on the fitting node with the least
+// resources left, so whole nodes stay free for big deployments. Spread
+// preference is applied before bin-packing.
+type BinPackScheduler struct{}
+
+func (self *BinPackScheduler) Name() string {
+	return "binpack"
+}
+
+type binPackNode struct {
+	candidate NodeCandidate
+	freeCpu   float64
+	freeMem   int64
+	replicas  int
+}
+
+func (self *BinPackScheduler) Schedule(req PlacementRequest, candidates []NodeCandidate) (*Placement, error) {
+	if req.Replicas <= 0 {
+		req.Replicas = 1
+	}
+
+	rejections := []NodeRejection{}
+	eligible := []*binPackNode{}
+
+	for _, candidate := range candidates {
+		if reasons := MatchesSelector(candidate.Labels, req.NodeSelector); len(reasons) > 0 {
+			rejections = append(rejections, NodeRejection{Node: candidate.Name, Reasons: reasons})
+			continue
+		}
+
+		eligible = append(eligible, &binPackNode{
+			candidate: candidate,
+			freeCpu:   candidate.FreeCpu,
+			freeMem:   candidate.FreeMemoryMb,
+		})
+	}
+
+	// Stable order so same input gives same placement
+	sort.Slice(eligible, func(i, j int) bool {
+		return eligible[i].candidate.Name < eligible[j].candidate.Name
+	})
+
+	placed := 0
+
+	for placed < req.Replicas {
+		best := self.pickNode(req, eligible)
+		if best == nil {
+			break
+		}
+
+		best.freeCpu -= req.Cpu
+		best.freeMem -= req.MemoryMb
+		best.replicas++
+		placed++
+	}
+
+	if placed < req.Replicas {
+		for _, node := range eligible {
+			if reasons := self.rejectReasons(req, node); len(reasons) > 0 {
+				rejections = append(rejections, NodeRejection{Node: node.candidate.Name, Reasons: reasons})
+			}
+		}
+
+		message := "not enough free resources"
+		if len(candidates) == 0 {
+			message = "no Ready nodes"
+		} else if len(eligible) == 0 {
+			message = "no node matches nodeSelector"
+		} else if req.Spread == manifest.SPREAD_REQUIRE {
+			message = "spread is required and there are not enough fitting nodes"
+		}
+
+		return nil, &PlacementError{
+			App:        req.App,
+			Requested:  req.Replicas,
+			Placed:     placed,
+			Message:    message,
+			Rejections: rejections,
+		}
+	}
+
+	placement := &Placement{
+		Scheduler: self.Name(),
+	}
+
+	for _, node := range eligible {
+		if node.replicas > 0 {
+			placement.Assignments = append(placement.Assignments, Assignment{
+				Node:     node.candidate.Name,
+				Url:      node.candidate.Url,
+				Replicas: node.replicas,
+			})
+		}
+	}
+
+	return placement, nil
+}
+
+func (self *BinPackScheduler) fits(req PlacementRequest, node *binPackNode) bool {
+	return len(self.rejectReasons(req, node)) == 0
+}
+
+func (self *BinPackScheduler) rejectReasons(req PlacementRequest, node *binPackNode) []string {
+	var reasons []string
+
+	if req.Cpu > node.freeCpu {
+		reasons = append(reasons, fmt.Sprintf("needs %.2f cpu, %.2f free", req.Cpu, node.freeCpu))
+	}
+	if req.MemoryMb > node.freeMem {
+		reasons = append(reasons, fmt.Sprintf("needs %d MB memory, %d MB free", req.MemoryMb, node.freeMem))
+	}
+	if req.Spread == manifest.SPREAD_REQUIRE && node.replicas > 0 {
+		reasons = append(reasons, "already runs a replica and spread is required")
+	}
+
+	return reasons
+}
+
+// pickNode returns fitting node, fewer replicas first when spreading,
+// then the one with least free memory and cpu left
+func (self *BinPackScheduler) pickNode(req PlacementRequest, eligible []*binPackNode) *binPackNode {
+	var best *binPackNode
+
+	for _, node := range eligible {
+		if !self.fits(req, node) {
+			continue
+		}
+
+		if best == nil {
+			best = node
+			continue
+		}
+
+		if req.Spread != manifest.SPREAD_NONE && node.replicas != best.replicas {
+			if node.replicas < best.replicas {
+				best = node
+			}
+			continue
+		}
+
+		if node.freeMem < best.freeMem || (node.freeMem == best.freeMem && node.freeCpu < best.freeCpu) {
+			best = node
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,127 @@
+package scheduler
+
+import (
+	"errors"
+	"maps"
+	"testing"
+	"turtle/netes/manifest"
+)
+
+func TestBinPackSchedule(t *testing.T) {
+	candidates := []NodeCandidate{
+		{Name: "c", FreeCpu: 8, FreeMemoryMb: 16000, Labels: map[string]string{"zone": "x"}},
+		{Name: "a", FreeCpu: 4, FreeMemoryMb: 4000},
+		{Name: "b", FreeCpu: 2, FreeMemoryMb: 1000},
+	}
+
+	tests := []struct {
+		name       string
+		req        PlacementRequest
+		candidates []NodeCandidate
+		// Node -> replicas of successful placement
+		want map[string]int
+		// Message of PlacementError when placement fails
+		wantErr    string
+		wantPlaced int
+	}{
+		{
+			name: "tightest node",
+			req:  PlacementRequest{Replicas: 1, Cpu: 0.5, MemoryMb: 500, Spread: manifest.SPREAD_NONE},
+			want: map[string]int{"b": 1},
+		},
+		{
+			name: "packs until node is full",
+			req:  PlacementRequest{Replicas: 3, Cpu: 0.5, MemoryMb: 500, Spread: manifest.SPREAD_NONE},
+			want: map[string]int{"b": 2, "a": 1},
+		},
+		{
+			name: "zero replicas is one",
+			req:  PlacementRequest{Replicas: 0, Cpu: 0.5, MemoryMb: 500, Spread: manifest.SPREAD_NONE},
+			want: map[string]int{"b": 1},
+		},
+		{
+			name: "prefer spread",
+			req:  PlacementRequest{Replicas: 4, Cpu: 0.5, MemoryMb: 500, Spread: manifest.SPREAD_PREFER},
+			want: map[string]int{"a": 1, "b": 2, "c": 1},
+		},
+		{
+			name: "empty spread prefers spreading",
+			req:  PlacementRequest{Replicas: 3, Cpu: 0.5, MemoryMb: 500},
+			want: map[string]int{"a": 1, "b": 1, "c": 1},
+		},
+		{
+			name: "prefer spread falls back to packing",
+			req:  PlacementRequest{Replicas: 3, Cpu: 1, MemoryMb: 3000, Spread: manifest.SPREAD_PREFER},
+			want: map[string]int{"a": 1, "c": 2},
+		},
+		{
+			name:       "require spread",
+			req:        PlacementRequest{Replicas: 4, Cpu: 0.5, MemoryMb: 500, Spread: manifest.SPREAD_REQUIRE},
+			wantErr:    "spread is required and there are not enough fitting nodes",
+			wantPlaced: 3,
+		},
+		{
+			name: "node selector",
+			req:  PlacementRequest{Replicas: 2, Cpu: 1, MemoryMb: 500, NodeSelector: map[string]string{"zone": "x"}},
+			want: map[string]int{"c": 2},
+		},
+		{
+			name:    "node selector matches nothing",
+			req:     PlacementRequest{Replicas: 1, NodeSelector: map[string]string{"zone": "y"}},
+			wantErr: "no node matches nodeSelector",
+		},
+		{
+			name:    "not enough memory",
+			req:     PlacementRequest{Replicas: 1, Cpu: 1, MemoryMb: 20000},
+			wantErr: "not enough free resources",
+		},
+		{
+			name:       "not enough cpu for all replicas",
+			req:        PlacementRequest{Replicas: 4, Cpu: 4, MemoryMb: 100, Spread: manifest.SPREAD_NONE},
+			wantErr:    "not enough free resources",
+			wantPlaced: 3,
+		},
+		{
+			name:       "no nodes",
+			req:        PlacementRequest{Replicas: 1},
+			candidates: []NodeCandidate{},
+			wantErr:    "no Ready nodes",
+		},
+	}
+
+	scheduler := &BinPackScheduler{}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			nodes := candidates
+			if test.candidates != nil {
+				nodes = test.candidates
+			}
+
+			placement, err := scheduler.Schedule(test.req, nodes)
+
+			if test.wantErr != "" {
+				var placementErr *PlacementError
+				if !errors.As(err, &placementErr) {
+					t.Fatalf("Schedule() error = %v, want PlacementError", err)
+				}
+				if placementErr.Message != test.wantErr || placementErr.Placed != test.wantPlaced {
+					t.Fatalf("Schedule() error = %q placed %d, want %q placed %d", placementErr.Message, placementErr.Placed, test.wantErr, test.wantPlaced)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Schedule() failed: %v", err)
+			}
+
+			got := map[string]int{}
+			for _, assignment := range placement.Assignments {
+				got[assignment.Node] = assignment.Replicas
+			}
+			if !maps.Equal(got, test.want) {
+				t.Fatalf("Schedule() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
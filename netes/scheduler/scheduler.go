@@ -0,0 +1,180 @@
+package scheduler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"turtle/netes/manifest"
+	"turtle/netes/nodes"
+)
+
+const DEFAULT_SCHEDULER = "binpack"
+
+// Scheduler decides on which nodes replicas of a deployment run
+type Scheduler interface {
+	Name() string
+	Schedule(req PlacementRequest, candidates []NodeCandidate) (*Placement, error)
+}
+
+// PlacementRequest is what deployment asks for, per replica resources
+type PlacementRequest struct {
+	App          string            `json:"app"`
+	Replicas     int               `json:"replicas"`
+	Cpu          float64           `json:"cpu"`
+	MemoryMb     int64             `json:"memoryMb"`
+	NodeSelector map[string]string `json:"nodeSelector"`
+	Spread       string            `json:"spread"`
+}
+
+// NodeCandidate is node with free resources as reported by its info endpoint
+type NodeCandidate struct {
+	Name         string            `json:"name"`
+	Url          string            `json:"url"`
+	Labels       map[string]string `json:"labels"`
+	FreeCpu      float64           `json:"freeCpu"`
+	FreeMemoryMb int64             `json:"freeMemoryMb"`
+}
+
+type Assignment struct {
+	Node     string `json:"node"`
+	Url      string `json:"url"`
+	Replicas int    `json:"replicas"`
+}
+
+type Placement struct {
+	Scheduler   string       `json:"scheduler"`
+	Assignments []Assignment `json:"assignments"`
+}
+
+// NodeRejection explains why node could not take (more) replicas
+type NodeRejection struct {
+	Node    string   `json:"node"`
+	Reasons []string `json:"reasons"`
+}
+
+// PlacementError is returned when not all replicas could be placed
+type PlacementError struct {
+	App        string          `json:"app"`
+	Requested  int             `json:"requested"`
+	Placed     int             `json:"placed"`
+	Message    string          `json:"message"`
+	Rejections []NodeRejection `json:"rejections"`
+}
+
+func (self *PlacementError) Error() string {
+	reasons := make([]string, 0, len(self.Rejections))
+	for _, rejection := range self.Rejections {
+		reasons = append(reasons, rejection.Node+": "+strings.Join(rejection.Reasons, ", "))
+	}
+
+	message := fmt.Sprintf("cannot place %s: %s (placed %d of %d replicas)", self.App, self.Message, self.Placed, self.Requested)
+
+	if len(reasons) > 0 {
+		message += "; " + strings.Join(reasons, "; ")
+	}
+
+	return message
+}
+
+var (
+	schedulersMu sync.RWMutex
+	schedulers   = map[string]Scheduler{}
+)
+
+func init() {
+	RegisterScheduler(&BinPackScheduler{})
+}
+
+// RegisterScheduler makes strategy available under its name
+func RegisterScheduler(scheduler Scheduler) {
+	schedulersMu.Lock()
+	defer schedulersMu.Unlock()
+	schedulers[scheduler.Name()] = scheduler
+}
+
+func GetScheduler(name string) (Scheduler, error) {
+	if name == "" {
+		name = DEFAULT_SCHEDULER
+	}
+
+	schedulersMu.RLock()
+	defer schedulersMu.RUnlock()
+
+	scheduler, ok := schedulers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown scheduler %q", name)
+	}
+	return scheduler, nil
+}
+
+func ListSchedulers() []string {
+	schedulersMu.RLock()
+	defer schedulersMu.RUnlock()
+
+	result := make([]string, 0, len(schedulers))
+	for name := range schedulers {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func RequestFromManifest(appManifest *manifest.Manifest) PlacementRequest {
+	return PlacementRequest{
+		App:          appManifest.App,
+		Replicas:     appManifest.Placement.Replicas,
+		Cpu:          appManifest.Resources.Cpu,
+		MemoryMb:     appManifest.Resources.MemoryMb,
+		NodeSelector: appManifest.Placement.NodeSelector,
+		Spread:       appManifest.Placement.Spread,
+	}
+}
+
+// CandidateFromNode computes free resources from last heartbeat of node
+func CandidateFromNode(node *nodes.Node) NodeCandidate {
+	info := node.Info
+
+	freeCpu := float64(info.Cpu.Count) - info.Cpu.Load1
+	if freeCpu < 0 {
+		freeCpu = 0
+	}
+
+	return NodeCandidate{
+		Name:         node.Name,
+		Url:          node.Url,
+		Labels:       info.Labels,
+		FreeCpu:      freeCpu,
+		FreeMemoryMb: int64(info.Memory.AvailableBytes / (1024 * 1024)),
+	}
+}
+
+func CandidatesFromNodes(list []nodes.Node) []NodeCandidate {
+	result := make([]NodeCandidate, len(list))
+	for i := range list {
+		result[i] = CandidateFromNode(&list[i])
+	}
+	return result
+}
+
+// MatchesSelector reports missing or different labels of node
+func MatchesSelector(labels, selector map[string]string) []string {
+	var reasons []string
+
+	keys := make([]string, 0, len(selector))
+	for key := range selector {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value, ok := labels[key]
+		if !ok {
+			reasons = append(reasons, fmt.Sprintf("missing label %s", key))
+		} else if value != selector[key] {
+			reasons = append(reasons, fmt.Sprintf("label %s=%s, want %s", key, value, selector[key]))
+		}
+	}
+
+	return reasons
+}
@@ -0,0 +1,108 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"turtle/core/serverKit"
+)
+
+var (
+	ErrNoMasterKey    = errors.New("secrets master key is not configured")
+	ErrWrongMasterKey = errors.New("secret was encrypted with different master key")
+)
+
+const MASTER_KEY_SIZE = 32
+
+var (
+	masterKeyOnce sync.Once
+	masterKey     []byte
+	masterKeyErr  error
+)
+
+// getMasterKey loads the key once from secretsKey or secretsKeyFile config
+func getMasterKey() ([]byte, error) {
+	masterKeyOnce.Do(func() {
+		masterKey, masterKeyErr = loadMasterKey(serverKit.SERVER_CONFIG)
+	})
+	return masterKey, masterKeyErr
+}
+
+func loadMasterKey(config *serverKit.GinServerConfig) ([]byte, error) {
+	encoded := config.SecretsKey
+
+	if encoded == "" && config.SecretsKeyFile != "" {
+		data, err := os.ReadFile(config.SecretsKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read secrets key file: %w", err)
+		}
+		encoded = strings.TrimSpace(string(data))
+	}
+
+	if encoded == "" {
+		return nil, ErrNoMasterKey
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("secrets master key is not valid base64: %w", err)
+	}
+
+	if len(key) != MASTER_KEY_SIZE {
+		return nil, fmt.Errorf("secrets master key must have %d bytes, got %d", MASTER_KEY_SIZE, len(key))
+	}
+
+	return key, nil
+}
+
+// keyId identifies master key without revealing it, stored next to ciphertext
+func keyId(key []byte) string {
+	sum := sha256.Sum256(append([]byte("turtle-secrets/"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encrypt seals value with AES-256-GCM, secret name is additional data so
+// ciphertext can't be moved to another secret
+func encrypt(key []byte, name string, value []byte) (nonce []byte, ciphertext []byte, err error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+
+	return nonce, gcm.Seal(nil, nonce, value, []byte(name)), nil
+}
+
+func decrypt(key []byte, name string, nonce, ciphertext []byte) ([]byte, error) {
+	gcm, err := newGcm(key)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := gcm.Open(nil, nonce, ciphertext, []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt secret %s: %w", name, err)
+	}
+
+	return value, nil
+}
+
+func newGcm(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
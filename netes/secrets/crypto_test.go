@@ -0,0 +1,176 @@
+package secrets
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"turtle/core/serverKit"
+)
+
+// Stands for any error in test tables
+var errAny = errors.New("any error")
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+
+	key := make([]byte, MASTER_KEY_SIZE)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key := newKey(t)
+	otherKey := newKey(t)
+
+	tests := []struct {
+		name  string
+		value []byte
+		// Changes what decrypt gets, nil decrypts what encrypt returned
+		tamper  func(name string, nonce, ciphertext []byte) ([]byte, string, []byte, []byte)
+		wantErr bool
+	}{
+		{name: "text", value: []byte("s3cr3t password")},
+		{name: "empty", value: []byte{}},
+		{name: "binary", value: []byte{0, 1, 2, 255, 254, 0}},
+		{name: "large", value: bytes.Repeat([]byte("x"), 1<<20)},
+		{
+			name:  "other key",
+			value: []byte("value"),
+			tamper: func(name string, nonce, ciphertext []byte) ([]byte, string, []byte, []byte) {
+				return otherKey, name, nonce, ciphertext
+			},
+			wantErr: true,
+		},
+		{
+			name:  "moved to other secret",
+			value: []byte("value"),
+			tamper: func(name string, nonce, ciphertext []byte) ([]byte, string, []byte, []byte) {
+				return key, name + "-copy", nonce, ciphertext
+			},
+			wantErr: true,
+		},
+		{
+			name:  "changed ciphertext",
+			value: []byte("value"),
+			tamper: func(name string, nonce, ciphertext []byte) ([]byte, string, []byte, []byte) {
+				changed := bytes.Clone(ciphertext)
+				changed[0] ^= 1
+				return key, name, nonce, changed
+			},
+			wantErr: true,
+		},
+		{
+			name:  "changed nonce",
+			value: []byte("value"),
+			tamper: func(name string, nonce, ciphertext []byte) ([]byte, string, []byte, []byte) {
+				changed := bytes.Clone(nonce)
+				changed[0] ^= 1
+				return key, name, changed, ciphertext
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := "db-password"
+
+			nonce, ciphertext, err := encrypt(key, name, test.value)
+			if err != nil {
+				t.Fatalf("encrypt() failed: %v", err)
+			}
+			if len(test.value) > 0 && bytes.Contains(ciphertext, test.value) {
+				t.Fatal("ciphertext contains the value")
+			}
+
+			decryptKey, decryptName := key, name
+			if test.tamper != nil {
+				decryptKey, decryptName, nonce, ciphertext = test.tamper(name, nonce, ciphertext)
+			}
+
+			value, err := decrypt(decryptKey, decryptName, nonce, ciphertext)
+
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("decrypt() accepted tampered secret")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decrypt() failed: %v", err)
+			}
+			if !bytes.Equal(value, test.value) {
+				t.Fatalf("decrypt() = %q, want %q", value, test.value)
+			}
+		})
+	}
+}
+
+func TestEncryptUsesFreshNonce(t *testing.T) {
+	key := newKey(t)
+
+	nonce1, ciphertext1, err := encrypt(key, "name", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce2, ciphertext2, err := encrypt(key, "name", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(nonce1, nonce2) || bytes.Equal(ciphertext1, ciphertext2) {
+		t.Fatal("same value was encrypted twice with the same nonce")
+	}
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key := newKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	keyFile := filepath.Join(t.TempDir(), "secrets.key")
+	if err := os.WriteFile(keyFile, []byte(encoded+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		config  serverKit.GinServerConfig
+		wantErr error
+	}{
+		{name: "key", config: serverKit.GinServerConfig{SecretsKey: encoded}},
+		{name: "key file", config: serverKit.GinServerConfig{SecretsKeyFile: keyFile}},
+		{name: "key wins over file", config: serverKit.GinServerConfig{SecretsKey: encoded, SecretsKeyFile: "/missing"}},
+		{name: "no key", config: serverKit.GinServerConfig{}, wantErr: ErrNoMasterKey},
+		{name: "missing file", config: serverKit.GinServerConfig{SecretsKeyFile: "/missing/secrets.key"}, wantErr: os.ErrNotExist},
+		{name: "not base64", config: serverKit.GinServerConfig{SecretsKey: "not base64!"}, wantErr: errAny},
+		{name: "short key", config: serverKit.GinServerConfig{SecretsKey: base64.StdEncoding.EncodeToString(key[:16])}, wantErr: errAny},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := loadMasterKey(&test.config)
+
+			switch {
+			case test.wantErr == nil:
+				if err != nil {
+					t.Fatalf("loadMasterKey() failed: %v", err)
+				}
+				if !bytes.Equal(got, key) {
+					t.Fatal("loadMasterKey() returned different key")
+				}
+			case test.wantErr == errAny:
+				if err == nil {
+					t.Fatal("loadMasterKey() accepted invalid key")
+				}
+			case !errors.Is(err, test.wantErr):
+				t.Fatalf("loadMasterKey() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
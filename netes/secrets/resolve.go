@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+)
+
+func GetSecretsDir() string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".secrets")
+}
+
+// GetAppSecretsDir is where file secrets of one app instance are written, instance
+// is revision id of services and run id of jobs
+func GetAppSecretsDir(app, instance string) string {
+	return filepath.Join(GetSecretsDir(), app, instance)
+}
+
+// Resolve decrypts secrets referenced by manifest, writes file secrets and returns
+// env variables ("KEY=value") to append to the process environment
+func Resolve(ctx context.Context, app, instance string, refs []manifest.SecretRef) ([]string, error) {
+	env := []string{}
+
+	if len(refs) == 0 {
+		return env, nil
+	}
+
+	dir := GetAppSecretsDir(app, instance)
+
+	for _, ref := range refs {
+		secret, err := GetSecret(ctx, ref.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := secret.Reveal()
+		if err != nil {
+			return nil, err
+		}
+
+		if ref.File == "" {
+			env = append(env, ref.Env+"="+string(value))
+			continue
+		}
+
+		path, err := writeSecretFile(dir, ref.File, value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to write secret %s: %w", ref.Name, err)
+		}
+
+		if ref.Env != "" {
+			env = append(env, ref.Env+"="+path)
+		}
+	}
+
+	env = append(env, "TURTLE_SECRETS_DIR="+dir)
+
+	return env, nil
+}
+
+func writeSecretFile(dir, name string, value []byte) (string, error) {
+	if err := manifest.ValidateRelativePath(name); err != nil {
+		return "", err
+	}
+
+	path, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+
+	// Write next to target and rename so running readers never see half a file
+	tmp := path + ".tmp"
+
+	if err := os.WriteFile(tmp, value, 0600); err != nil {
+		return "", err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return path, nil
+}
+
+// RemoveResolved deletes secret files of app instance, called when process stops
+func RemoveResolved(app, instance string) error {
+	return os.RemoveAll(GetAppSecretsDir(app, instance))
+}
@@ -0,0 +1,88 @@
+package secrets
+
+import (
+	"errors"
+	"net/http"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+GET /api/secrets
+Metadata only, values are write-only
+*/
+func _ListSecrets(c *gin.Context) {
+	result, err := ListSecrets(c.Request.Context())
+
+	if err != nil {
+		serverKit.ReturnError(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, result)
+}
+
+/*
+GET /api/secrets/get?name=
+*/
+func _GetSecret(c *gin.Context) {
+	secret, err := GetSecret(c.Request.Context(), c.Query("name"))
+	returnSecret(c, secret, err)
+}
+
+/*
+POST /api/secrets
+
+	{"name": "db-password", "value": "..."}
+
+Creates secret or replaces its value
+*/
+func _PutSecret(c *gin.Context) {
+	var req struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	user, err := auth.GetUserUidFromContext(c)
+	if err != nil {
+		serverKit.ReturnUnauthorized(c, err)
+		return
+	}
+
+	secret, err := PutSecret(c.Request.Context(), req.Name, []byte(req.Value), user)
+	returnSecret(c, secret, err)
+}
+
+/*
+DELETE /api/secrets?name=
+*/
+func _DeleteSecret(c *gin.Context) {
+	err := DeleteSecret(c.Request.Context(), c.Query("name"))
+	returnSecret(c, nil, err)
+}
+
+func returnSecret(c *gin.Context, secret *Secret, err error) {
+	if errors.Is(err, ErrSecretNotFound) || errors.Is(err, ErrInvalidSecret) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else if secret == nil {
+		serverKit.ReturnOkJson(c, gin.H{"status": "ok"})
+	} else {
+		serverKit.ReturnOkJson(c, secret)
+	}
+}
+
+func InitSecretsApi(r *gin.Engine) {
+	r.GET("/api/secrets", auth.ApiKeysRequired, _ListSecrets)
+	r.GET("/api/secrets/get", auth.ApiKeysRequired, _GetSecret)
+	r.POST("/api/secrets", auth.ApiKeysRequired, _PutSecret)
+	r.DELETE("/api/secrets", auth.ApiKeysRequired, _DeleteSecret)
+}
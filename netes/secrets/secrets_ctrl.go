@@ -0,0 +1,151 @@
+package secrets
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"turtle/core/dbclient"
+	"turtle/core/tools"
+	"turtle/netes/manifest"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const SECRETS_COLLECTION = "secrets"
+
+// Maximum size of one secret value
+const MAX_SECRET_SIZE = 1 << 20
+
+var (
+	ErrSecretNotFound = errors.New("secret not found")
+	ErrInvalidSecret  = errors.New("invalid secret")
+)
+
+// Secret is stored encrypted, value is never returned by the API
+type Secret struct {
+	Uid        primitive.ObjectID `json:"uid" bson:"_id"`
+	Name       string             `json:"name" bson:"name"`
+	KeyId      string             `json:"keyId" bson:"keyId"`
+	Nonce      []byte             `json:"-" bson:"nonce"`
+	Ciphertext []byte             `json:"-" bson:"ciphertext"`
+	Size       int                `json:"size" bson:"size"`
+	Version    int                `json:"version" bson:"version"`
+	CreatedBy  string             `json:"createdBy" bson:"createdBy"`
+	CreatedAt  time.Time          `json:"createdAt" bson:"createdAt"`
+	UpdatedBy  string             `json:"updatedBy" bson:"updatedBy"`
+	UpdatedAt  time.Time          `json:"updatedAt" bson:"updatedAt"`
+}
+
+func secretsRepo() *dbclient.Repository[Secret] {
+	return dbclient.NewRepository[Secret](dbclient.MongoClient, SECRETS_COLLECTION)
+}
+
+func secretUid(name string) primitive.ObjectID {
+	return tools.StringToObjectID("secret/" + name)
+}
+
+// PutSecret creates secret or replaces its value, version is increased on every change
+func PutSecret(ctx context.Context, name string, value []byte, user string) (*Secret, error) {
+	if err := manifest.ValidateSecretName(name); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrInvalidSecret, err.Error())
+	}
+
+	if len(value) > MAX_SECRET_SIZE {
+		return nil, fmt.Errorf("%w: value is larger than %d bytes", ErrInvalidSecret, MAX_SECRET_SIZE)
+	}
+
+	key, err := getMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, ciphertext, err := encrypt(key, name, value)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	collection, err := secretsRepo().Collection()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Secret{}
+
+	err = collection.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": secretUid(name)},
+		bson.M{
+			"$set": bson.M{
+				"name":       name,
+				"keyId":      keyId(key),
+				"nonce":      nonce,
+				"ciphertext": ciphertext,
+				"size":       len(value),
+				"updatedBy":  user,
+				"updatedAt":  now,
+			},
+			"$inc": bson.M{"version": 1},
+			"$setOnInsert": bson.M{
+				"createdBy": user,
+				"createdAt": now,
+			},
+		},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(result)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// GetSecret returns secret metadata, use Reveal for the value
+func GetSecret(ctx context.Context, name string) (*Secret, error) {
+	secret, err := secretsRepo().FindByID(ctx, secretUid(name))
+	if err != nil {
+		return nil, err
+	}
+	if secret == nil {
+		return nil, fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return secret, nil
+}
+
+func ListSecrets(ctx context.Context) ([]Secret, error) {
+	opts := options.Find().
+		SetSort(bson.D{{Key: "name", Value: 1}}).
+		SetProjection(bson.M{"nonce": 0, "ciphertext": 0})
+
+	return secretsRepo().FindMany(ctx, bson.M{}, opts)
+}
+
+func DeleteSecret(ctx context.Context, name string) error {
+	deleted, err := secretsRepo().DeleteByID(ctx, secretUid(name))
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("%w: %s", ErrSecretNotFound, name)
+	}
+	return nil
+}
+
+// Reveal decrypts secret value, only used when injecting secrets into processes
+func (self *Secret) Reveal() ([]byte, error) {
+	key, err := getMasterKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if self.KeyId != keyId(key) {
+		return nil, fmt.Errorf("%w: %s", ErrWrongMasterKey, self.Name)
+	}
+
+	return decrypt(key, self.Name, self.Nonce, self.Ciphertext)
+}
@@ -0,0 +1,367 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/tools"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+)
+
+const (
+	COLOR_BLUE  = "blue"
+	COLOR_GREEN = "green"
+)
+
+var ErrColorsNotFound = errors.New("app is not blue/green")
+
+// Colors are two revisions of blue/green app, only replicas of the active color
+// get traffic, the other color stays running for instant switch back
+type Colors struct {
+	App              string       `json:"app"`
+	Active           string       `json:"active"`
+	ActiveRevisionId string       `json:"activeRevisionId"`
+	Blue             *ColorStatus `json:"blue,omitempty"`
+	Green            *ColorStatus `json:"green,omitempty"`
+	// Percent of traffic of the inactive color while it is a canary
+	CanaryWeight int       `json:"canaryWeight,omitempty"`
+	SwitchedAt   time.Time `json:"switchedAt"`
+}
+
+type ColorStatus struct {
+	RevisionId string          `json:"revisionId"`
+	Ready      int             `json:"ready"`
+	Replicas   []ProcessStatus `json:"replicas"`
+}
+
+type appColors struct {
+	active string
+	// Color -> revision
+	revisions  map[string]string
+	switchedAt time.Time
+	// Percent of traffic of the inactive color while it is a canary
+	weight int
+	stats  *canaryStats
+}
+
+func otherColor(color string) string {
+	if color == COLOR_BLUE {
+		return COLOR_GREEN
+	}
+	return COLOR_BLUE
+}
+
+// alternatePorts lets green replicas run next to blue ones, fixed ports become
+// allocated ones and ingress follows them
+func alternatePorts(ports []manifest.Port) []manifest.Port {
+	result := make([]manifest.Port, len(ports))
+	for i, port := range ports {
+		port.Port = 0
+		result[i] = port
+	}
+	return result
+}
+
+// colorOf returns color of revision, empty when app is not blue/green
+func (self *Supervisor) colorOf(app, revisionId string) string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if colors := self.colors[app]; colors != nil {
+		for color, colorRevision := range colors.revisions {
+			if colorRevision == revisionId {
+				return color
+			}
+		}
+	}
+	return ""
+}
+
+// activeRevision returns revision getting traffic of blue/green app, empty for other apps
+func (self *Supervisor) activeRevision(app string) string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if colors := self.colors[app]; colors != nil {
+		return colors.revisions[colors.active]
+	}
+	return ""
+}
+
+func (self *Supervisor) setColor(app, color, revisionId string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	colors := self.colors[app]
+	if colors == nil {
+		colors = &appColors{active: color, revisions: map[string]string{}, switchedAt: time.Now()}
+		self.colors[app] = colors
+	}
+
+	if revisionId == "" {
+		delete(colors.revisions, color)
+	} else {
+		colors.revisions[color] = revisionId
+	}
+}
+
+// replaceColor points color of failed revision back to revision it replaced,
+// canary traffic goes back to the active color
+func (self *Supervisor) replaceColor(app, revisionId, replacement string) {
+	if color := self.colorOf(app, revisionId); color != "" {
+		self.setColor(app, color, replacement)
+		self.setCanaryWeight(app, 0)
+	}
+}
+
+func (self *Supervisor) clearColors(app string) {
+	self.mu.Lock()
+	delete(self.colors, app)
+	self.mu.Unlock()
+}
+
+// switchColor makes color active, traffic moves at once as ingress asks Ready
+func (self *Supervisor) switchColor(app, color string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if colors := self.colors[app]; colors != nil {
+		colors.active = color
+		colors.switchedAt = time.Now()
+		colors.weight = 0
+	}
+}
+
+// GetColors returns both colors of blue/green app and the active one
+func (self *Supervisor) GetColors(app string) (Colors, error) {
+	self.mu.Lock()
+	colors := self.colors[app]
+	if colors == nil {
+		self.mu.Unlock()
+		return Colors{}, fmt.Errorf("%w: %s", ErrColorsNotFound, app)
+	}
+	result := Colors{
+		App:              app,
+		Active:           colors.active,
+		ActiveRevisionId: colors.revisions[colors.active],
+		CanaryWeight:     colors.weight,
+		SwitchedAt:       colors.switchedAt,
+	}
+	revisions := map[string]string{}
+	for color, revisionId := range colors.revisions {
+		revisions[color] = revisionId
+	}
+	self.mu.Unlock()
+
+	colorStatus := func(revisionId string) *ColorStatus {
+		if revisionId == "" {
+			return nil
+		}
+		status := &ColorStatus{
+			RevisionId: revisionId,
+			Replicas:   self.revisionStatuses(app, revisionId),
+		}
+		for _, replica := range status.Replicas {
+			if replica.Ready {
+				status.Ready++
+			}
+		}
+		return status
+	}
+
+	result.Blue = colorStatus(revisions[COLOR_BLUE])
+	result.Green = colorStatus(revisions[COLOR_GREEN])
+
+	return result, nil
+}
+
+// SwitchColor sends traffic of blue/green app back to the other color,
+// all replicas of the other color must be ready
+func (self *Supervisor) SwitchColor(app string) (Colors, error) {
+	if update := self.getUpdate(app); update != nil && update.isActive() {
+		return Colors{}, fmt.Errorf("%w: update of %s is in progress", ErrNotReady, app)
+	}
+
+	colors, err := self.GetColors(app)
+	if err != nil {
+		return colors, err
+	}
+
+	target := otherColor(colors.Active)
+	status := colors.Blue
+	if target == COLOR_GREEN {
+		status = colors.Green
+	}
+
+	if status == nil || len(status.Replicas) == 0 {
+		return colors, fmt.Errorf("%w: %s color of %s does not run", ErrNotReady, target, app)
+	}
+	if status.Ready != len(status.Replicas) {
+		return colors, fmt.Errorf("%w: %d of %d replicas of %s color are ready", ErrNotReady, status.Ready, len(status.Replicas), target)
+	}
+
+	self.switchColor(app, target)
+
+	lgr.Info("Traffic of %s switched to %s color, revision %s", app, target, status.RevisionId)
+	events.Emitf(events.EVENT_COLOR_SWITCHED, app, status.RevisionId, "traffic switched to %s color", target)
+
+	return self.GetColors(app)
+}
+
+// colorUpdate starts revision as the inactive color, blue/green update switches traffic
+// to it once all its replicas are ready, canary update moves traffic in steps.
+// Replicas of the previously inactive color are replaced unless they already are the
+// requested revision.
+func (self *Supervisor) colorUpdate(app, revisionId, dir string, appManifest *manifest.Manifest, replicas int, onFinished func(UpdateStatus)) ([]ProcessStatus, error) {
+	processes := self.get(app)
+
+	if self.activeRevision(app) == "" && len(processes) > 0 && processes[0].revisionId != revisionId {
+		// Running app becomes blue color
+		self.setColor(app, COLOR_BLUE, processes[0].revisionId)
+	}
+
+	active := self.activeRevision(app)
+
+	if active == "" || active == revisionId {
+		current := []*AppProcess{}
+		for _, process := range processes {
+			if process.revisionId == revisionId {
+				current = append(current, process)
+			}
+		}
+
+		// Revision already runs as requested, the other color stays warm
+		if len(current) > 0 && runsAs(current, revisionId, appManifest) && (active != "" || len(current) == len(processes)) {
+			if active == "" {
+				self.setColor(app, COLOR_BLUE, revisionId)
+			}
+			return self.Scale(app, revisionId, dir, appManifest, replicas)
+		}
+
+		statuses, err := self.Start(app, revisionId, dir, appManifest, replicas)
+		self.setColor(app, COLOR_BLUE, revisionId)
+		return statuses, err
+	}
+
+	update := newAppUpdate(app, revisionId, replicas, appManifest.Update.RollbackOnFailure())
+	update.status.Strategy = appManifest.Update.Type
+
+	self.mu.Lock()
+	self.updates[app] = update
+	self.mu.Unlock()
+
+	lgr.Info("Update of %s to revision %s started, strategy %s", app, revisionId, appManifest.Update.Type)
+	events.Emitf(events.EVENT_UPDATE_STARTED, app, revisionId, "%s update of %d replicas started", appManifest.Update.Type, replicas)
+
+	go tools.SafeGoRoutine(func() {
+		defer close(update.done)
+
+		if appManifest.Update.Type == manifest.STRATEGY_CANARY {
+			self.runCanary(update, dir, appManifest)
+		} else {
+			self.runBlueGreen(update, dir, appManifest)
+		}
+
+		if onFinished != nil {
+			onFinished(update.Status())
+		}
+	})
+
+	return self.statuses(app), nil
+}
+
+func (self *Supervisor) runBlueGreen(update *appUpdate, dir string, appManifest *manifest.Manifest) {
+	app, revisionId, replicas := update.status.App, update.status.RevisionId, update.status.Replicas
+
+	target, _, ok := self.startInactiveColor(update, dir, appManifest)
+	if !ok {
+		return
+	}
+
+	self.switchColor(app, target)
+
+	update.setProgress(replicas, replicas)
+	update.finish(UPDATE_COMPLETED, nil)
+
+	lgr.Ok("Traffic of %s switched to %s color, revision %s", app, target, revisionId)
+	events.Emitf(events.EVENT_COLOR_SWITCHED, app, revisionId, "traffic switched to %s color", target)
+}
+
+// startInactiveColor replaces replicas of the inactive color with replicas of update
+// revision and waits until they are ready, replicas of the active color keep serving.
+// Returns the color and replicas it stopped, false when update is over.
+func (self *Supervisor) startInactiveColor(update *appUpdate, dir string, appManifest *manifest.Manifest) (string, []replicaSpec, bool) {
+	app, revisionId, replicas := update.status.App, update.status.RevisionId, update.status.Replicas
+
+	active := self.activeRevision(app)
+	target := otherColor(self.colorOf(app, active))
+
+	stopped := []replicaSpec{}
+	warm := 0
+
+	for _, process := range self.get(app) {
+		if process.revisionId == active || (process.revisionId == revisionId && process.replica < replicas) {
+			if process.revisionId == revisionId {
+				warm++
+			}
+			continue
+		}
+
+		self.removeProcess(process)
+		process.Stop()
+
+		stopped = append(stopped, replicaSpec{
+			revisionId: process.revisionId,
+			dir:        process.dir,
+			manifest:   process.manifest,
+			replica:    process.replica,
+		})
+	}
+
+	self.setColor(app, target, revisionId)
+
+	if warm > 0 {
+		lgr.Info("%d replicas of %s revision %s are still running as %s color", warm, app, revisionId, target)
+	}
+
+	for replica := 0; replica < replicas; {
+		if err := update.checkpoint(); err != nil {
+			self.endUpdate(update, stopped, err)
+			return target, stopped, false
+		}
+
+		if self.getReplica(app, revisionId, replica) == nil {
+			if _, err := self.StartReplica(app, revisionId, dir, appManifest, replica); err != nil {
+				if self.updateFailed(update, stopped, err) {
+					return target, stopped, false
+				}
+				continue
+			}
+		}
+		replica++
+	}
+
+	update.setProgress(replicas, 0)
+
+	for {
+		if err := update.checkpoint(); err != nil {
+			self.endUpdate(update, stopped, err)
+			return target, stopped, false
+		}
+
+		ctx, cancel := context.WithTimeout(update.rollbackCtx, time.Duration(appManifest.Update.ReadyTimeoutSeconds)*time.Second)
+		_, err := self.waitReplicasReady(ctx, app, revisionId)
+		cancel()
+
+		if err == nil {
+			return target, stopped, true
+		}
+
+		if self.updateFailed(update, stopped, err) {
+			return target, stopped, false
+		}
+	}
+}
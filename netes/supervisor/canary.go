@@ -0,0 +1,192 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+	"turtle/core/lgr"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+)
+
+// How often running canary step checks error rate of the canary
+var CANARY_CHECK_INTERVAL = 1 * time.Second
+
+var ErrCanaryFailing = errors.New("canary error rate is too high")
+
+// canaryStats counts ingress responses of canary in the current step
+type canaryStats struct {
+	requests atomic.Int64
+	errors   atomic.Int64
+}
+
+// Backends returns ready replicas getting traffic of app, canary replicas get weight
+// percent of requests, the rest goes to stable replicas
+func (self *Supervisor) Backends(app string) (stable, canary []ProcessStatus, weight int) {
+	self.mu.Lock()
+	stableRevision, canaryRevision := "", ""
+	if colors := self.colors[app]; colors != nil {
+		stableRevision = colors.revisions[colors.active]
+		if colors.weight > 0 {
+			canaryRevision = colors.revisions[otherColor(colors.active)]
+			weight = colors.weight
+		}
+	}
+	self.mu.Unlock()
+
+	if canaryRevision == "" {
+		return self.Ready(app), nil, 0
+	}
+
+	for _, process := range self.get(app) {
+		if process.revisionId != stableRevision && process.revisionId != canaryRevision {
+			continue
+		}
+
+		status := process.snapshot()
+		if !status.Ready {
+			continue
+		}
+
+		if status.RevisionId == canaryRevision {
+			canary = append(canary, status)
+		} else {
+			stable = append(stable, status)
+		}
+	}
+
+	return stable, canary, weight
+}
+
+// RecordResponse counts response of replica of revision sent through ingress,
+// only responses of a canary getting traffic are counted
+func (self *Supervisor) RecordResponse(app, revisionId string, status int) {
+	self.mu.Lock()
+	var stats *canaryStats
+	if colors := self.colors[app]; colors != nil && colors.weight > 0 && colors.revisions[otherColor(colors.active)] == revisionId {
+		stats = colors.stats
+	}
+	self.mu.Unlock()
+
+	if stats == nil {
+		return
+	}
+
+	stats.requests.Add(1)
+	if status >= 500 {
+		stats.errors.Add(1)
+	}
+}
+
+// setCanaryWeight sends weight percent of traffic to the inactive color and starts counting again
+func (self *Supervisor) setCanaryWeight(app string, weight int) *canaryStats {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	colors := self.colors[app]
+	if colors == nil {
+		return nil
+	}
+
+	colors.weight = weight
+	colors.stats = &canaryStats{}
+
+	return colors.stats
+}
+
+// runCanary starts revision as the inactive color and moves traffic to it step by step,
+// the old color is stopped when canary gets all traffic
+func (self *Supervisor) runCanary(update *appUpdate, dir string, appManifest *manifest.Manifest) {
+	app, revisionId, replicas := update.status.App, update.status.RevisionId, update.status.Replicas
+	strategy := appManifest.Update.Canary
+
+	target, stopped, ok := self.startInactiveColor(update, dir, appManifest)
+	if !ok {
+		return
+	}
+
+	update.setProgress(replicas, replicas)
+
+	for _, weight := range strategy.Steps {
+		if weight >= 100 {
+			break
+		}
+
+		stats := self.setCanaryWeight(app, weight)
+		update.setWeight(weight)
+
+		lgr.Info("Canary of %s revision %s gets %d%% of traffic", app, revisionId, weight)
+		events.Emitf(events.EVENT_CANARY_WEIGHT, app, revisionId, "canary gets %d%% of traffic", weight)
+
+		err := self.watchCanaryStep(update, strategy, stats)
+		if errors.Is(err, ErrCanaryFailing) {
+			self.rollback(update, stopped, err)
+			return
+		} else if err != nil {
+			self.endUpdate(update, stopped, err)
+			return
+		}
+	}
+
+	old := self.activeRevision(app)
+
+	self.switchColor(app, target)
+	self.setColor(app, otherColor(target), "")
+
+	for _, process := range self.get(app) {
+		if process.revisionId == old {
+			self.removeProcess(process)
+			process.Stop()
+		}
+	}
+
+	update.setWeight(100)
+	update.finish(UPDATE_COMPLETED, nil)
+
+	lgr.Ok("Canary of %s revision %s promoted to all traffic", app, revisionId)
+	events.Emitf(events.EVENT_COLOR_SWITCHED, app, revisionId, "canary promoted to all traffic as %s color", target)
+}
+
+// watchCanaryStep waits until step is promoted by time or by hand, it fails as soon as
+// error rate of the step passes the limit
+func (self *Supervisor) watchCanaryStep(update *appUpdate, strategy *manifest.CanaryStrategy, stats *canaryStats) error {
+	ticker := time.NewTicker(CANARY_CHECK_INTERVAL)
+	defer ticker.Stop()
+
+	var deadline <-chan time.Time
+	if strategy.StepSeconds > 0 {
+		timer := time.NewTimer(time.Duration(strategy.StepSeconds) * time.Second)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	check := func() error {
+		requests, failed := stats.requests.Load(), stats.errors.Load()
+		update.setCanaryStats(requests, failed)
+
+		if requests > 0 && requests >= int64(strategy.MinRequests) && float64(failed)/float64(requests) > strategy.MaxErrorRate {
+			return fmt.Errorf("%w: %d of %d responses failed", ErrCanaryFailing, failed, requests)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-update.rollbackCtx.Done():
+			return update.rollbackCtx.Err()
+		case <-update.promoteCh:
+			return check()
+		case <-deadline:
+			// Paused canary is not promoted by time
+			if err := update.checkpoint(); err != nil {
+				return err
+			}
+			return check()
+		case <-ticker.C:
+			if err := check(); err != nil {
+				return err
+			}
+		}
+	}
+}
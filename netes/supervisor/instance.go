@@ -0,0 +1,57 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+	"turtle/netes/manifest"
+)
+
+// Time limit of rendering config templates before each start
+const RENDER_TEMPLATES_TIMEOUT = 10 * time.Second
+
+var ErrTemplatesNotSupported = errors.New("config templates can't be rendered, no renderer is registered")
+
+// TemplateInstance is replica or job run whose config templates are rendered before it starts
+type TemplateInstance struct {
+	App        string
+	RevisionId string
+	// Replica index, 0 for job runs
+	Replica  int
+	Manifest *manifest.Manifest
+	// Revision folder with package files
+	Dir string
+	// Working folder of the process, see GetInstanceDir
+	InstanceDir string
+}
+
+// RenderInstanceTemplates fills instance folder with package files and templates rendered
+// for the instance. Deploy listener registers it, supervisor can't depend on it.
+var RenderInstanceTemplates func(ctx context.Context, instance *TemplateInstance) error
+
+// prepareWorkDir returns folder the process runs in, revision folder when manifest
+// has no templates, otherwise instance folder with templates rendered for it
+func prepareWorkDir(instance *TemplateInstance) (string, error) {
+	if len(instance.Manifest.Templates) == 0 {
+		return instance.Dir, nil
+	}
+
+	if RenderInstanceTemplates == nil {
+		return "", ErrTemplatesNotSupported
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), RENDER_TEMPLATES_TIMEOUT)
+	defer cancel()
+
+	if err := RenderInstanceTemplates(ctx, instance); err != nil {
+		return "", err
+	}
+
+	return instance.InstanceDir, nil
+}
+
+// removeInstanceDir deletes instance folder, rendered templates may contain secrets
+func removeInstanceDir(app, instance string) error {
+	return os.RemoveAll(GetInstanceDir(app, instance))
+}
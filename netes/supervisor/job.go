@@ -0,0 +1,144 @@
+package supervisor
+
+import (
+	"context"
+	"io"
+	"time"
+	"turtle/core/lgr"
+	"turtle/netes/appLogs"
+	"turtle/netes/manifest"
+	"turtle/netes/secrets"
+)
+
+// JobAttempt is one run of a job process, jobs are not kept in Supervisor
+// because one app can have several runs at the same time
+type JobAttempt struct {
+	App        string
+	RevisionId string
+	Dir        string
+	Manifest   *manifest.Manifest
+	// Instance separates concurrent runs, names cgroup leaf, secrets dir and instance dir
+	Instance string
+	// Output gets copy of stdout and stderr, e.g. to store it with the job run
+	Output io.Writer
+	// OnStart is called with pid once the process runs
+	OnStart func(pid int)
+}
+
+// RunAttempt starts job process and waits until it exits. Cancelled ctx stops the
+// process like Stop does, SIGTERM first and SIGKILL after STOP_GRACE_PERIOD.
+func RunAttempt(ctx context.Context, attempt *JobAttempt) (int, error) {
+	log, err := appLogs.Open(attempt.App, attempt.RevisionId)
+	if err != nil {
+		lgr.Error("Failed to open log of job %s: %s", attempt.App, err.Error())
+	} else {
+		defer log.Close()
+	}
+
+	logf := func(format string, args ...any) {
+		if log != nil {
+			log.Systemf(0, format, args...)
+		}
+	}
+
+	defer secrets.RemoveResolved(attempt.App, attempt.Instance)
+	defer removeInstanceDir(attempt.App, attempt.Instance)
+
+	workDir, err := prepareWorkDir(&TemplateInstance{
+		App:         attempt.App,
+		RevisionId:  attempt.RevisionId,
+		Manifest:    attempt.Manifest,
+		Dir:         attempt.Dir,
+		InstanceDir: GetInstanceDir(attempt.App, attempt.Instance),
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	env, err := buildEnv(attempt.App, attempt.RevisionId, attempt.Instance, attempt.Manifest, nil)
+	if err != nil {
+		return -1, err
+	}
+
+	cmd, err := newCommand(workDir, attempt.Manifest, env)
+	if err != nil {
+		return -1, err
+	}
+
+	output := attempt.Output
+	if output == nil {
+		output = io.Discard
+	}
+
+	var stdout, stderr *appLogs.StreamWriter
+
+	if log != nil {
+		stdout = log.Writer(appLogs.STREAM_STDOUT, 0)
+		stderr = log.Writer(appLogs.STREAM_STDERR, 0)
+		cmd.Stdout = io.MultiWriter(stdout, output)
+		cmd.Stderr = io.MultiWriter(stderr, output)
+	} else {
+		cmd.Stdout = output
+		cmd.Stderr = output
+	}
+
+	cgroup, err := createCgroup(attempt.App, attempt.Instance, attempt.Manifest, logf)
+	if err != nil {
+		return -1, err
+	}
+
+	cmd, cgroup, err = startCommand(attempt.App, cmd, cgroup, attempt.Manifest)
+	if err != nil {
+		return -1, err
+	}
+
+	if cgroup != nil {
+		defer func() {
+			cgroup.Kill()
+			if err := cgroup.Remove(); err != nil {
+				lgr.Error("Failed to remove cgroup of job %s: %s", attempt.Instance, err.Error())
+			}
+		}()
+	}
+
+	logf("job %s started with pid %d", attempt.Instance, cmd.Process.Pid)
+
+	if attempt.OnStart != nil {
+		attempt.OnStart(cmd.Process.Pid)
+	}
+
+	waitCh := make(chan error, 1)
+	go func() {
+		waitCh <- cmd.Wait()
+	}()
+
+	var waitErr error
+
+	select {
+	case waitErr = <-waitCh:
+	case <-ctx.Done():
+		terminateProcess(cmd)
+
+		select {
+		case waitErr = <-waitCh:
+		case <-time.After(STOP_GRACE_PERIOD):
+			killProcess(cmd)
+			waitErr = <-waitCh
+		}
+	}
+
+	if stdout != nil {
+		stdout.Flush()
+		stderr.Flush()
+	}
+
+	exitCode := exitCodeOf(waitErr)
+
+	logf("job %s pid %d exited with code %d", attempt.Instance, cmd.Process.Pid, exitCode)
+
+	if ctx.Err() != nil {
+		return exitCode, ctx.Err()
+	}
+
+	return exitCode, nil
+}
@@ -0,0 +1,198 @@
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+)
+
+var ErrPortConflict = errors.New("port conflict")
+
+// PortAllocation tells which replica owns a port of this node
+type PortAllocation struct {
+	Port       int    `json:"port"`
+	Protocol   string `json:"protocol"`
+	Name       string `json:"name"`
+	App        string `json:"app"`
+	RevisionId string `json:"revisionId"`
+	Replica    int    `json:"replica"`
+}
+
+// portSlot is port number of one protocol, tcp and udp port with the same number
+// are different slots
+type portSlot struct {
+	Protocol string
+	Port     int
+}
+
+// PortAllocator gives replicas ports from configured range, fixed manifest ports
+// are only checked for conflicts
+type PortAllocator struct {
+	mu          sync.Mutex
+	next        int
+	allocations map[portSlot]PortAllocation
+}
+
+var PORTS = NewPortAllocator()
+
+func NewPortAllocator() *PortAllocator {
+	return &PortAllocator{
+		allocations: map[portSlot]PortAllocation{},
+	}
+}
+
+// PortKey names port in env and status, name of the port or its index
+func PortKey(index int, port manifest.Port) string {
+	if port.Name != "" {
+		return port.Name
+	}
+	return strconv.Itoa(index)
+}
+
+// PortEnvName returns TURTLE_PORT_<KEY> variable of port
+func PortEnvName(key string) string {
+	return "TURTLE_PORT_" + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(key))
+}
+
+// Allocate reserves ports of replica, all or nothing. Returned map is port key -> port.
+func (self *PortAllocator) Allocate(app, revisionId string, replica int, ports []manifest.Port) (map[string]int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	result := map[string]int{}
+	reserved := []portSlot{}
+
+	rollback := func() {
+		for _, slot := range reserved {
+			delete(self.allocations, slot)
+		}
+	}
+
+	for i, port := range ports {
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+
+		allocation := PortAllocation{
+			Protocol:   protocol,
+			Name:       PortKey(i, port),
+			App:        app,
+			RevisionId: revisionId,
+			Replica:    replica,
+		}
+
+		number := port.Port
+
+		if number > 0 {
+			if owner, ok := self.allocations[portSlot{protocol, number}]; ok {
+				rollback()
+				return nil, fmt.Errorf("%w: %s port %d is used by %s replica %d", ErrPortConflict, protocol, number, owner.App, owner.Replica)
+			}
+			if !portAvailable(number, protocol) {
+				rollback()
+				return nil, fmt.Errorf("%w: %s port %d is used by another process", ErrPortConflict, protocol, number)
+			}
+		} else {
+			var err error
+			if number, err = self.findFreeLocked(protocol); err != nil {
+				rollback()
+				return nil, err
+			}
+		}
+
+		slot := portSlot{protocol, number}
+		allocation.Port = number
+		self.allocations[slot] = allocation
+		reserved = append(reserved, slot)
+		result[allocation.Name] = number
+	}
+
+	return result, nil
+}
+
+func (self *PortAllocator) findFreeLocked(protocol string) (int, error) {
+	start, end := serverKit.SERVER_CONFIG.GetPortRange()
+	size := end - start + 1
+
+	if self.next < start || self.next > end {
+		self.next = start
+	}
+
+	// Round robin so a just released port is not reused right away
+	for i := 0; i < size; i++ {
+		port := start + (self.next-start+i)%size
+
+		if _, ok := self.allocations[portSlot{protocol, port}]; ok {
+			continue
+		}
+		if !portAvailable(port, protocol) {
+			continue
+		}
+
+		self.next = port + 1
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("%w: no free port in range %d-%d", ErrPortConflict, start, end)
+}
+
+// Release frees all ports of replica
+func (self *PortAllocator) Release(app, revisionId string, replica int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for slot, allocation := range self.allocations {
+		if allocation.App == app && allocation.RevisionId == revisionId && allocation.Replica == replica {
+			delete(self.allocations, slot)
+		}
+	}
+}
+
+// List returns allocations of app, of all apps when app is empty
+func (self *PortAllocator) List(app string) []PortAllocation {
+	self.mu.Lock()
+	result := []PortAllocation{}
+	for _, allocation := range self.allocations {
+		if app == "" || allocation.App == app {
+			result = append(result, allocation)
+		}
+	}
+	self.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Port != result[j].Port {
+			return result[i].Port < result[j].Port
+		}
+		return result[i].Protocol < result[j].Protocol
+	})
+
+	return result
+}
+
+// portAvailable tries to bind the port, it can still be taken before the app binds it
+func portAvailable(port int, protocol string) bool {
+	address := ":" + strconv.Itoa(port)
+
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", address)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
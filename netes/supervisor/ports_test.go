@@ -0,0 +1,225 @@
+package supervisor
+
+import (
+	"errors"
+	"maps"
+	"net"
+	"strconv"
+	"testing"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+)
+
+// Stands for fixed port outside of allocation range in test steps
+const FIXED_PORT = -1
+
+type allocationStep struct {
+	app     string
+	replica int
+	ports   []manifest.Port
+	// Releases ports of app replica instead of allocating
+	release bool
+	// Port key -> offset in allocation range or FIXED_PORT
+	want    map[string]int
+	wantErr bool
+}
+
+// freeRange returns first port of size consecutive ports nobody listens on
+func freeRange(t *testing.T, size int) int {
+	t.Helper()
+
+	for attempt := 0; attempt < 20; attempt++ {
+		start := freePort(t)
+		if start+size > 65535 {
+			continue
+		}
+
+		free := true
+		for port := start; port < start+size; port++ {
+			if !portAvailable(port, "tcp") {
+				free = false
+				break
+			}
+		}
+		if free {
+			return start
+		}
+	}
+
+	t.Fatalf("no %d free consecutive ports", size)
+	return 0
+}
+
+func TestPortAllocator(t *testing.T) {
+	tests := []struct {
+		name string
+		// Offsets in allocation range used by another process
+		busy  []int
+		steps []allocationStep
+		// Allocations of app "a" left after all steps
+		wantLeft int
+	}{
+		{
+			name: "automatic ports in order",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{Name: "http"}}, want: map[string]int{"http": 0}},
+				{app: "a", replica: 1, ports: []manifest.Port{{Name: "http"}}, want: map[string]int{"http": 1}},
+			},
+			wantLeft: 2,
+		},
+		{
+			name: "unnamed ports are keyed by index",
+			steps: []allocationStep{
+				{app: "a", ports: []manifest.Port{{}, {Name: "admin"}, {}}, want: map[string]int{"0": 0, "admin": 1, "2": 2}},
+			},
+			wantLeft: 3,
+		},
+		{
+			name: "released port is not reused right away",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{}}, want: map[string]int{"0": 0}},
+				{app: "a", replica: 0, release: true},
+				{app: "a", replica: 1, ports: []manifest.Port{{}}, want: map[string]int{"0": 1}},
+			},
+			wantLeft: 1,
+		},
+		{
+			name: "range is exhausted",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{}, {}}, want: map[string]int{"0": 0, "1": 1}},
+				{app: "a", replica: 1, ports: []manifest.Port{{}}, want: map[string]int{"0": 2}},
+				{app: "a", replica: 2, ports: []manifest.Port{{}}, wantErr: true},
+			},
+			wantLeft: 3,
+		},
+		{
+			name: "port of another process is skipped",
+			busy: []int{0},
+			steps: []allocationStep{
+				{app: "a", ports: []manifest.Port{{}}, want: map[string]int{"0": 1}},
+			},
+			wantLeft: 1,
+		},
+		{
+			name: "fixed port",
+			steps: []allocationStep{
+				{app: "a", ports: []manifest.Port{{Name: "http", Port: FIXED_PORT}}, want: map[string]int{"http": FIXED_PORT}},
+			},
+			wantLeft: 1,
+		},
+		{
+			name: "fixed port of another replica",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", replica: 1, ports: []manifest.Port{{Port: FIXED_PORT}}, wantErr: true},
+			},
+			wantLeft: 1,
+		},
+		{
+			name: "failed allocation reserves nothing",
+			steps: []allocationStep{
+				{app: "b", ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", ports: []manifest.Port{{}, {Port: FIXED_PORT}}, wantErr: true},
+			},
+			wantLeft: 0,
+		},
+		{
+			name: "fixed tcp and udp port with the same number",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", replica: 1, ports: []manifest.Port{{Port: FIXED_PORT, Protocol: "udp"}}, want: map[string]int{"0": FIXED_PORT}},
+			},
+			wantLeft: 2,
+		},
+		{
+			name: "releasing udp port keeps tcp port with the same number",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", replica: 1, ports: []manifest.Port{{Port: FIXED_PORT, Protocol: "udp"}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", replica: 1, release: true},
+				{app: "a", replica: 2, ports: []manifest.Port{{Port: FIXED_PORT}}, wantErr: true},
+			},
+			wantLeft: 1,
+		},
+		{
+			name: "released fixed port is free again",
+			steps: []allocationStep{
+				{app: "a", replica: 0, ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+				{app: "a", replica: 0, release: true},
+				{app: "a", replica: 0, ports: []manifest.Port{{Port: FIXED_PORT}}, want: map[string]int{"0": FIXED_PORT}},
+			},
+			wantLeft: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useTestConfig(t)
+
+			start := freeRange(t, 3)
+			serverKit.SERVER_CONFIG.PortRangeStart = start
+			serverKit.SERVER_CONFIG.PortRangeEnd = start + 2
+
+			fixed := freePort(t)
+			for fixed >= start && fixed <= start+2 {
+				fixed = freePort(t)
+			}
+
+			for _, offset := range test.busy {
+				listener, err := net.Listen("tcp", ":"+strconv.Itoa(start+offset))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+			}
+
+			resolve := func(value int) int {
+				if value == FIXED_PORT {
+					return fixed
+				}
+				return start + value
+			}
+
+			allocator := NewPortAllocator()
+
+			for i, step := range test.steps {
+				if step.release {
+					allocator.Release(step.app, "rev", step.replica)
+					continue
+				}
+
+				ports := make([]manifest.Port, len(step.ports))
+				for j, port := range step.ports {
+					if port.Port == FIXED_PORT {
+						port.Port = fixed
+					}
+					ports[j] = port
+				}
+
+				got, err := allocator.Allocate(step.app, "rev", step.replica, ports)
+
+				if step.wantErr {
+					if !errors.Is(err, ErrPortConflict) {
+						t.Fatalf("step %d: Allocate() error = %v, want ErrPortConflict", i, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("step %d: Allocate() failed: %v", i, err)
+				}
+
+				want := map[string]int{}
+				for key, value := range step.want {
+					want[key] = resolve(value)
+				}
+				if !maps.Equal(got, want) {
+					t.Fatalf("step %d: Allocate() = %v, want %v", i, got, want)
+				}
+			}
+
+			if left := allocator.List("a"); len(left) != test.wantLeft {
+				t.Fatalf("List() = %v, want %d allocations", left, test.wantLeft)
+			}
+		})
+	}
+}
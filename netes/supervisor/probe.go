@@ -0,0 +1,258 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/tools"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+)
+
+const (
+	PROBE_LIVENESS  = "liveness"
+	PROBE_READINESS = "readiness"
+)
+
+var errLivenessFailed = errors.New("liveness probe failed")
+
+// Exec probe output is read this long after its process group was killed on timeout
+const PROBE_WAIT_DELAY = 1 * time.Second
+
+var probeClient = &http.Client{
+	// Redirect response is a success, it is not followed
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+	Transport: &http.Transport{
+		Proxy:             nil,
+		DisableKeepAlives: true,
+	},
+}
+
+// RunProbe runs one check against replica listening on port, error tells why it failed
+func RunProbe(ctx context.Context, check *manifest.HealthCheck, port int, dir string, env []string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(check.TimeoutSeconds)*time.Second)
+	defer cancel()
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+
+	switch check.Type {
+	case manifest.HEALTH_CHECK_HTTP:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+address+check.Path, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "turtle-probe")
+
+		resp, err := probeClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("http status %d", resp.StatusCode)
+		}
+		return nil
+
+	case manifest.HEALTH_CHECK_TCP:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+
+	case manifest.HEALTH_CHECK_EXEC:
+		workDir, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+
+		command, err := ResolveCommand(workDir, check.Command[0])
+		if err != nil {
+			return err
+		}
+
+		cmd := exec.CommandContext(ctx, command, check.Command[1:]...)
+		cmd.Dir = workDir
+		cmd.Env = env
+		// Timed out probe is killed with its whole process group, children included
+		setProcessAttributes(cmd)
+		cmd.Cancel = func() error {
+			killProcess(cmd)
+			return nil
+		}
+		cmd.WaitDelay = PROBE_WAIT_DELAY
+
+		output, err := cmd.CombinedOutput()
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %ds", check.TimeoutSeconds)
+		}
+		if err != nil && len(output) > 0 {
+			return fmt.Errorf("%w: %s", err, truncate(strings.TrimSpace(string(output)), 200))
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown health check type %q", check.Type)
+}
+
+// probePort resolves port of http and tcp checks for replica
+func (self *AppProcess) probePort(check *manifest.HealthCheck) int {
+	switch {
+	case check.PortName != "":
+		return self.ports[check.PortName]
+	case check.Port > 0:
+		return check.Port
+	case len(self.manifest.Ports) > 0:
+		return self.ports[PortKey(0, self.manifest.Ports[0])]
+	}
+	return 0
+}
+
+// startProbes runs probes of one run of the process until ctx is canceled,
+// replica without readiness probe is ready as soon as it runs
+func (self *AppProcess) startProbes(ctx context.Context, cmd *exec.Cmd) {
+	readiness := self.manifest.ReadinessProbe
+
+	self.mu.Lock()
+	self.ready = readiness == nil
+	self.probeError = ""
+	self.mu.Unlock()
+
+	if readiness != nil {
+		go tools.SafeGoRoutine(func() {
+			self.probeLoop(ctx, PROBE_READINESS, readiness, cmd)
+		})
+	}
+	if liveness := self.manifest.LivenessProbe; liveness != nil {
+		go tools.SafeGoRoutine(func() {
+			self.probeLoop(ctx, PROBE_LIVENESS, liveness, cmd)
+		})
+	}
+}
+
+func (self *AppProcess) probeLoop(ctx context.Context, kind string, check *manifest.HealthCheck, cmd *exec.Cmd) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(time.Duration(check.InitialDelaySeconds) * time.Second):
+	}
+
+	ticker := time.NewTicker(time.Duration(check.IntervalSeconds) * time.Second)
+	defer ticker.Stop()
+
+	env := processEnv(self.app, self.revisionId, self.manifest, self.replicaEnv())
+	successes, failures := 0, 0
+
+	for {
+		err := RunProbe(ctx, check, self.probePort(check), cmd.Dir, env)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			failures++
+			successes = 0
+		}
+
+		if kind == PROBE_READINESS {
+			self.readinessResult(check, successes, failures, err)
+		} else if failures == check.FailureThreshold {
+			self.livenessFailed(ctx, cmd, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readinessResult updates ready flag, log and event are written after unlocking
+func (self *AppProcess) readinessResult(check *manifest.HealthCheck, successes, failures int, err error) {
+	self.mu.Lock()
+	if err != nil {
+		self.probeError = PROBE_READINESS + ": " + err.Error()
+	}
+
+	becameReady, becameNotReady := false, false
+
+	if !self.ready && successes == check.SuccessThreshold {
+		self.ready = true
+		self.probeError = ""
+		becameReady = true
+	} else if self.ready && failures == check.FailureThreshold {
+		self.ready = false
+		becameNotReady = true
+	}
+	self.mu.Unlock()
+
+	if becameReady {
+		self.logSystem("ready")
+	} else if becameNotReady {
+		lgr.Error("App %s replica %d is not ready: %s", self.app, self.replica, err.Error())
+		self.logSystem("not ready after %d failed readiness probes: %s", failures, err.Error())
+		self.emitEvent(events.EVENT_PROBE_FAILED, events.LEVEL_WARNING, "not ready after %d failed readiness probes: %s", failures, err.Error())
+	}
+}
+
+// livenessFailed terminates the process of the run, watch loop restarts it.
+// With restartPolicy never the replica is failed right away, it is not restarted.
+func (self *AppProcess) livenessFailed(ctx context.Context, cmd *exec.Cmd, err error) {
+	action := "restarting"
+	restart := ShouldRestart(self.manifest.RestartPolicy, 0, errLivenessFailed)
+	if !restart {
+		action = "stopping"
+	}
+
+	self.mu.Lock()
+	if self.cmd != cmd || !self.running {
+		self.mu.Unlock()
+		return
+	}
+	self.livenessKilled = true
+	self.probeError = PROBE_LIVENESS + ": " + err.Error()
+	if !restart {
+		self.state = STATE_FAILED
+		self.lastError = errLivenessFailed.Error()
+	}
+	terminateProcess(cmd)
+	self.mu.Unlock()
+
+	lgr.Error("App %s replica %d failed liveness probe, %s: %s", self.app, self.replica, action, err.Error())
+	self.logSystem("liveness probe failed %d times, %s: %s", self.manifest.LivenessProbe.FailureThreshold, action, err.Error())
+	self.emitEvent(events.EVENT_PROBE_FAILED, events.LEVEL_WARNING, "liveness probe failed %d times, %s: %s", self.manifest.LivenessProbe.FailureThreshold, action, err.Error())
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(STOP_GRACE_PERIOD):
+		self.mu.Lock()
+		if self.cmd == cmd && self.running {
+			killProcess(cmd)
+		}
+		self.mu.Unlock()
+	}
+}
+
+func truncate(value string, length int) string {
+	if len(value) <= length {
+		return value
+	}
+	return value[:length] + "..."
+}
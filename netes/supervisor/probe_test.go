@@ -0,0 +1,53 @@
+package supervisor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"turtle/netes/manifest"
+)
+
+func TestExecProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		command []string
+		// Deploy folder relative to working directory of node when set
+		relative bool
+		wantErr  bool
+	}{
+		{name: "absolute deploy dir", command: []string{"./check.sh"}},
+		{name: "relative deploy dir", command: []string{"./check.sh"}, relative: true},
+		{name: "relative deploy dir reads file of revision", command: []string{"sh", "-c", "test -f check.sh"}, relative: true},
+		{name: "failing check", command: []string{"sh", "-c", "exit 3"}, relative: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useTestConfig(t)
+			if tt.relative {
+				t.Chdir(root)
+				root = "deployments"
+			}
+
+			dir := filepath.Join(root, "app", "rev1")
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, "check.sh"), []byte(EXITING_SCRIPT), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			check := &manifest.HealthCheck{
+				Type:           manifest.HEALTH_CHECK_EXEC,
+				Command:        tt.command,
+				TimeoutSeconds: 5,
+			}
+
+			err := RunProbe(context.Background(), check, 0, dir, os.Environ())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("probe error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,659 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/serverKit"
+	"turtle/netes/appLogs"
+	"turtle/netes/cgroups"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+	"turtle/netes/secrets"
+)
+
+// Time limit of loading secrets before each start
+const RESOLVE_SECRETS_TIMEOUT = 10 * time.Second
+
+// ProcessStatus is a snapshot of supervised process, safe to serialize
+type ProcessStatus struct {
+	App           string    `json:"app"`
+	RevisionId    string    `json:"revisionId"`
+	Version       string    `json:"version"`
+	Replica       int       `json:"replica"`
+	State         string    `json:"state"`
+	Pid           int       `json:"pid"`
+	ExitCode      int       `json:"exitCode"`
+	RestartCount  int       `json:"restartCount"`
+	LastError     string    `json:"lastError,omitempty"`
+	StartedAt     time.Time `json:"startedAt"`
+	ExitedAt      time.Time `json:"exitedAt"`
+	NextRestartAt time.Time `json:"nextRestartAt"`
+	// Port key (name or index) -> port given to this replica
+	Ports map[string]int `json:"ports,omitempty"`
+	// First port of manifest, the one in PORT variable
+	Port int `json:"port,omitempty"`
+	// Running and passing readiness probe, only ready replicas get traffic
+	Ready bool `json:"ready"`
+	// Last failed probe while replica is not ready or was restarted by liveness probe
+	ProbeError string `json:"probeError,omitempty"`
+	// Usage of app cgroup, nil when app does not run in a cgroup
+	Usage *cgroups.Usage `json:"usage,omitempty"`
+}
+
+// AppProcess supervises one replica of app revision and restarts it by manifest restart policy
+type AppProcess struct {
+	app        string
+	revisionId string
+	replica    int
+	dir        string
+	manifest   *manifest.Manifest
+	ports      map[string]int
+	// Output of all runs of this revision, nil when log could not be opened
+	log *appLogs.AppLog
+	// Cgroup of the process, nil when cgroups are not available
+	cgroup *cgroups.Cgroup
+
+	mu            sync.Mutex
+	cmd           *exec.Cmd
+	running       bool
+	state         string
+	pid           int
+	exitCode      int
+	restartCount  int
+	lastError     string
+	startedAt     time.Time
+	exitedAt      time.Time
+	nextRestartAt time.Time
+	// Probe results of current run
+	ready          bool
+	probeError     string
+	livenessKilled bool
+
+	stopOnce sync.Once
+	stopCh   chan struct{}
+	done     chan struct{}
+}
+
+func newAppProcess(app, revisionId string, replica int, dir string, appManifest *manifest.Manifest, ports map[string]int) *AppProcess {
+	return &AppProcess{
+		app:        app,
+		revisionId: revisionId,
+		replica:    replica,
+		dir:        dir,
+		manifest:   appManifest,
+		ports:      ports,
+		state:      STATE_STARTING,
+		stopCh:     make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+func (self *AppProcess) Status() ProcessStatus {
+	status := self.snapshot()
+
+	self.mu.Lock()
+	cgroup := self.cgroup
+	self.mu.Unlock()
+
+	if cgroup != nil {
+		usage := cgroup.Usage()
+		status.Usage = &usage
+	}
+
+	return status
+}
+
+// snapshot is status without cgroup usage, cheap enough for every proxied request
+func (self *AppProcess) snapshot() ProcessStatus {
+	self.mu.Lock()
+	status := ProcessStatus{
+		App:           self.app,
+		RevisionId:    self.revisionId,
+		Version:       self.manifest.Version,
+		Replica:       self.replica,
+		Ports:         self.ports,
+		State:         self.state,
+		Pid:           self.pid,
+		ExitCode:      self.exitCode,
+		RestartCount:  self.restartCount,
+		LastError:     self.lastError,
+		StartedAt:     self.startedAt,
+		ExitedAt:      self.exitedAt,
+		NextRestartAt: self.nextRestartAt,
+		Ready:         self.state == STATE_RUNNING && self.ready,
+		ProbeError:    self.probeError,
+	}
+	self.mu.Unlock()
+
+	if len(self.manifest.Ports) > 0 {
+		status.Port = self.ports[PortKey(0, self.manifest.Ports[0])]
+	}
+
+	return status
+}
+
+// PortOf returns port of replica by port key, the first port for empty key
+func (self *ProcessStatus) PortOf(key string) (int, bool) {
+	if key == "" {
+		return self.Port, self.Port > 0
+	}
+	port, ok := self.Ports[key]
+	return port, ok
+}
+
+// Stop terminates process gracefully and waits until watcher exits
+func (self *AppProcess) Stop() {
+	self.stopOnce.Do(func() {
+		close(self.stopCh)
+	})
+
+	self.signalTerminate()
+
+	select {
+	case <-self.done:
+		return
+	case <-time.After(STOP_GRACE_PERIOD):
+	}
+
+	lgr.Error("App %s did not stop in %s, killing it", self.app, STOP_GRACE_PERIOD)
+	self.signalKill()
+
+	<-self.done
+}
+
+func (self *AppProcess) isStopping() bool {
+	select {
+	case <-self.stopCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *AppProcess) setState(state string) {
+	self.mu.Lock()
+	self.state = state
+	self.mu.Unlock()
+}
+
+// watch is the supervising loop, it runs inside tools.SafeGoRoutine
+func (self *AppProcess) watch() {
+	defer self.watcherExited()
+
+	self.openLog()
+
+	crashCount := 0
+
+	for {
+		if self.isStopping() {
+			self.setState(STATE_STOPPED)
+			return
+		}
+
+		startedAt := time.Now()
+		exitCode, err := self.runOnce()
+
+		if self.isStopping() {
+			self.setState(STATE_STOPPED)
+			return
+		}
+
+		if !ShouldRestart(self.manifest.RestartPolicy, exitCode, err) {
+			if err != nil || exitCode != 0 {
+				self.setState(STATE_FAILED)
+			} else {
+				self.setState(STATE_EXITED)
+			}
+			return
+		}
+
+		if time.Since(startedAt) > BACKOFF_RESET_AFTER {
+			crashCount = 0
+		}
+
+		delay := NextBackoff(crashCount)
+		crashCount++
+
+		self.mu.Lock()
+		self.state = STATE_BACKOFF
+		self.nextRestartAt = time.Now().Add(delay)
+		self.mu.Unlock()
+
+		lgr.Error("App %s replica %d exited with code %d, restarting in %s", self.app, self.replica, exitCode, delay)
+
+		select {
+		case <-self.stopCh:
+			self.setState(STATE_STOPPED)
+			return
+		case <-time.After(delay):
+		}
+
+		self.mu.Lock()
+		self.restartCount++
+		self.nextRestartAt = time.Time{}
+		self.mu.Unlock()
+	}
+}
+
+// watcherExited closes done channel, also when watcher panicked
+func (self *AppProcess) watcherExited() {
+	self.mu.Lock()
+	switch self.state {
+	case STATE_STOPPED, STATE_EXITED, STATE_FAILED:
+	default:
+		self.state = STATE_FAILED
+		self.lastError = "supervisor watcher exited unexpectedly"
+	}
+	self.mu.Unlock()
+
+	self.removeCgroup()
+
+	PORTS.Release(self.app, self.revisionId, self.replica)
+
+	if err := secrets.RemoveResolved(self.app, self.instance()); err != nil {
+		lgr.Error("Failed to remove secrets of app %s: %s", self.app, err.Error())
+	}
+
+	if err := removeInstanceDir(self.app, self.instance()); err != nil {
+		lgr.Error("Failed to remove instance folder of app %s: %s", self.app, err.Error())
+	}
+
+	if self.log != nil {
+		self.log.Close()
+	}
+
+	close(self.done)
+}
+
+func (self *AppProcess) openLog() {
+	log, err := appLogs.Open(self.app, self.revisionId)
+	if err != nil {
+		lgr.Error("Failed to open log of app %s, output goes to listener stdout: %s", self.app, err.Error())
+		return
+	}
+	self.log = log
+}
+
+// instance names cgroup leaf, secrets dir and instance dir, replicas of two revisions run
+// side by side during updates
+func (self *AppProcess) instance() string {
+	return fmt.Sprintf("%s-%d", self.revisionId, self.replica)
+}
+
+func (self *AppProcess) prepareCgroup() (*cgroups.Cgroup, error) {
+	return createCgroup(self.app, self.instance(), self.manifest, self.logSystem)
+}
+
+func (self *AppProcess) removeCgroup() {
+	self.mu.Lock()
+	cgroup := self.cgroup
+	self.cgroup = nil
+	self.mu.Unlock()
+
+	if cgroup == nil {
+		return
+	}
+
+	// Kill leftovers which left the process group, e.g. daemonized children
+	cgroup.Kill()
+	if err := cgroup.Remove(); err != nil {
+		lgr.Error("Failed to remove cgroup of app %s: %s", self.app, err.Error())
+	}
+}
+
+func (self *AppProcess) logSystem(format string, args ...any) {
+	if self.log != nil {
+		self.log.Systemf(self.replica, format, args...)
+	}
+}
+
+// emitEvent records state change of the replica as deployment event
+func (self *AppProcess) emitEvent(eventType, level, format string, args ...any) {
+	replica := self.replica
+	events.Emit(events.Event{
+		Type:       eventType,
+		Level:      level,
+		App:        self.app,
+		RevisionId: self.revisionId,
+		Replica:    &replica,
+		Message:    fmt.Sprintf(format, args...),
+	})
+}
+
+// runOnce starts the process and blocks until it exits, error tells the process
+// could not start or was killed by liveness probe
+func (self *AppProcess) runOnce() (int, error) {
+	cmd, stdout, stderr, err := self.buildCommand()
+
+	var cgroup *cgroups.Cgroup
+	if err == nil {
+		cgroup, err = self.prepareCgroup()
+	}
+
+	if err == nil {
+		self.mu.Lock()
+		// Stop could come while building the command, don't start then
+		if self.isStopping() {
+			self.mu.Unlock()
+			if cgroup != nil {
+				cgroup.Remove()
+			}
+			return 0, nil
+		}
+		cmd, cgroup, err = startCommand(self.app, cmd, cgroup, self.manifest)
+		if err == nil {
+			self.cgroup = cgroup
+			self.cmd = cmd
+			self.running = true
+			self.state = STATE_RUNNING
+			self.pid = cmd.Process.Pid
+			self.startedAt = time.Now()
+			self.lastError = ""
+		}
+		self.mu.Unlock()
+	}
+
+	if err != nil {
+		self.mu.Lock()
+		self.exitCode = -1
+		self.lastError = err.Error()
+		self.exitedAt = time.Now()
+		self.mu.Unlock()
+
+		lgr.Error("Failed to start app %s: %s", self.app, err.Error())
+		self.logSystem("failed to start: %s", err.Error())
+		self.emitEvent(events.EVENT_PROCESS_FAILED, events.LEVEL_WARNING, "failed to start: %s", err.Error())
+		return -1, err
+	}
+
+	self.logSystem("started with pid %d", cmd.Process.Pid)
+	self.emitEvent(events.EVENT_PROCESS_STARTED, events.LEVEL_NORMAL, "started with pid %d", cmd.Process.Pid)
+
+	probeCtx, cancelProbes := context.WithCancel(context.Background())
+	self.startProbes(probeCtx, cmd)
+
+	waitErr := cmd.Wait()
+	cancelProbes()
+
+	if stdout != nil {
+		stdout.Flush()
+		stderr.Flush()
+	}
+
+	exitCode := exitCodeOf(waitErr)
+
+	self.mu.Lock()
+	self.running = false
+	self.ready = false
+	self.exitCode = exitCode
+	self.exitedAt = time.Now()
+	if waitErr != nil {
+		self.lastError = waitErr.Error()
+	}
+	// Restarted by liveness probe even when it exited cleanly on SIGTERM
+	var probeErr error
+	if self.livenessKilled {
+		self.livenessKilled = false
+		self.lastError = errLivenessFailed.Error()
+		probeErr = errLivenessFailed
+	}
+	self.mu.Unlock()
+
+	lgr.Info("App %s replica %d (pid %d) exited with code %d", self.app, self.replica, cmd.Process.Pid, exitCode)
+	self.logSystem("pid %d exited with code %d", cmd.Process.Pid, exitCode)
+
+	level := events.LEVEL_NORMAL
+	if !self.isStopping() && (exitCode != 0 || probeErr != nil) {
+		level = events.LEVEL_WARNING
+	}
+	self.emitEvent(events.EVENT_PROCESS_EXITED, level, "pid %d exited with code %d", cmd.Process.Pid, exitCode)
+
+	return exitCode, probeErr
+}
+
+// buildCommand returns line writers of stdout and stderr, they are nil when app log is not open
+func (self *AppProcess) buildCommand() (*exec.Cmd, *appLogs.StreamWriter, *appLogs.StreamWriter, error) {
+	workDir, err := prepareWorkDir(&TemplateInstance{
+		App:         self.app,
+		RevisionId:  self.revisionId,
+		Replica:     self.replica,
+		Manifest:    self.manifest,
+		Dir:         self.dir,
+		InstanceDir: GetInstanceDir(self.app, self.instance()),
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	env, err := buildEnv(self.app, self.revisionId, self.instance(), self.manifest, self.replicaEnv())
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	cmd, err := newCommand(workDir, self.manifest, env)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var stdout, stderr *appLogs.StreamWriter
+
+	if self.log != nil {
+		stdout = self.log.Writer(appLogs.STREAM_STDOUT, self.replica)
+		stderr = self.log.Writer(appLogs.STREAM_STDERR, self.replica)
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+	} else {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	return cmd, stdout, stderr, nil
+}
+
+func newCommand(dir string, appManifest *manifest.Manifest, env []string) (*exec.Cmd, error) {
+	command, err := ResolveCommand(dir, appManifest.Command)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(command, appManifest.Args...)
+	cmd.Dir = dir
+	cmd.Env = env
+
+	setProcessAttributes(cmd)
+
+	return cmd, nil
+}
+
+// replicaEnv tells replica its index and ports, first port is also in PORT
+func (self *AppProcess) replicaEnv() []string {
+	env := []string{"TURTLE_REPLICA_INDEX=" + strconv.Itoa(self.replica)}
+
+	for i, port := range self.manifest.Ports {
+		key := PortKey(i, port)
+		number := strconv.Itoa(self.ports[key])
+
+		if i == 0 {
+			env = append(env, "PORT="+number)
+		}
+		env = append(env, PortEnvName(key)+"="+number)
+	}
+
+	return env
+}
+
+// GetInstanceDir is working folder of replica or job run of app with config templates,
+// package files are hardlinked from revision folder and templates rendered next to them
+func GetInstanceDir(app, instance string) string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".instances", app, instance)
+}
+
+// GetAppDataDir is writable folder of app kept across revisions, files of revision
+// are read-only hardlinks into artifact store
+func GetAppDataDir(app string) string {
+	return filepath.Join(serverKit.SERVER_CONFIG.GetDeployDir(), ".data", app)
+}
+
+// processEnv is environment of app process without secrets, exec probes run with it too
+func processEnv(app, revisionId string, appManifest *manifest.Manifest, extra []string) []string {
+	env := os.Environ()
+
+	for key, value := range appManifest.Env {
+		env = append(env, key+"="+value)
+	}
+
+	env = append(env,
+		"TURTLE_APP="+app,
+		"TURTLE_REVISION="+revisionId,
+		"TURTLE_VERSION="+appManifest.Version,
+		"TURTLE_DATA_DIR="+GetAppDataDir(app),
+	)
+
+	return append(env, extra...)
+}
+
+// buildEnv resolves secrets on every start so restarted process gets current values,
+// file secrets are written to secrets dir of instance
+func buildEnv(app, revisionId, instance string, appManifest *manifest.Manifest, extra []string) ([]string, error) {
+	if err := os.MkdirAll(GetAppDataDir(app), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data dir: %w", err)
+	}
+
+	env := processEnv(app, revisionId, appManifest, extra)
+
+	ctx, cancel := context.WithTimeout(context.Background(), RESOLVE_SECRETS_TIMEOUT)
+	defer cancel()
+
+	secretEnv, err := secrets.Resolve(ctx, app, instance, appManifest.Secrets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve secrets: %w", err)
+	}
+
+	return append(env, secretEnv...), nil
+}
+
+// createCgroup creates cgroup of app instance with manifest limits, failure is
+// fatal only when the manifest requests limits
+func createCgroup(app, instance string, appManifest *manifest.Manifest, logf func(string, ...any)) (*cgroups.Cgroup, error) {
+	limits := cgroups.LimitsFromResources(appManifest.Resources)
+
+	if !cgroupsSupported {
+		if !limits.IsEmpty() {
+			logf("resource limits are not enforced on this platform")
+		}
+		return nil, nil
+	}
+
+	cgroup, err := cgroups.Create(app, instance, limits)
+	if err == nil {
+		return cgroup, nil
+	}
+
+	if limits.IsEmpty() {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("failed to enforce resource limits: %w", err)
+}
+
+// startCommand starts process directly inside cgroup, so limits apply from its first
+// instruction and children it forks can't escape. When that fails and no limits are
+// requested the process starts outside of cgroup. Returned cmd is the started one,
+// returned cgroup is nil when process is not in it.
+func startCommand(app string, cmd *exec.Cmd, cgroup *cgroups.Cgroup, appManifest *manifest.Manifest) (*exec.Cmd, *cgroups.Cgroup, error) {
+	if cgroup == nil {
+		return cmd, nil, cmd.Start()
+	}
+
+	err := startInCgroup(cmd, cgroup)
+	if err == nil {
+		return cmd, cgroup, nil
+	}
+
+	cgroup.Remove()
+
+	if !cgroups.LimitsFromResources(appManifest.Resources).IsEmpty() {
+		return cmd, nil, fmt.Errorf("failed to start process in cgroup: %w", err)
+	}
+
+	lgr.Error("Failed to start app %s in cgroup, starting it without one: %s", app, err.Error())
+
+	// Cmd can't be started twice, even after failed start
+	plain := &exec.Cmd{
+		Path:   cmd.Path,
+		Args:   cmd.Args,
+		Dir:    cmd.Dir,
+		Env:    cmd.Env,
+		Stdin:  cmd.Stdin,
+		Stdout: cmd.Stdout,
+		Stderr: cmd.Stderr,
+	}
+	setProcessAttributes(plain)
+
+	return plain, nil, plain.Start()
+}
+
+// exitCodeOf returns exit code of cmd.Wait error, -1 when process did not exit normally
+func exitCodeOf(waitErr error) int {
+	if waitErr == nil {
+		return 0
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(waitErr, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
+
+func (self *AppProcess) signalTerminate() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.running && self.cmd != nil && self.cmd.Process != nil {
+		terminateProcess(self.cmd)
+	}
+}
+
+func (self *AppProcess) signalKill() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.running && self.cmd != nil && self.cmd.Process != nil {
+		killProcess(self.cmd)
+	}
+}
+
+// ResolveCommand resolves relative paths ("./bin/app", "bin/app") inside revision
+// folder and bare names ("python3") from PATH. Resolved path is absolute, relative
+// one would be resolved again against cmd.Dir which is the same revision folder
+func ResolveCommand(dir, command string) (string, error) {
+	if filepath.IsAbs(command) {
+		return command, nil
+	}
+
+	if strings.ContainsAny(command, `/\`) {
+		resolved, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(command)))
+		if err != nil {
+			return "", err
+		}
+
+		if _, err := os.Stat(resolved); err != nil {
+			return "", fmt.Errorf("command %s not found in package: %w", command, err)
+		}
+
+		return resolved, nil
+	}
+
+	return exec.LookPath(command)
+}
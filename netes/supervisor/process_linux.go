@@ -0,0 +1,43 @@
+//go:build linux
+
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"turtle/netes/cgroups"
+)
+
+// Processes are placed into cgroup v2 sub-trees only on Linux
+const cgroupsSupported = true
+
+// Own process group so signals reach whole process tree, child dies with listener
+func setProcessAttributes(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid:   true,
+		Pdeathsig: syscall.SIGKILL,
+	}
+}
+
+// startInCgroup clones process straight into cgroup, needs kernel 5.7
+func startInCgroup(cmd *exec.Cmd, cgroup *cgroups.Cgroup) error {
+	dir, err := os.Open(cgroup.Path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+
+	return cmd.Start()
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+}
+
+func killProcess(cmd *exec.Cmd) {
+	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
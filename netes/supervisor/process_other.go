@@ -0,0 +1,29 @@
+//go:build !linux
+
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"turtle/netes/cgroups"
+)
+
+const cgroupsSupported = false
+
+func setProcessAttributes(cmd *exec.Cmd) {
+}
+
+// startInCgroup is not reached, cgroups are not created on this platform
+func startInCgroup(cmd *exec.Cmd, cgroup *cgroups.Cgroup) error {
+	return cmd.Start()
+}
+
+func terminateProcess(cmd *exec.Cmd) {
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		cmd.Process.Kill()
+	}
+}
+
+func killProcess(cmd *exec.Cmd) {
+	cmd.Process.Kill()
+}
@@ -0,0 +1,44 @@
+package supervisor
+
+import (
+	"path/filepath"
+	"testing"
+	"turtle/netes/manifest"
+)
+
+const EXITING_SCRIPT = "#!/bin/sh\nexit 0\n"
+
+func TestNewCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		// Deploy folder relative to working directory of node when set
+		relative bool
+	}{
+		{name: "absolute deploy dir", command: "./run.sh"},
+		{name: "relative deploy dir", command: "./run.sh", relative: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := useTestConfig(t)
+			if tt.relative {
+				t.Chdir(root)
+				root = "deployments"
+			}
+
+			dir := writeRevision(t, filepath.Join(root, "app"), "rev1", EXITING_SCRIPT)
+
+			cmd, err := newCommand(dir, &manifest.Manifest{Command: tt.command}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !filepath.IsAbs(cmd.Path) {
+				t.Errorf("command path %s is not absolute", cmd.Path)
+			}
+			if err := cmd.Run(); err != nil {
+				t.Fatalf("run in %s: %v", dir, err)
+			}
+		})
+	}
+}
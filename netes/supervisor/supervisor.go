@@ -0,0 +1,440 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/tools"
+	"turtle/netes/manifest"
+)
+
+const (
+	STATE_STARTING = "starting"
+	STATE_RUNNING  = "running"
+	STATE_BACKOFF  = "backoff"
+	STATE_EXITED   = "exited"
+	STATE_STOPPED  = "stopped"
+	STATE_FAILED   = "failed"
+)
+
+var (
+	// First restart waits BACKOFF_MIN, every next crash doubles it up to BACKOFF_MAX
+	BACKOFF_MIN = 1 * time.Second
+	BACKOFF_MAX = 5 * time.Minute
+	// Process running longer than this is considered healthy and backoff is reset
+	BACKOFF_RESET_AFTER = 1 * time.Minute
+	// How long to wait after SIGTERM before SIGKILL
+	STOP_GRACE_PERIOD = 10 * time.Second
+	// How often WaitReady checks replicas
+	READY_POLL_INTERVAL = 500 * time.Millisecond
+)
+
+var (
+	ErrAppNotFound     = errors.New("app not found")
+	ErrReplicaNotFound = errors.New("replica not found")
+	ErrNotReady        = errors.New("replicas are not ready")
+)
+
+// Supervisor keeps replicas of apps, replicas of two revisions of one app can
+// run side by side while the app is being updated
+type Supervisor struct {
+	mu        sync.Mutex
+	processes map[string][]*AppProcess
+	// Last update of every app
+	updates map[string]*appUpdate
+	// Blue/green apps
+	colors map[string]*appColors
+}
+
+var SUPERVISOR = NewSupervisor()
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		processes: map[string][]*AppProcess{},
+		updates:   map[string]*appUpdate{},
+		colors:    map[string]*appColors{},
+	}
+}
+
+// Start replaces all replicas of app with replicas of revision at once
+func (self *Supervisor) Start(app, revisionId, dir string, appManifest *manifest.Manifest, replicas int) ([]ProcessStatus, error) {
+	self.cancelUpdate(app)
+
+	self.mu.Lock()
+	previous := self.processes[app]
+	delete(self.processes, app)
+	delete(self.colors, app)
+	self.mu.Unlock()
+
+	stopAll(previous)
+
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	result := []ProcessStatus{}
+
+	for replica := 0; replica < replicas; replica++ {
+		status, err := self.StartReplica(app, revisionId, dir, appManifest, replica)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, status)
+	}
+
+	lgr.Info("Supervisor started %s revision %s with %d replicas", app, revisionId, replicas)
+
+	return result, nil
+}
+
+// StartReplica starts one replica of revision next to already running ones,
+// running replica with the same revision and index is replaced
+func (self *Supervisor) StartReplica(app, revisionId, dir string, appManifest *manifest.Manifest, replica int) (ProcessStatus, error) {
+	if existing := self.getReplica(app, revisionId, replica); existing != nil {
+		self.removeProcess(existing)
+		existing.Stop()
+	}
+
+	manifestPorts := appManifest.Ports
+	if self.colorOf(app, revisionId) == COLOR_GREEN {
+		manifestPorts = alternatePorts(manifestPorts)
+	}
+
+	ports, err := PORTS.Allocate(app, revisionId, replica, manifestPorts)
+	if err != nil {
+		return ProcessStatus{}, err
+	}
+
+	process := newAppProcess(app, revisionId, replica, dir, appManifest, ports)
+
+	self.mu.Lock()
+	self.processes[app] = append(self.processes[app], process)
+	self.mu.Unlock()
+
+	go tools.SafeGoRoutine(process.watch)
+
+	return process.Status(), nil
+}
+
+// StopReplica stops replica and forgets about it
+func (self *Supervisor) StopReplica(app, revisionId string, replica int) error {
+	process := self.getReplica(app, revisionId, replica)
+
+	if process == nil {
+		return fmt.Errorf("%w: %s revision %s replica %d", ErrReplicaNotFound, app, revisionId, replica)
+	}
+
+	self.removeProcess(process)
+	process.Stop()
+
+	return nil
+}
+
+// Scale starts missing or stops extra replicas of revision, other replicas are untouched
+func (self *Supervisor) Scale(app, revisionId, dir string, appManifest *manifest.Manifest, replicas int) ([]ProcessStatus, error) {
+	self.cancelUpdate(app)
+
+	for _, process := range self.get(app) {
+		if process.revisionId == revisionId && process.replica >= replicas {
+			self.removeProcess(process)
+			process.Stop()
+		}
+	}
+
+	for replica := 0; replica < replicas; replica++ {
+		if self.getReplica(app, revisionId, replica) != nil {
+			continue
+		}
+		if _, err := self.StartReplica(app, revisionId, dir, appManifest, replica); err != nil {
+			return self.statuses(app), err
+		}
+	}
+
+	return self.statuses(app), nil
+}
+
+// Stop stops all replicas of app and keeps their last status
+func (self *Supervisor) Stop(app string) ([]ProcessStatus, error) {
+	self.cancelUpdate(app)
+
+	processes := self.get(app)
+
+	if len(processes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrAppNotFound, app)
+	}
+
+	stopAll(processes)
+
+	return self.statuses(app), nil
+}
+
+// Restart starts every replica again with fresh restart counters
+func (self *Supervisor) Restart(app string) ([]ProcessStatus, error) {
+	processes := self.get(app)
+
+	if len(processes) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrAppNotFound, app)
+	}
+
+	for _, process := range processes {
+		self.removeProcess(process)
+		process.Stop()
+
+		if _, err := self.StartReplica(app, process.revisionId, process.dir, process.manifest, process.replica); err != nil {
+			return self.statuses(app), err
+		}
+	}
+
+	return self.statuses(app), nil
+}
+
+// Remove stops all replicas of app and forgets about them
+func (self *Supervisor) Remove(app string) {
+	self.cancelUpdate(app)
+
+	self.mu.Lock()
+	processes := self.processes[app]
+	delete(self.processes, app)
+	delete(self.colors, app)
+	self.mu.Unlock()
+
+	stopAll(processes)
+}
+
+// Status returns statuses of all replicas of app
+func (self *Supervisor) Status(app string) ([]ProcessStatus, bool) {
+	processes := self.get(app)
+
+	if len(processes) == 0 {
+		return nil, false
+	}
+
+	return self.statuses(app), true
+}
+
+// Ready returns replicas of app that run and pass readiness probe, only replicas
+// of the active color of blue/green app. Usage is not filled.
+func (self *Supervisor) Ready(app string) []ProcessStatus {
+	result := []ProcessStatus{}
+	active := self.activeRevision(app)
+
+	for _, process := range self.get(app) {
+		if active != "" && process.revisionId != active {
+			continue
+		}
+		status := process.snapshot()
+		if status.Ready {
+			result = append(result, status)
+		}
+	}
+
+	return result
+}
+
+// WaitReady blocks until update of app to revision is over (or its canary gets traffic)
+// and every replica of revision is ready, it fails as soon as update was rolled back,
+// a replica gave up or when ctx is done. Empty revisionId waits for all replicas of app.
+func (self *Supervisor) WaitReady(ctx context.Context, app, revisionId string) ([]ProcessStatus, error) {
+	if update := self.getUpdate(app); update != nil && (revisionId == "" || update.Status().RevisionId == revisionId) {
+		select {
+		case <-update.done:
+		case <-update.serving:
+		case <-ctx.Done():
+			return self.revisionStatuses(app, revisionId), fmt.Errorf("%w: update of %s is %s", ErrNotReady, app, update.Status().State)
+		}
+
+		if status := update.Status(); status.State == UPDATE_ROLLED_BACK {
+			return self.revisionStatuses(app, revisionId), fmt.Errorf("%w: %s", ErrNotReady, status.Error)
+		}
+	}
+
+	return self.waitReplicasReady(ctx, app, revisionId)
+}
+
+func (self *Supervisor) waitReplicasReady(ctx context.Context, app, revisionId string) ([]ProcessStatus, error) {
+	ticker := time.NewTicker(READY_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		statuses := []ProcessStatus{}
+		ready := 0
+
+		for _, process := range self.get(app) {
+			if revisionId != "" && process.revisionId != revisionId {
+				continue
+			}
+
+			status := process.snapshot()
+			statuses = append(statuses, status)
+
+			switch status.State {
+			case STATE_EXITED, STATE_FAILED, STATE_STOPPED:
+				return statuses, fmt.Errorf("%w: %s replica %d is %s: %s", ErrNotReady, app, status.Replica, status.State, status.LastError)
+			}
+			if status.Ready {
+				ready++
+			}
+		}
+
+		if len(statuses) == 0 {
+			return statuses, fmt.Errorf("%w: %s revision %s", ErrAppNotFound, app, revisionId)
+		}
+		if ready == len(statuses) {
+			return statuses, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return statuses, fmt.Errorf("%w: %d of %d replicas of %s are ready", ErrNotReady, ready, len(statuses), app)
+		case <-ticker.C:
+		}
+	}
+}
+
+func (self *Supervisor) List() []ProcessStatus {
+	self.mu.Lock()
+	processes := []*AppProcess{}
+	for _, appProcesses := range self.processes {
+		processes = append(processes, appProcesses...)
+	}
+	self.mu.Unlock()
+
+	return sortedStatuses(processes)
+}
+
+// StopAll stops every supervised process, used on shutdown
+func (self *Supervisor) StopAll() {
+	self.mu.Lock()
+	apps := make([]string, 0, len(self.updates))
+	for app := range self.updates {
+		apps = append(apps, app)
+	}
+	self.mu.Unlock()
+
+	for _, app := range apps {
+		self.cancelUpdate(app)
+	}
+
+	self.mu.Lock()
+	processes := []*AppProcess{}
+	for _, appProcesses := range self.processes {
+		processes = append(processes, appProcesses...)
+	}
+	self.mu.Unlock()
+
+	stopAll(processes)
+}
+
+func (self *Supervisor) get(app string) []*AppProcess {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return append([]*AppProcess{}, self.processes[app]...)
+}
+
+func (self *Supervisor) getReplica(app, revisionId string, replica int) *AppProcess {
+	for _, process := range self.get(app) {
+		if process.revisionId == revisionId && process.replica == replica {
+			return process
+		}
+	}
+	return nil
+}
+
+func (self *Supervisor) removeProcess(process *AppProcess) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	processes := self.processes[process.app]
+
+	for i, candidate := range processes {
+		if candidate == process {
+			processes = append(processes[:i:i], processes[i+1:]...)
+			break
+		}
+	}
+
+	if len(processes) == 0 {
+		delete(self.processes, process.app)
+	} else {
+		self.processes[process.app] = processes
+	}
+}
+
+func (self *Supervisor) statuses(app string) []ProcessStatus {
+	return sortedStatuses(self.get(app))
+}
+
+// revisionStatuses returns replicas of revision, of all revisions when revisionId is empty
+func (self *Supervisor) revisionStatuses(app, revisionId string) []ProcessStatus {
+	processes := []*AppProcess{}
+	for _, process := range self.get(app) {
+		if revisionId == "" || process.revisionId == revisionId {
+			processes = append(processes, process)
+		}
+	}
+	return sortedStatuses(processes)
+}
+
+func sortedStatuses(processes []*AppProcess) []ProcessStatus {
+	result := make([]ProcessStatus, 0, len(processes))
+	for _, process := range processes {
+		result = append(result, process.Status())
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].App != result[j].App {
+			return result[i].App < result[j].App
+		}
+		if result[i].RevisionId != result[j].RevisionId {
+			return result[i].RevisionId < result[j].RevisionId
+		}
+		return result[i].Replica < result[j].Replica
+	})
+
+	return result
+}
+
+// stopAll stops processes in parallel and waits for all of them
+func stopAll(processes []*AppProcess) {
+	var wg sync.WaitGroup
+
+	for _, process := range processes {
+		wg.Add(1)
+		go func(p *AppProcess) {
+			defer wg.Done()
+			p.Stop()
+		}(process)
+	}
+
+	wg.Wait()
+}
+
+// NextBackoff returns delay before restart number restartCount (starting with 0)
+func NextBackoff(restartCount int) time.Duration {
+	delay := BACKOFF_MIN
+
+	for i := 0; i < restartCount; i++ {
+		delay *= 2
+		if delay >= BACKOFF_MAX {
+			return BACKOFF_MAX
+		}
+	}
+
+	return delay
+}
+
+// ShouldRestart applies manifest restart policy to exit of process
+func ShouldRestart(policy string, exitCode int, startErr error) bool {
+	switch policy {
+	case manifest.RESTART_ALWAYS:
+		return true
+	case manifest.RESTART_NEVER:
+		return false
+	default:
+		return startErr != nil || exitCode != 0
+	}
+}
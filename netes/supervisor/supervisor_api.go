@@ -0,0 +1,204 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"turtle/core/auth"
+	"turtle/core/serverKit"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DEFAULT_READY_WAIT = 30 * time.Second
+
+// Stays below server write timeout, callers wait longer by asking again
+const MAX_READY_WAIT = 90 * time.Second
+
+/*
+GET /deplistener/apps
+*/
+func _ListApps(c *gin.Context) {
+	serverKit.ReturnOkJson(c, SUPERVISOR.List())
+}
+
+/*
+GET /deplistener/apps/status?app=
+Statuses of all replicas of app
+*/
+func _GetAppStatus(c *gin.Context) {
+	status, ok := SUPERVISOR.Status(c.Query("app"))
+
+	if !ok {
+		serverKit.ReturnUnacceptable(c, ErrAppNotFound)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, status)
+}
+
+/*
+POST /deplistener/apps/stop?app=
+*/
+func _StopApp(c *gin.Context) {
+	status, err := SUPERVISOR.Stop(c.Query("app"))
+	returnStatus(c, status, err)
+}
+
+/*
+POST /deplistener/apps/restart?app=
+*/
+func _RestartApp(c *gin.Context) {
+	status, err := SUPERVISOR.Restart(c.Query("app"))
+	returnStatus(c, status, err)
+}
+
+/*
+GET /deplistener/apps/ports?app=
+Port to replica mapping, of all apps when app is empty
+*/
+func _ListPorts(c *gin.Context) {
+	serverKit.ReturnOkJson(c, PORTS.List(c.Query("app")))
+}
+
+/*
+GET /deplistener/apps/ready?app=&revisionId=&timeoutSeconds=30
+Waits until update to revision is over and all replicas of revision (of app when
+revisionId is empty) are ready, returns report with ready false when timeout passes
+and 406 when update was rolled back or a replica gave up
+*/
+func _WaitAppReady(c *gin.Context) {
+	timeout := DEFAULT_READY_WAIT
+
+	if value := c.Query("timeoutSeconds"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			serverKit.ReturnUnacceptable(c, fmt.Errorf("%w: timeoutSeconds must be positive number", ErrNotReady))
+			return
+		}
+		timeout = min(time.Duration(seconds)*time.Second, MAX_READY_WAIT)
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), timeout)
+	defer cancel()
+
+	app := c.Query("app")
+
+	status, err := SUPERVISOR.WaitReady(ctx, app, c.Query("revisionId"))
+
+	report := ReadyReport{
+		Ready:    err == nil,
+		Replicas: status,
+	}
+	if update, err := SUPERVISOR.GetUpdate(app); err == nil {
+		report.Update = &update
+	}
+
+	// Timeout is not a failure, caller sees which replicas are not ready yet
+	if errors.Is(err, ErrNotReady) && ctx.Err() != nil {
+		err = nil
+	}
+
+	if err != nil {
+		returnStatus(c, status, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, report)
+}
+
+/*
+GET /deplistener/apps/update?app=
+Status of the last rolling, blue/green or canary update of app
+*/
+func _GetAppUpdate(c *gin.Context) {
+	update, err := SUPERVISOR.GetUpdate(c.Query("app"))
+	returnUpdate(c, update, err)
+}
+
+/*
+POST /deplistener/apps/update/pause?app=
+Old and new replicas keep running as they are until update is resumed
+*/
+func _PauseAppUpdate(c *gin.Context) {
+	update, err := SUPERVISOR.PauseUpdate(c.Query("app"))
+	returnUpdate(c, update, err)
+}
+
+/*
+POST /deplistener/apps/update/resume?app=
+*/
+func _ResumeAppUpdate(c *gin.Context) {
+	update, err := SUPERVISOR.ResumeUpdate(c.Query("app"))
+	returnUpdate(c, update, err)
+}
+
+/*
+POST /deplistener/apps/update/promote?app=
+Moves canary to its next traffic step
+*/
+func _PromoteAppUpdate(c *gin.Context) {
+	update, err := SUPERVISOR.PromoteUpdate(c.Query("app"))
+	returnUpdate(c, update, err)
+}
+
+/*
+POST /deplistener/apps/update/rollback?app=
+Stops new replicas and starts old replicas again
+*/
+func _RollbackAppUpdate(c *gin.Context) {
+	update, err := SUPERVISOR.RollbackUpdate(c.Query("app"))
+	returnUpdate(c, update, err)
+}
+
+/*
+GET /deplistener/apps/colors?app=
+Blue and green revision of app with their replicas and the active color
+*/
+func _GetAppColors(c *gin.Context) {
+	colors, err := SUPERVISOR.GetColors(c.Query("app"))
+
+	if errors.Is(err, ErrColorsNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+		return
+	}
+
+	serverKit.ReturnOkJson(c, colors)
+}
+
+func returnStatus(c *gin.Context, status []ProcessStatus, err error) {
+	if errors.Is(err, ErrAppNotFound) || errors.Is(err, ErrNotReady) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else {
+		serverKit.ReturnOkJson(c, status)
+	}
+}
+
+func returnUpdate(c *gin.Context, update UpdateStatus, err error) {
+	if errors.Is(err, ErrUpdateNotFound) {
+		serverKit.ReturnUnacceptable(c, err)
+	} else if err != nil {
+		serverKit.ReturnError(c, err)
+	} else {
+		serverKit.ReturnOkJson(c, update)
+	}
+}
+
+func InitSupervisorApi(r *gin.Engine) {
+	r.GET("/deplistener/apps", auth.ApiKeysRequired, _ListApps)
+	r.GET("/deplistener/apps/status", auth.ApiKeysRequired, _GetAppStatus)
+	r.POST("/deplistener/apps/stop", auth.ApiKeysRequired, _StopApp)
+	r.POST("/deplistener/apps/restart", auth.ApiKeysRequired, _RestartApp)
+	r.GET("/deplistener/apps/ports", auth.ApiKeysRequired, _ListPorts)
+	r.GET("/deplistener/apps/ready", auth.ApiKeysRequired, _WaitAppReady)
+	r.GET("/deplistener/apps/update", auth.ApiKeysRequired, _GetAppUpdate)
+	r.POST("/deplistener/apps/update/pause", auth.ApiKeysRequired, _PauseAppUpdate)
+	r.POST("/deplistener/apps/update/resume", auth.ApiKeysRequired, _ResumeAppUpdate)
+	r.POST("/deplistener/apps/update/promote", auth.ApiKeysRequired, _PromoteAppUpdate)
+	r.POST("/deplistener/apps/update/rollback", auth.ApiKeysRequired, _RollbackAppUpdate)
+	r.GET("/deplistener/apps/colors", auth.ApiKeysRequired, _GetAppColors)
+}
@@ -0,0 +1,525 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+	"turtle/core/lgr"
+	"turtle/core/tools"
+	"turtle/netes/events"
+	"turtle/netes/manifest"
+)
+
+const (
+	UPDATE_PROGRESSING = "progressing"
+	UPDATE_PAUSED      = "paused"
+	UPDATE_COMPLETED   = "completed"
+	UPDATE_ROLLED_BACK = "rolledBack"
+	UPDATE_CANCELED    = "canceled"
+)
+
+var (
+	ErrUpdateNotFound = errors.New("update not found")
+	ErrUpdateFailed   = errors.New("update failed")
+)
+
+// UpdateStatus is progress of replacing replicas of app with replicas of revision
+type UpdateStatus struct {
+	App        string `json:"app"`
+	RevisionId string `json:"revisionId"`
+	Strategy   string `json:"strategy"`
+	State      string `json:"state"`
+	Replicas   int    `json:"replicas"`
+	// New replicas started and new replicas ready
+	Updated int    `json:"updated"`
+	Ready   int    `json:"ready"`
+	Error   string `json:"error,omitempty"`
+	// Percent of traffic of canary step and responses of canary in the step
+	Weight         int       `json:"weight,omitempty"`
+	CanaryRequests int64     `json:"canaryRequests,omitempty"`
+	CanaryErrors   int64     `json:"canaryErrors,omitempty"`
+	StartedAt      time.Time `json:"startedAt"`
+	FinishedAt     time.Time `json:"finishedAt"`
+}
+
+// ReadyReport tells whether revision finished updating and all its replicas are ready
+type ReadyReport struct {
+	Ready    bool            `json:"ready"`
+	Replicas []ProcessStatus `json:"replicas"`
+	Update   *UpdateStatus   `json:"update,omitempty"`
+}
+
+// replicaSpec is enough to start stopped old replica again on rollback
+type replicaSpec struct {
+	revisionId string
+	dir        string
+	manifest   *manifest.Manifest
+	replica    int
+}
+
+type appUpdate struct {
+	mu           sync.Mutex
+	status       UpdateStatus
+	autoRollback bool
+	paused       bool
+	resumeCh     chan struct{}
+	promoteCh    chan struct{}
+	// Closed when new revision gets traffic while update goes on, canary only
+	serving     chan struct{}
+	servingOnce sync.Once
+
+	// ctx is canceled when update is superseded, rollbackCtx also on rollback request
+	ctx             context.Context
+	cancel          context.CancelFunc
+	rollbackCtx     context.Context
+	requestRollback context.CancelFunc
+	done            chan struct{}
+}
+
+func newAppUpdate(app, revisionId string, replicas int, autoRollback bool) *appUpdate {
+	ctx, cancel := context.WithCancel(context.Background())
+	rollbackCtx, requestRollback := context.WithCancel(ctx)
+
+	return &appUpdate{
+		status: UpdateStatus{
+			App:        app,
+			RevisionId: revisionId,
+			Strategy:   manifest.STRATEGY_ROLLING,
+			State:      UPDATE_PROGRESSING,
+			Replicas:   replicas,
+			StartedAt:  time.Now(),
+		},
+		autoRollback:    autoRollback,
+		resumeCh:        make(chan struct{}, 1),
+		promoteCh:       make(chan struct{}, 1),
+		serving:         make(chan struct{}),
+		ctx:             ctx,
+		cancel:          cancel,
+		rollbackCtx:     rollbackCtx,
+		requestRollback: requestRollback,
+		done:            make(chan struct{}),
+	}
+}
+
+func (self *appUpdate) Status() UpdateStatus {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.status
+}
+
+func (self *appUpdate) setProgress(updated, ready int) {
+	self.mu.Lock()
+	self.status.Updated = updated
+	self.status.Ready = ready
+	self.mu.Unlock()
+}
+
+// setWeight records traffic percent of canary, new revision is serving from now on
+func (self *appUpdate) setWeight(weight int) {
+	self.mu.Lock()
+	self.status.Weight = weight
+	self.status.CanaryRequests = 0
+	self.status.CanaryErrors = 0
+	self.mu.Unlock()
+
+	self.servingOnce.Do(func() {
+		close(self.serving)
+	})
+}
+
+func (self *appUpdate) setCanaryStats(requests, errors int64) {
+	self.mu.Lock()
+	self.status.CanaryRequests = requests
+	self.status.CanaryErrors = errors
+	self.mu.Unlock()
+}
+
+func (self *appUpdate) finish(state string, err error) {
+	self.mu.Lock()
+	self.status.State = state
+	self.status.FinishedAt = time.Now()
+	if err != nil {
+		self.status.Error = err.Error()
+	}
+	status := self.status
+	self.mu.Unlock()
+
+	if state == UPDATE_COMPLETED {
+		events.Emitf(events.EVENT_UPDATE_FINISHED, status.App, status.RevisionId, "%s update %s", status.Strategy, state)
+	} else {
+		events.Warnf(events.EVENT_UPDATE_FINISHED, status.App, status.RevisionId, "%s update %s: %s", status.Strategy, state, status.Error)
+	}
+}
+
+func (self *appUpdate) pause(err error) {
+	self.mu.Lock()
+	self.paused = true
+	self.status.State = UPDATE_PAUSED
+	if err != nil {
+		self.status.Error = err.Error()
+	}
+	self.mu.Unlock()
+}
+
+func (self *appUpdate) resume() {
+	self.mu.Lock()
+	self.paused = false
+	self.status.State = UPDATE_PROGRESSING
+	self.status.Error = ""
+	self.mu.Unlock()
+
+	select {
+	case self.resumeCh <- struct{}{}:
+	default:
+	}
+}
+
+// checkpoint blocks while update is paused, error means update must not continue
+func (self *appUpdate) checkpoint() error {
+	for {
+		self.mu.Lock()
+		paused := self.paused
+		self.mu.Unlock()
+
+		if err := self.rollbackCtx.Err(); err != nil {
+			return err
+		}
+		if !paused {
+			return nil
+		}
+
+		select {
+		case <-self.rollbackCtx.Done():
+		case <-self.resumeCh:
+		}
+	}
+}
+
+func (self *appUpdate) isActive() bool {
+	select {
+	case <-self.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Update replaces replicas of app with replicas of revision by update strategy of the
+// manifest. Rolling, blue/green and canary update run in background and onFinished is called
+// when it completed, was rolled back or canceled. Without old replicas app is just started.
+func (self *Supervisor) Update(app, revisionId, dir string, appManifest *manifest.Manifest, replicas int, onFinished func(UpdateStatus)) ([]ProcessStatus, error) {
+	self.cancelUpdate(app)
+
+	if replicas < 1 {
+		replicas = 1
+	}
+
+	if appManifest.Update.Type == manifest.STRATEGY_BLUE_GREEN || appManifest.Update.Type == manifest.STRATEGY_CANARY {
+		return self.colorUpdate(app, revisionId, dir, appManifest, replicas, onFinished)
+	}
+
+	self.clearColors(app)
+
+	if processes := self.get(app); len(processes) > 0 && runsAs(processes, revisionId, appManifest) {
+		// Revision already runs as requested, only number of replicas can change
+		return self.Scale(app, revisionId, dir, appManifest, replicas)
+	}
+
+	old := []*AppProcess{}
+	for _, process := range self.get(app) {
+		if process.revisionId == revisionId {
+			// Same revision again, nothing to roll
+			old = nil
+			break
+		}
+		old = append(old, process)
+	}
+
+	if appManifest.Update.Type != manifest.STRATEGY_ROLLING || len(old) == 0 {
+		return self.Start(app, revisionId, dir, appManifest, replicas)
+	}
+
+	update := newAppUpdate(app, revisionId, replicas, appManifest.Update.RollbackOnFailure())
+
+	self.mu.Lock()
+	self.updates[app] = update
+	self.mu.Unlock()
+
+	lgr.Info("Rolling update of %s to revision %s started, %d old replicas", app, revisionId, len(old))
+	events.Emitf(events.EVENT_UPDATE_STARTED, app, revisionId, "rolling update of %d replicas started", replicas)
+
+	go tools.SafeGoRoutine(func() {
+		defer close(update.done)
+
+		self.rollingUpdate(update, old, dir, appManifest)
+
+		if onFinished != nil {
+			onFinished(update.Status())
+		}
+	})
+
+	return self.statuses(app), nil
+}
+
+// runsAs tells every process runs revision with the same manifest, stopped and
+// exited processes don't count as running
+func runsAs(processes []*AppProcess, revisionId string, appManifest *manifest.Manifest) bool {
+	for _, process := range processes {
+		if process.revisionId != revisionId || !reflect.DeepEqual(process.manifest, appManifest) {
+			return false
+		}
+
+		switch process.snapshot().State {
+		case STATE_STOPPED, STATE_EXITED, STATE_FAILED:
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Supervisor) rollingUpdate(update *appUpdate, old []*AppProcess, dir string, appManifest *manifest.Manifest) {
+	app, revisionId, replicas := update.status.App, update.status.RevisionId, update.status.Replicas
+	strategy := appManifest.Update
+
+	surge, unavailable := strategy.MaxSurge, strategy.MaxUnavailable
+	// Fixed port can't be bound by old and new replica at the same time
+	if appManifest.HasFixedPorts() {
+		surge = 0
+		unavailable = max(unavailable, 1)
+	}
+
+	// Replicas with highest index go first
+	sort.Slice(old, func(i, j int) bool {
+		return old[i].replica > old[j].replica
+	})
+
+	stopped := []replicaSpec{}
+	started, ready := 0, 0
+
+	for {
+		if err := update.checkpoint(); err != nil {
+			self.endUpdate(update, stopped, err)
+			return
+		}
+
+		progressed := false
+		var startErr error
+
+		for started < replicas && len(old)+started < replicas+surge {
+			if _, startErr = self.StartReplica(app, revisionId, dir, appManifest, started); startErr != nil {
+				break
+			}
+			started++
+			progressed = true
+		}
+
+		if startErr != nil {
+			if self.updateFailed(update, stopped, startErr) {
+				return
+			}
+			continue
+		}
+
+		for len(old) > 0 && (ready == replicas || len(old)-1+ready >= replicas-unavailable) {
+			process := old[0]
+			old = old[1:]
+
+			self.removeProcess(process)
+			process.Stop()
+
+			stopped = append(stopped, replicaSpec{
+				revisionId: process.revisionId,
+				dir:        process.dir,
+				manifest:   process.manifest,
+				replica:    process.replica,
+			})
+			progressed = true
+		}
+
+		update.setProgress(started, ready)
+
+		if started == replicas && ready == replicas && len(old) == 0 {
+			update.finish(UPDATE_COMPLETED, nil)
+			lgr.Ok("Rolling update of %s to revision %s completed", app, revisionId)
+			return
+		}
+
+		if progressed {
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(update.rollbackCtx, time.Duration(strategy.ReadyTimeoutSeconds)*time.Second)
+		_, err := self.waitReplicasReady(ctx, app, revisionId)
+		cancel()
+
+		if err == nil {
+			ready = started
+			continue
+		}
+
+		if self.updateFailed(update, stopped, err) {
+			return
+		}
+	}
+}
+
+// updateFailed rolls update back, or pauses it when manifest disabled auto rollback,
+// true means update is over
+func (self *Supervisor) updateFailed(update *appUpdate, stopped []replicaSpec, err error) bool {
+	if update.rollbackCtx.Err() != nil {
+		self.endUpdate(update, stopped, update.rollbackCtx.Err())
+		return true
+	}
+
+	if !update.autoRollback {
+		status := update.Status()
+		lgr.Error("Update of %s to revision %s paused: %s", status.App, status.RevisionId, err.Error())
+		events.Warnf(events.EVENT_UPDATE_PAUSED, status.App, status.RevisionId, "%s update paused: %s", status.Strategy, err.Error())
+		update.pause(err)
+		return false
+	}
+
+	self.rollback(update, stopped, err)
+	return true
+}
+
+// endUpdate handles checkpoint errors, update was superseded or rollback was requested
+func (self *Supervisor) endUpdate(update *appUpdate, stopped []replicaSpec, err error) {
+	if update.ctx.Err() != nil {
+		update.finish(UPDATE_CANCELED, nil)
+		return
+	}
+	self.rollback(update, stopped, fmt.Errorf("rollback requested"))
+}
+
+// rollback stops new replicas and starts stopped old replicas again
+func (self *Supervisor) rollback(update *appUpdate, stopped []replicaSpec, cause error) {
+	status := update.Status()
+
+	lgr.Error("Rolling back %s update of %s to revision %s: %s", status.Strategy, status.App, status.RevisionId, cause.Error())
+	events.Warnf(events.EVENT_ROLLBACK, status.App, status.RevisionId, "rolling back %s update: %s", status.Strategy, cause.Error())
+
+	for _, process := range self.get(status.App) {
+		if process.revisionId == status.RevisionId {
+			self.removeProcess(process)
+			process.Stop()
+		}
+	}
+
+	// Blue/green color of failed revision goes back to revision it replaced
+	replacement := ""
+	if len(stopped) > 0 {
+		replacement = stopped[0].revisionId
+	}
+	self.replaceColor(status.App, status.RevisionId, replacement)
+
+	for _, spec := range stopped {
+		if _, err := self.StartReplica(status.App, spec.revisionId, spec.dir, spec.manifest, spec.replica); err != nil {
+			lgr.Error("Failed to start replica %d of %s revision %s on rollback: %s", spec.replica, status.App, spec.revisionId, err.Error())
+		}
+	}
+
+	update.finish(UPDATE_ROLLED_BACK, fmt.Errorf("%w: %w", ErrUpdateFailed, cause))
+}
+
+// cancelUpdate stops running update of app and leaves replicas as they are
+func (self *Supervisor) cancelUpdate(app string) {
+	self.mu.Lock()
+	update := self.updates[app]
+	self.mu.Unlock()
+
+	if update == nil || !update.isActive() {
+		return
+	}
+
+	update.cancel()
+	<-update.done
+}
+
+func (self *Supervisor) getUpdate(app string) *appUpdate {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.updates[app]
+}
+
+// GetUpdate returns status of the last update of app
+func (self *Supervisor) GetUpdate(app string) (UpdateStatus, error) {
+	update := self.getUpdate(app)
+	if update == nil {
+		return UpdateStatus{}, fmt.Errorf("%w: %s", ErrUpdateNotFound, app)
+	}
+	return update.Status(), nil
+}
+
+func (self *Supervisor) activeUpdate(app string) (*appUpdate, error) {
+	update := self.getUpdate(app)
+	if update == nil || !update.isActive() {
+		return nil, fmt.Errorf("%w: %s has no update in progress", ErrUpdateNotFound, app)
+	}
+	return update, nil
+}
+
+// PauseUpdate stops update of app before its next step
+func (self *Supervisor) PauseUpdate(app string) (UpdateStatus, error) {
+	update, err := self.activeUpdate(app)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+
+	update.pause(nil)
+	lgr.Info("Update of %s paused", app)
+
+	return update.Status(), nil
+}
+
+// ResumeUpdate continues paused update, failed readiness wait is tried again
+func (self *Supervisor) ResumeUpdate(app string) (UpdateStatus, error) {
+	update, err := self.activeUpdate(app)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+
+	update.resume()
+	lgr.Info("Update of %s resumed", app)
+
+	return update.Status(), nil
+}
+
+// PromoteUpdate moves canary of app to its next step right away, paused canary is resumed
+func (self *Supervisor) PromoteUpdate(app string) (UpdateStatus, error) {
+	update, err := self.activeUpdate(app)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+	if update.Status().Strategy != manifest.STRATEGY_CANARY {
+		return UpdateStatus{}, fmt.Errorf("%w: %s has no canary in progress", ErrUpdateNotFound, app)
+	}
+
+	update.resume()
+
+	select {
+	case update.promoteCh <- struct{}{}:
+	default:
+	}
+
+	lgr.Info("Canary of %s promoted", app)
+
+	return update.Status(), nil
+}
+
+// RollbackUpdate aborts update of app and waits until old replicas are back
+func (self *Supervisor) RollbackUpdate(app string) (UpdateStatus, error) {
+	update, err := self.activeUpdate(app)
+	if err != nil {
+		return UpdateStatus{}, err
+	}
+
+	update.requestRollback()
+	<-update.done
+
+	return update.Status(), nil
+}
@@ -0,0 +1,249 @@
+package supervisor
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+	"turtle/core/serverKit"
+	"turtle/netes/manifest"
+)
+
+const (
+	RUNNING_SCRIPT = "#!/bin/sh\nexec sleep 60\n"
+	FAILING_SCRIPT = "#!/bin/sh\nexit 1\n"
+)
+
+// useTestConfig keeps deployments, logs and cgroups of the test in its temp dir
+func useTestConfig(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	previous := serverKit.SERVER_CONFIG
+	serverKit.SERVER_CONFIG = &serverKit.GinServerConfig{
+		DeployDir:  dir,
+		CgroupRoot: filepath.Join(dir, "no-cgroups"),
+	}
+	t.Cleanup(func() {
+		serverKit.SERVER_CONFIG = previous
+	})
+
+	return dir
+}
+
+func writeRevision(t *testing.T, root, revisionId, script string) string {
+	t.Helper()
+
+	dir := filepath.Join(root, revisionId)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "run.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	return dir
+}
+
+func freePort(t *testing.T) int {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// countRunning returns replicas of app which are not stopped or failed
+func countRunning(supervisor *Supervisor, app, revisionId string) int {
+	count := 0
+	for _, process := range supervisor.get(app) {
+		if revisionId != "" && process.revisionId != revisionId {
+			continue
+		}
+		switch process.snapshot().State {
+		case STATE_STOPPED, STATE_EXITED, STATE_FAILED:
+		default:
+			count++
+		}
+	}
+	return count
+}
+
+func TestRollingUpdate(t *testing.T) {
+	disabled := false
+
+	tests := []struct {
+		name     string
+		replicas int
+		update   manifest.UpdateStrategy
+		ports    []manifest.Port
+		script   string
+		// Rolls back paused update when set
+		rollback bool
+
+		wantState string
+		// Replicas of the new and of the old revision when update is over
+		wantNew int
+		wantOld int
+		// Most replicas running at once during update
+		maxRunning int
+	}{
+		{
+			name:       "surge",
+			replicas:   3,
+			update:     manifest.UpdateStrategy{MaxSurge: 1},
+			script:     RUNNING_SCRIPT,
+			wantState:  UPDATE_COMPLETED,
+			wantNew:    3,
+			maxRunning: 4,
+		},
+		{
+			name:       "unavailable without surge",
+			replicas:   3,
+			update:     manifest.UpdateStrategy{MaxUnavailable: 1},
+			script:     RUNNING_SCRIPT,
+			wantState:  UPDATE_COMPLETED,
+			wantNew:    3,
+			maxRunning: 3,
+		},
+		{
+			name:       "fixed port disables surge",
+			replicas:   1,
+			update:     manifest.UpdateStrategy{MaxSurge: 1},
+			ports:      []manifest.Port{{Port: freePort(t)}},
+			script:     RUNNING_SCRIPT,
+			wantState:  UPDATE_COMPLETED,
+			wantNew:    1,
+			maxRunning: 1,
+		},
+		{
+			name:       "failed update is rolled back",
+			replicas:   3,
+			update:     manifest.UpdateStrategy{MaxSurge: 1},
+			script:     FAILING_SCRIPT,
+			wantState:  UPDATE_ROLLED_BACK,
+			wantOld:    3,
+			maxRunning: 4,
+		},
+		{
+			name:       "paused update is rolled back on request",
+			replicas:   2,
+			update:     manifest.UpdateStrategy{MaxSurge: 1, AutoRollback: &disabled},
+			script:     FAILING_SCRIPT,
+			rollback:   true,
+			wantState:  UPDATE_ROLLED_BACK,
+			wantOld:    2,
+			maxRunning: 3,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			root := useTestConfig(t)
+			supervisor := NewSupervisor()
+			app := "rolling"
+			t.Cleanup(func() {
+				supervisor.Remove(app)
+			})
+
+			oldManifest := &manifest.Manifest{App: app, Version: "1", Command: "./run.sh", Ports: test.ports}
+			oldManifest.ApplyDefaults()
+
+			if _, err := supervisor.Start(app, "old", writeRevision(t, root, "old", RUNNING_SCRIPT), oldManifest, test.replicas); err != nil {
+				t.Fatalf("Start() failed: %v", err)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			if _, err := supervisor.waitReplicasReady(ctx, app, "old"); err != nil {
+				t.Fatalf("old replicas are not ready: %v", err)
+			}
+
+			newManifest := &manifest.Manifest{
+				App:           app,
+				Version:       "2",
+				Command:       "./run.sh",
+				Ports:         test.ports,
+				RestartPolicy: manifest.RESTART_NEVER,
+				Update:        test.update,
+			}
+			newManifest.Update.ReadyTimeoutSeconds = 10
+			newManifest.ApplyDefaults()
+
+			var maxRunning atomic.Int64
+			stopSampling := make(chan struct{})
+			sampled := make(chan struct{})
+			go func() {
+				defer close(sampled)
+				for {
+					if running := int64(countRunning(supervisor, app, "")); running > maxRunning.Load() {
+						maxRunning.Store(running)
+					}
+					select {
+					case <-stopSampling:
+						return
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}()
+
+			finished := make(chan UpdateStatus, 1)
+			if _, err := supervisor.Update(app, "new", writeRevision(t, root, "new", test.script), newManifest, test.replicas, func(status UpdateStatus) {
+				finished <- status
+			}); err != nil {
+				t.Fatalf("Update() failed: %v", err)
+			}
+
+			if test.rollback {
+				waitUpdateState(t, supervisor, app, UPDATE_PAUSED)
+				if _, err := supervisor.RollbackUpdate(app); err != nil {
+					t.Fatalf("RollbackUpdate() failed: %v", err)
+				}
+			}
+
+			var status UpdateStatus
+			select {
+			case status = <-finished:
+			case <-time.After(30 * time.Second):
+				t.Fatal("update did not finish")
+			}
+
+			close(stopSampling)
+			<-sampled
+
+			if status.State != test.wantState {
+				t.Fatalf("update state = %s (%s), want %s", status.State, status.Error, test.wantState)
+			}
+			if got := countRunning(supervisor, app, "new"); got != test.wantNew {
+				t.Errorf("new replicas = %d, want %d", got, test.wantNew)
+			}
+			if got := countRunning(supervisor, app, "old"); got != test.wantOld {
+				t.Errorf("old replicas = %d, want %d", got, test.wantOld)
+			}
+			if got := int(maxRunning.Load()); got > test.maxRunning {
+				t.Errorf("%d replicas ran at once, want at most %d", got, test.maxRunning)
+			}
+		})
+	}
+}
+
+func waitUpdateState(t *testing.T, supervisor *Supervisor, app, state string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if status, err := supervisor.GetUpdate(app); err == nil && status.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("update of %s did not become %s", app, state)
+}